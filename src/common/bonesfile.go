@@ -0,0 +1,408 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A bonesFile can be written as JSON, YAML or TOML. Each is parsed into the
+// same tree of nodes that remember where they came from, so a mistake is
+// reported at its line and column whatever the format. A bonesFile can
+// include others, which are merged underneath it.
+
+// BonesFileNames are the names a bonesFile can have, one per format
+var BonesFileNames = []string{"bonesFile", "bonesFile.yaml", "bonesFile.yml", "bonesFile.toml"}
+
+// includeKey is the top level key listing the files a bonesFile includes
+const includeKey = "include"
+
+// position is where a value starts
+type position struct {
+	file   string
+	line   int
+	column int
+}
+
+// node is a value read from a bonesFile
+type node struct {
+	position
+
+	// kind is '{' or '[' for objects and lists, '"' for strings, '0' for
+	// numbers, 't' for true and false, 'n' for null and 'p' for plain
+	// YAML scalars, which are read as whatever type is wanted
+	kind     byte
+	value    string
+	keys     []string
+	keyAt    []position
+	children []*node
+}
+
+// get finds the value of a key in an object
+func (n *node) get(key string) (*node, int) {
+	for i, k := range n.keys {
+		if k == key {
+			return n.children[i], i
+		}
+	}
+	return nil, -1
+}
+
+// remove drops the i-th key of an object
+func (n *node) remove(i int) {
+	n.keys = append(n.keys[:i], n.keys[i+1:]...)
+	n.keyAt = append(n.keyAt[:i], n.keyAt[i+1:]...)
+	n.children = append(n.children[:i], n.children[i+1:]...)
+}
+
+func parseError(p position, message string) error {
+	return ValidationErrors{&ValidationError{File: p.file, Line: p.line, Column: p.column,
+		Message: message}}
+}
+
+// bonesFilesIn lists the bonesFiles in a directory
+func bonesFilesIn(dir string) []string {
+	found := []string{}
+	for _, name := range BonesFileNames {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err == nil && !info.IsDir() {
+			found = append(found, name)
+		}
+	}
+	return found
+}
+
+// FindBonesFile finds the bonesFile in a directory, whatever its format
+func FindBonesFile(dir string) (string, error) {
+	found := bonesFilesIn(dir)
+	if len(found) == 0 {
+		return "", errors.New("No bonesFile in " + dir)
+	}
+	if len(found) > 1 {
+		return "", errors.New("Only one bonesFile can be used, found " + strings.Join(found, ", "))
+	}
+	return filepath.Join(dir, found[0]), nil
+}
+
+// SearchBonesFile finds the bonesFile in a directory or the nearest
+// directory above it, so skeleton can be run from anywhere in a project
+func SearchBonesFile(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for start := dir; ; {
+		if len(bonesFilesIn(dir)) > 0 {
+			return FindBonesFile(dir)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", errors.New("No bonesFile in " + start + " or any directory above it")
+		}
+		dir = parent
+	}
+}
+
+var envName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// EnvFile finds the overlay for an environment next to a bonesFile, such as
+// bonesFile.production or bonesFile.production.yaml. An overlay can be in a
+// different format from the bonesFile
+func EnvFile(name string, env string) (string, error) {
+	if !envName.MatchString(env) {
+		return "", errors.New(env + " is not an environment, use letters, digits, - and _")
+	}
+	base := strings.TrimSuffix(name, filepath.Ext(name)) + "." + env
+
+	found := []string{}
+	for _, ext := range []string{"", ".yaml", ".yml", ".toml"} {
+		_, err := os.Stat(base + ext)
+		if err == nil {
+			found = append(found, base+ext)
+		}
+	}
+	if len(found) == 0 {
+		return "", errors.New("No bonesFile for " + env + ", expected " + base)
+	}
+	if len(found) > 1 {
+		return "", errors.New("Only one bonesFile can be used for " + env + ", found " +
+			strings.Join(found, ", "))
+	}
+	return found[0], nil
+}
+
+// parseBonesFile parses a bonesFile in the format its name says
+func parseBonesFile(name string, b []byte) (*node, error) {
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml":
+		return parseYAML(name, b)
+	case ".toml":
+		return parseTOML(name, b)
+	}
+	return parseJSON(name, b)
+}
+
+// loadBonesFile reads a bonesFile and merges everything it includes beneath
+// it. Included files are found relative to the file including them, and
+// later ones win over earlier ones. loading is the files being read, to catch
+// files that include themselves
+func loadBonesFile(name string, loading []string) (n *node, err error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return
+	}
+	n, err = parseBonesFile(name, b)
+	if err != nil || n.kind != '{' {
+		return
+	}
+
+	includes, i := n.get(includeKey)
+	if includes == nil {
+		return
+	}
+	n.remove(i)
+
+	files := []*node{includes}
+	switch includes.kind {
+	case '[':
+		files = includes.children
+	case 'n':
+		files = nil
+	}
+
+	chain := append(append([]string{}, loading...), name)
+	merged := &node{position: n.position, kind: '{'}
+	for _, f := range files {
+		if f.kind != '"' && f.kind != 'p' {
+			return nil, parseError(f.position, includeKey+": expected a file name")
+		}
+		path := f.value
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(name), path)
+		}
+		_, err = os.Stat(path)
+		if err != nil {
+			return nil, parseError(f.position, includeKey+": no file "+f.value)
+		}
+		if including(chain, path) {
+			return nil, parseError(f.position, includeKey+": "+f.value+" includes "+name)
+		}
+
+		var included *node
+		included, err = loadBonesFile(path, chain)
+		if err != nil {
+			return
+		}
+		merged = merge(merged, included)
+	}
+	return merge(merged, n), nil
+}
+
+// loadOverlaid reads a bonesFile and merges overlays on top of it in order
+func loadOverlaid(name string, overlays []string) (n *node, err error) {
+	n, err = loadBonesFile(name, nil)
+	if err != nil {
+		return
+	}
+	for _, o := range overlays {
+		var overlay *node
+		overlay, err = loadBonesFile(o, nil)
+		if err != nil {
+			return
+		}
+		n = merge(n, overlay)
+	}
+	return
+}
+
+// including is true if a file is already being read
+func including(loading []string, name string) bool {
+	abs, _ := filepath.Abs(name)
+	for _, l := range loading {
+		l, _ = filepath.Abs(l)
+		if l == abs {
+			return true
+		}
+	}
+	return false
+}
+
+// merge lays over on top of base. Objects are merged key by key, anything
+// else in over replaces what is in base. A key over gives twice is kept
+// twice, so it is reported
+func merge(base *node, over *node) *node {
+	if base == nil || base.kind != '{' || over.kind != '{' {
+		return over
+	}
+
+	merged := &node{position: over.position, kind: '{'}
+	merged.keys = append(merged.keys, base.keys...)
+	merged.keyAt = append(merged.keyAt, base.keyAt...)
+	merged.children = append(merged.children, base.children...)
+
+	seen := make(map[string]bool)
+	for i, key := range over.keys {
+		_, j := merged.get(key)
+		if j < 0 || seen[key] {
+			merged.keys = append(merged.keys, key)
+			merged.keyAt = append(merged.keyAt, over.keyAt[i])
+			merged.children = append(merged.children, over.children[i])
+		} else {
+			merged.keyAt[j] = over.keyAt[i]
+			merged.children[j] = merge(merged.children[j], over.children[i])
+		}
+		seen[key] = true
+	}
+	return merged
+}
+
+// MarshalJSON writes a node back out as JSON, keeping the order of its keys
+func (n *node) MarshalJSON() ([]byte, error) {
+	switch n.kind {
+	case '{', '[':
+		b := &bytes.Buffer{}
+		b.WriteByte(n.kind)
+		for i, child := range n.children {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if n.kind == '{' {
+				key, _ := json.Marshal(n.keys[i])
+				b.Write(key)
+				b.WriteByte(':')
+			}
+			value, err := child.MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			b.Write(value)
+		}
+		if n.kind == '{' {
+			b.WriteByte('}')
+		} else {
+			b.WriteByte(']')
+		}
+		return b.Bytes(), nil
+	case '0', 't':
+		return []byte(n.value), nil
+	case 'n':
+		return []byte("null"), nil
+	}
+	return json.Marshal(n.value)
+}
+
+// jsonParser parses JSON keeping where every value starts
+type jsonParser struct {
+	dec   *json.Decoder
+	b     []byte
+	file  string
+	lines []int
+}
+
+func parseJSON(file string, b []byte) (n *node, err error) {
+	p := &jsonParser{b: b, file: file, lines: []int{0}}
+	for i, c := range b {
+		if c == '\n' {
+			p.lines = append(p.lines, i+1)
+		}
+	}
+
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, parseError(p.at(0), "bonesFile is empty")
+	}
+
+	// The decoder's tokens don't say where a syntax error is, Unmarshal does
+	var any interface{}
+	err = json.Unmarshal(b, &any)
+	if err != nil {
+		offset := len(b)
+		e, ok := err.(*json.SyntaxError)
+		if ok && e.Offset > 0 {
+			// The offset is past the character at fault
+			offset = int(e.Offset) - 1
+		}
+		return nil, parseError(p.at(offset), "invalid JSON: "+err.Error())
+	}
+
+	p.dec = json.NewDecoder(bytes.NewReader(b))
+	p.dec.UseNumber()
+	n, err = p.value()
+	if err != nil {
+		return
+	}
+	_, err = p.dec.Token()
+	if err != io.EOF {
+		return nil, parseError(p.at(p.start()), "invalid JSON: text after the end")
+	}
+	return n, nil
+}
+
+// at turns an offset into a position
+func (p *jsonParser) at(offset int) position {
+	line := sort.Search(len(p.lines), func(i int) bool { return p.lines[i] > offset })
+	return position{p.file, line, offset - p.lines[line-1] + 1}
+}
+
+// start finds where the next token starts, past the separators the decoder
+// skips
+func (p *jsonParser) start() int {
+	i := int(p.dec.InputOffset())
+	for i < len(p.b) && strings.IndexByte(" \t\r\n,:", p.b[i]) >= 0 {
+		i++
+	}
+	return i
+}
+
+func (p *jsonParser) value() (n *node, err error) {
+	n = &node{position: p.at(p.start())}
+	t, err := p.dec.Token()
+	if err != nil {
+		return
+	}
+
+	switch v := t.(type) {
+	case json.Delim:
+		n.kind = byte(v)
+		for p.dec.More() {
+			if n.kind == '{' {
+				at := p.at(p.start())
+				var k json.Token
+				k, err = p.dec.Token()
+				if err != nil {
+					return
+				}
+				n.keys = append(n.keys, k.(string))
+				n.keyAt = append(n.keyAt, at)
+			}
+			var child *node
+			child, err = p.value()
+			if err != nil {
+				return
+			}
+			n.children = append(n.children, child)
+		}
+		_, err = p.dec.Token()
+	case string:
+		n.kind = '"'
+		n.value = v
+	case json.Number:
+		n.kind = '0'
+		n.value = v.String()
+	case bool:
+		n.kind = 't'
+		n.value = "false"
+		if v {
+			n.value = "true"
+		}
+	case nil:
+		n.kind = 'n'
+	}
+	return
+}
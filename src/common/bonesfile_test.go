@@ -0,0 +1,170 @@
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "bonesFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err = ioutil.WriteFile(path, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"bonesFile.yaml": `
+include: [shared/databases.toml, shared/web.json]
+machines: {provider: static}
+containers:
+  web:
+    quantity: 3
+`,
+		"shared/databases.toml": `
+[containers.postgresql]
+mode = "single"
+database = "postgresql"
+`,
+		"shared/web.json": `{
+  "include": "databases.toml",
+  "containers": {"web": {"quantity": 1, "links": ["postgresql"]}}
+}`,
+	})
+	defer os.RemoveAll(dir)
+
+	name, err := FindBonesFile(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	d, err := Validator{}.ValidateFile(name)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	web := d.Containers["web"]
+	if web.Quantity != 3 || len(web.Links) != 1 || d.Containers["postgresql"].Mode != "single" {
+		t.Error(errors.New("includes were not merged"))
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"bonesFile":  `{"include": ["base.yaml"], "machines": {"provider": "static"}}`,
+		"base.yaml":  "containers:\n  web:\n    mode: many\n",
+		"loop.yaml":  "include: bonesFile.toml\n",
+		"other.toml": "include = 'missing.json'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	_, err := Validator{}.ValidateFile(filepath.Join(dir, "bonesFile"))
+	if err == nil || !strings.HasSuffix(err.Error(), `base.yaml:3:11: containers.web.mode: "many" is not one of default, single`) {
+		t.Error(errors.New("error in an included file was not placed in it"))
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "bonesFile.toml"), []byte("include = 'loop.yaml'\n"), 0644)
+	_, err = Validator{}.ValidateFile(filepath.Join(dir, "bonesFile.toml"))
+	if err == nil || !strings.HasSuffix(err.Error(), "loop.yaml:1:10: include: bonesFile.toml includes "+filepath.Join(dir, "loop.yaml")) {
+		t.Error(errors.New("include circle was not caught"))
+	}
+
+	_, err = Validator{}.ValidateFile(filepath.Join(dir, "other.toml"))
+	if err == nil || !strings.HasSuffix(err.Error(), "other.toml:1:11: include: no file missing.json") {
+		t.Error(errors.New("missing include was not caught"))
+	}
+
+	_, err = FindBonesFile(dir)
+	if err == nil {
+		t.Error(errors.New("two bonesFiles in one directory were allowed"))
+	}
+}
+
+func TestSearchBonesFile(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"project/bonesFile.yaml":   "machines: {provider: hardcode}\n",
+		"project/web/static/.keep": "",
+	})
+	defer os.RemoveAll(dir)
+
+	name, err := SearchBonesFile(filepath.Join(dir, "project/web/static"))
+	if err != nil {
+		t.Error(err)
+	} else if name != filepath.Join(dir, "project/bonesFile.yaml") {
+		t.Error(errors.New("found " + name))
+	}
+
+	_, err = SearchBonesFile(dir)
+	if err == nil {
+		t.Error(errors.New("a bonesFile below the directory was found"))
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"bonesFile.yaml": `
+machines:
+  provider: hardcode
+  ip: [10.0.0.1]
+containers:
+  web: {quantity: 1, expose: [80]}
+`,
+		"bonesFile.production.toml": `
+[machines]
+ip = ["10.0.1.1", "10.0.1.2"]
+
+[containers.web]
+quantity = 4
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "bonesFile.yaml")
+	overlay, err := EnvFile(name, "production")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	d, err := Validator{}.ValidateFile(name, overlay)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(d.Machines.Ip) != 2 || d.Machines.Provider != "hardcode" ||
+		d.Containers["web"].Quantity != 4 || d.Containers["web"].Expose[0] != "80" {
+		t.Error(errors.New("overlay was not merged"))
+	}
+
+	b, err := Validator{}.RenderFile(name, overlay)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	rendered, err := Validate(b)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(d, rendered) {
+		t.Error(errors.New("rendered bonesFile is:\n" + string(b)))
+	}
+
+	_, err = EnvFile(name, "staging")
+	if err == nil {
+		t.Error(errors.New("missing overlay was not caught"))
+	}
+}
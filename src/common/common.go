@@ -6,11 +6,61 @@ type SkeletonDeployment struct {
 		Ip       []string
 	}
 
-	Containers map[string]struct {
-		Source      string
-		Quantity    int
-		Mode        string
-		Granularity string
-		Expose      []string
-	}
+	Containers map[string]ContainerSpec
+
+	Routes []Route
+}
+
+// OrchestratorReplicas is how many machines skeleton runs an orchestrator on,
+// the first ones of the bonesFile, one leading and the rest standing by
+const OrchestratorReplicas = 3
+
+// ContainerSpec is how the bonesFile describes a container
+type ContainerSpec struct {
+	Source      string
+	Quantity    int
+	Mode        string
+	Granularity string
+	Expose      []string
+
+	// Database names the kind of database the container runs, so the
+	// gatekeeper can hand out users of it. Only "postgresql" for now
+	Database string
+
+	// Links names containers this one talks to. It is handed their address
+	// in the variables docker sets for a link, and started after them
+	Links []string
+
+	// DependsOn names containers that must be up before this one starts
+	DependsOn []string `json:"depends_on"`
+
+	// Health is a path on the first exposed port that answers over HTTP
+	// once the container is up. If it is empty the container is up once
+	// its tcp ports take connections
+	Health string
+}
+
+// Dependencies lists the containers that have to start before this one
+func (spec ContainerSpec) Dependencies() []string {
+	return append(append([]string{}, spec.Links...), spec.DependsOn...)
+}
+
+// Route sends the requests for a hostname and path to a container through the
+// ingress. An empty Host matches every hostname, and the longest matching
+// Path wins
+type Route struct {
+	Host      string
+	Path      string
+	Container string
+
+	// Port picks one of the container's published ports, any if it is 0
+	Port int
+
+	// Health is a path checked over HTTP to see if a backend is up. If it
+	// is empty the backend is up as long as it takes connections
+	Health string
 }
+
+// Version is reported by the orchestrator on /version and compared by
+// skeleton to decide whether the running orchestrator needs replacing
+const Version = "v1"
@@ -0,0 +1,441 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSServer answers for the containers of a deployment. In the domain
+// skeleton, web.skeleton has an A record for every machine running web, and
+// _web._tcp.skeleton has an SRV record for every endpoint. The SRV targets
+// look like 10-0-0-1.web.skeleton, so each one resolves to its own machine.
+// Queries outside the domain from trusted clients are passed on to the
+// upstream resolver, so the server can be the only resolver a container has.
+// Anyone else is only answered within the domain, so it is no open resolver
+type DNSServer struct {
+	lock     sync.Mutex
+	domain   string
+	upstream string
+	services map[string][]string
+	trusted  []*net.IPNet
+	excluded []net.IP
+	conn     net.PacketConn
+}
+
+// dnsTTL is how many seconds resolvers may cache our answers, kept short as
+// containers come and go
+const dnsTTL = 5
+
+// dnsMaxUDP is the most a response over UDP may hold. We only serve UDP, so
+// answers are cut down to the records that fit rather than marked truncated
+const dnsMaxUDP = 512
+
+// dnsMaxQueries is how many queries are answered at once, the rest wait in the
+// socket's buffer
+const dnsMaxQueries = 64
+
+// dnsTimeout is how long we wait for the upstream resolver
+var dnsTimeout = 2 * time.Second
+
+const (
+	dnsTypeA   = 1
+	dnsTypeSRV = 33
+
+	dnsNameError = 3
+	dnsRefused   = 5
+)
+
+// NewDNSServer makes a server for domain, passing other queries on to
+// upstream unless it is ""
+func NewDNSServer(domain string, upstream string) (s *DNSServer) {
+	s = new(DNSServer)
+	s.domain = strings.ToLower(strings.Trim(domain, "."))
+	s.upstream = upstream
+	s.services = make(map[string][]string)
+	return s
+}
+
+// Nameserver reads the first nameserver out of a resolv.conf, as an address
+// to use upstream
+func Nameserver(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return ""
+}
+
+// Gateway reads the default gateway out of a Linux routing table such as
+// /proc/net/route, or "" if there is none
+func Gateway(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		return net.IPv4(b[3], b[2], b[1], b[0]).String()
+	}
+	return ""
+}
+
+// Update replaces the services served, mapping container names to ip:port
+// endpoints as in the orchestrator's service catalog
+func (s *DNSServer) Update(services map[string][]string) {
+	copied := make(map[string][]string)
+	for name, endpoints := range services {
+		copied[strings.ToLower(name)] = append([]string{}, endpoints...)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.services = copied
+}
+
+// Trust replaces the networks whose clients get queries outside the domain
+// forwarded. Each is a CIDR or a single address
+func (s *DNSServer) Trust(networks []string) (err error) {
+	trusted := []*net.IPNet{}
+	for _, network := range networks {
+		if strings.Contains(network, ":") && !strings.Contains(network, "/") {
+			network += "/128"
+		} else if !strings.Contains(network, "/") {
+			network += "/32"
+		}
+		_, n, err := net.ParseCIDR(network)
+		if err != nil {
+			return err
+		}
+		trusted = append(trusted, n)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.trusted = trusted
+	return nil
+}
+
+// Exclude replaces the addresses never trusted, even within a trusted network,
+// such as a proxy queries from anywhere may come through
+func (s *DNSServer) Exclude(addresses []string) (err error) {
+	excluded := []net.IP{}
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return errors.New("Bad address " + address)
+		}
+		excluded = append(excluded, ip)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.excluded = excluded
+	return nil
+}
+
+// isTrusted says whether queries from addr may be forwarded
+func (s *DNSServer) isTrusted(addr net.Addr) bool {
+	u, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, ip := range s.excluded {
+		if ip.Equal(u.IP) {
+			return false
+		}
+	}
+	for _, n := range s.trusted {
+		if n.Contains(u.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listen opens the UDP socket, Serve then answers on it
+func (s *DNSServer) Listen(address string) (err error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.conn = conn
+	s.lock.Unlock()
+	return
+}
+
+func (s *DNSServer) Serve() (err error) {
+	s.lock.Lock()
+	conn := s.conn
+	s.lock.Unlock()
+	if conn == nil {
+		return errors.New("DNS server not listening")
+	}
+
+	busy := make(chan bool, dnsMaxQueries)
+	for {
+		b := make([]byte, 512)
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil {
+			return err
+		}
+
+		// Forwarding can take a while, so don't hold up other queries
+		busy <- true
+		go func() {
+			defer func() { <-busy }()
+			r := s.answer(b[:n], s.isTrusted(addr))
+			if r != nil {
+				conn.WriteTo(r, addr)
+			}
+		}()
+	}
+}
+
+func (s *DNSServer) ListenAndServe(address string) (err error) {
+	err = s.Listen(address)
+	if err != nil {
+		return
+	}
+	return s.Serve()
+}
+
+func (s *DNSServer) Close() (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn != nil {
+		err = s.conn.Close()
+	}
+	return
+}
+
+// answer works out the response to a query, nil meaning no response at all.
+// Only trusted queries are forwarded
+func (s *DNSServer) answer(query []byte, trusted bool) []byte {
+	name, qtype, end, err := parseQuestion(query)
+	if err != nil {
+		return nil
+	}
+
+	suffix := "." + s.domain + "."
+	if !strings.HasSuffix(name, suffix) {
+		if len(s.upstream) == 0 || !trusted {
+			return dnsResponse(query, end, dnsRefused, nil)
+		}
+		r, err := forward(s.upstream, query)
+		if err != nil {
+			return nil
+		}
+		return r
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	records, found := s.lookup(strings.TrimSuffix(name, suffix), qtype)
+	if !found {
+		return dnsResponse(query, end, dnsNameError, nil)
+	}
+	return dnsResponse(query, end, 0, records)
+}
+
+// lookup makes the answer records for a name within the domain. found is false
+// if the name doesn't exist at all. It must be called with the lock held
+func (s *DNSServer) lookup(relative string, qtype uint16) (records [][]byte, found bool) {
+	labels := strings.Split(relative, ".")
+	pointer := []byte{0xc0, 12}
+
+	switch {
+
+	// _web._tcp
+	case len(labels) == 2 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_"):
+		endpoints, found := s.services[labels[0][1:]]
+		if !found || labels[1] != "_tcp" {
+			return nil, false
+		}
+		if qtype != dnsTypeSRV {
+			return nil, true
+		}
+		for _, endpoint := range endpoints {
+			host, port, err := net.SplitHostPort(endpoint)
+			if err != nil {
+				continue
+			}
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				continue
+			}
+			target := strings.Replace(host, ".", "-", -1) + "." + labels[0][1:] + "." + s.domain + "."
+			rdata := make([]byte, 6)
+			binary.BigEndian.PutUint16(rdata[4:], uint16(p))
+			records = append(records, dnsRecord(pointer, dnsTypeSRV, append(rdata, encodeName(target)...)))
+		}
+		return records, true
+
+	// web
+	case len(labels) == 1:
+		endpoints, found := s.services[labels[0]]
+		if !found {
+			return nil, false
+		}
+		if qtype != dnsTypeA {
+			return nil, true
+		}
+		seen := make(map[string]bool)
+		for _, endpoint := range endpoints {
+			host, _, err := net.SplitHostPort(endpoint)
+			ip := net.ParseIP(host).To4()
+			if err != nil || ip == nil || seen[host] {
+				continue
+			}
+			seen[host] = true
+			records = append(records, dnsRecord(pointer, dnsTypeA, ip))
+		}
+		return records, true
+
+	// 10-0-0-1.web
+	case len(labels) == 2:
+		host := strings.Replace(labels[0], "-", ".", -1)
+		for _, endpoint := range s.services[labels[1]] {
+			h, _, err := net.SplitHostPort(endpoint)
+			if err != nil || h != host {
+				continue
+			}
+			ip := net.ParseIP(host).To4()
+			if ip == nil {
+				continue
+			}
+			if qtype == dnsTypeA {
+				return [][]byte{dnsRecord(pointer, dnsTypeA, ip)}, true
+			}
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+// parseQuestion reads the single question of a query. end is where the
+// question finishes
+func parseQuestion(m []byte) (name string, qtype uint16, end int, err error) {
+	err = errors.New("Malformed DNS query")
+	if len(m) < 12 || m[2]&0x80 != 0 || binary.BigEndian.Uint16(m[4:]) != 1 {
+		return
+	}
+
+	labels := []string{}
+	off := 12
+	for {
+		if off >= len(m) {
+			return
+		}
+		l := int(m[off])
+		off++
+		if l == 0 {
+			break
+		}
+		if l > 63 || off+l > len(m) {
+			return
+		}
+		labels = append(labels, string(m[off:off+l]))
+		off += l
+	}
+	if off+4 > len(m) {
+		return
+	}
+
+	name = strings.ToLower(strings.Join(labels, ".")) + "."
+	qtype = binary.BigEndian.Uint16(m[off:])
+	return name, qtype, off + 4, nil
+}
+
+// dnsResponse answers a query, repeating its question. We are authoritative
+// for everything we answer ourselves. Only the records that fit in dnsMaxUDP
+// are given
+func dnsResponse(query []byte, end int, rcode byte, records [][]byte) []byte {
+	r := make([]byte, 12, dnsMaxUDP)
+	copy(r, query[:2])
+	r[2] = 0x84 | query[2]&0x01
+	r[3] = rcode
+	binary.BigEndian.PutUint16(r[4:], 1)
+	r = append(r, query[12:end]...)
+
+	count := 0
+	for _, record := range records {
+		if len(r)+len(record) > dnsMaxUDP {
+			break
+		}
+		r = append(r, record...)
+		count++
+	}
+	binary.BigEndian.PutUint16(r[6:], uint16(count))
+	return r
+}
+
+// dnsRecord makes a resource record in the internet class
+func dnsRecord(name []byte, rtype uint16, rdata []byte) []byte {
+	r := append([]byte{}, name...)
+	fixed := make([]byte, 10)
+	binary.BigEndian.PutUint16(fixed, rtype)
+	binary.BigEndian.PutUint16(fixed[2:], 1)
+	binary.BigEndian.PutUint32(fixed[4:], dnsTTL)
+	binary.BigEndian.PutUint16(fixed[8:], uint16(len(rdata)))
+	r = append(r, fixed...)
+	return append(r, rdata...)
+}
+
+// encodeName writes a name as DNS labels
+func encodeName(name string) (b []byte) {
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// forward passes a query to another resolver and returns its response
+func forward(upstream string, query []byte) (r []byte, err error) {
+	conn, err := net.DialTimeout("udp", upstream, dnsTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	_, err = conn.Write(query)
+	if err != nil {
+		return
+	}
+	b := make([]byte, 65535)
+	n, err := conn.Read(b)
+	return b[:n], err
+}
@@ -0,0 +1,193 @@
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// resolver sends every query to the server at address
+func resolver(address string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, "udp", address)
+		},
+	}
+}
+
+func startDNS(t *testing.T, s *DNSServer) string {
+	err := s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	return s.conn.LocalAddr().String()
+}
+
+func TestDNS(t *testing.T) {
+	upstream := NewDNSServer("example", "")
+	upstream.Update(map[string][]string{"www": {"192.0.2.1:80"}})
+	defer upstream.Close()
+
+	s := NewDNSServer("skeleton", startDNS(t, upstream))
+	s.Update(map[string][]string{
+		"web": {"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.2:8081"},
+	})
+	err := s.Trust([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	r := resolver(startDNS(t, s))
+	ctx := context.Background()
+
+	addrs, err := r.LookupHost(ctx, "web.skeleton.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(addrs)
+	if strings.Join(addrs, ",") != "10.0.0.1,10.0.0.2" {
+		t.Error("A records are " + strings.Join(addrs, ","))
+	}
+
+	_, srvs, err := r.LookupSRV(ctx, "web", "tcp", "skeleton.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srvs) != 3 {
+		t.Fatal("SRV records: ", len(srvs))
+	}
+	endpoints := []string{}
+	for _, srv := range srvs {
+		addrs, err := r.LookupHost(ctx, srv.Target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 {
+			t.Error("SRV target " + srv.Target + " resolves to " + strings.Join(addrs, ","))
+			continue
+		}
+		endpoints = append(endpoints, net.JoinHostPort(addrs[0], strconv.Itoa(int(srv.Port))))
+	}
+	sort.Strings(endpoints)
+	if strings.Join(endpoints, ",") != "10.0.0.1:8080,10.0.0.2:8080,10.0.0.2:8081" {
+		t.Error("SRV endpoints are " + strings.Join(endpoints, ","))
+	}
+
+	_, err = r.LookupHost(ctx, "db.skeleton.")
+	dnsErr, ok := err.(*net.DNSError)
+	if !ok || !dnsErr.IsNotFound {
+		t.Error("db.skeleton should not exist: ", err)
+	}
+
+	// Everything else comes from upstream
+	addrs, err = r.LookupHost(ctx, "www.example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(addrs, ",") != "192.0.2.1" {
+		t.Error("forwarded A records are " + strings.Join(addrs, ","))
+	}
+
+	// Updates take effect straight away
+	s.Update(map[string][]string{"db": {"10.0.0.3:5432"}})
+	addrs, err = r.LookupHost(ctx, "db.skeleton.")
+	if err != nil || strings.Join(addrs, ",") != "10.0.0.3" {
+		t.Error("db.skeleton resolves to ", addrs, err)
+	}
+}
+
+func TestDNSUntrusted(t *testing.T) {
+	upstream := NewDNSServer("example", "")
+	upstream.Update(map[string][]string{"www": {"192.0.2.1:80"}})
+	defer upstream.Close()
+
+	s := NewDNSServer("skeleton", startDNS(t, upstream))
+	s.Update(map[string][]string{"web": {"10.0.0.1:8080"}})
+	err := s.Trust([]string{"10.0.0.1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	r := resolver(startDNS(t, s))
+	ctx := context.Background()
+
+	// Strangers still reach the containers
+	addrs, err := r.LookupHost(ctx, "web.skeleton.")
+	if err != nil || strings.Join(addrs, ",") != "10.0.0.1" {
+		t.Error("web.skeleton resolves to ", addrs, err)
+	}
+
+	// But can't use us to resolve anything else
+	_, err = r.LookupHost(ctx, "www.example.")
+	if err == nil {
+		t.Error("query from an untrusted client was forwarded")
+	}
+}
+
+func TestDNSCapped(t *testing.T) {
+	endpoints := []string{}
+	for i := 1; i <= 40; i++ {
+		endpoints = append(endpoints, "10.0.0."+strconv.Itoa(i)+":8080")
+	}
+	s := NewDNSServer("skeleton", "")
+	s.Update(map[string][]string{"web": endpoints})
+
+	query := []byte{0, 1, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	query = append(query, encodeName("web.skeleton.")...)
+	query = append(query, 0, dnsTypeA, 0, 1)
+
+	// Nobody can ask again over TCP, so as many records as fit are given
+	r := s.answer(query, false)
+	if len(r) > dnsMaxUDP {
+		t.Errorf("%d byte response over UDP", len(r))
+	}
+	count := int(binary.BigEndian.Uint16(r[6:]))
+	if r[2]&0x02 != 0 || count == 0 || count >= 40 ||
+		len(r) != len(query)+count*16 {
+		t.Errorf("%d records in a %d byte response", count, len(r))
+	}
+}
+
+func TestDNSExclude(t *testing.T) {
+	s := NewDNSServer("skeleton", "")
+	err := s.Trust([]string{"172.17.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Exclude([]string{"172.17.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.isTrusted(&net.UDPAddr{IP: net.ParseIP("172.17.0.5")}) {
+		t.Error("container on the bridge not trusted")
+	}
+	if s.isTrusted(&net.UDPAddr{IP: net.ParseIP("172.17.0.1")}) {
+		t.Error("gateway trusted")
+	}
+}
+
+func TestGateway(t *testing.T) {
+	f, err := ioutil.TempFile("", "route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("Iface\tDestination\tGateway \tFlags\n" +
+		"eth0\t00000000\t010011AC\t0003\n" +
+		"eth0\t000011AC\t00000000\t0001\n")
+	f.Close()
+
+	if Gateway(f.Name()) != "172.17.0.1" {
+		t.Error("gateway is " + Gateway(f.Name()))
+	}
+}
@@ -3,6 +3,7 @@ package common
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -25,18 +27,35 @@ type Docker struct {
 	Containers []*Container
 	Images     []*Image
 	Updated    time.Time
+
+	// Dns is the resolvers containers started by Run use, docker's own
+	// if it is empty
+	Dns []string
+}
+
+// Port is a container port as the docker container list shows it
+type Port struct {
+	IP          string
+	PrivatePort int
+	PublicPort  int
+	Type        string
 }
 
 type Container struct {
 	Id              string
 	Image           string
+	Ports           []Port
 	D               *Docker
 	NetworkSettings struct {
 		Ports map[string][]map[string]string
 	}
+	Config struct {
+		Env []string
+	}
 	Volumes      map[string]string
 	Binds        []string
 	PortBindings map[string][]PortBinding
+	Dns          []string `json:",omitempty"`
 }
 
 type Image struct {
@@ -143,8 +162,27 @@ func (C *Container) Inspect() (err error) {
 	return
 }
 
-// runImage takes a docker image to run, and makes sure it is running
-func (Img *Image) Run(D *Docker, env []string, port string) (C *Container, err error) {
+// ImageId asks docker for the id of the image a name currently points at
+func (D *Docker) ImageId(name string) (id string, err error) {
+	resp, err := D.h.Get("images/" + name + "/json")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", errors.New("Inspect Image Status is not 200")
+	}
+
+	var img Image
+	err = json.NewDecoder(resp.Body).Decode(&img)
+	return img.Id, err
+}
+
+// runImage takes a docker image to run, and makes sure it is running. Each
+// port is published on the same port of the machine, and is tcp unless it
+// ends in /udp
+func (Img *Image) Run(D *Docker, env []string, ports ...string) (C *Container, err error) {
 
 	c := make(map[string]interface{})
 	c["Image"] = Img.GetName()
@@ -152,9 +190,13 @@ func (Img *Image) Run(D *Docker, env []string, port string) (C *Container, err e
 	v := make(map[string]struct{})
 	v["/foo"] = struct{}{}
 	c["Volumes"] = v
-	if len(port) > 0 {
-		p := make(map[string]struct{})
-		p[port] = struct{}{}
+	p := make(map[string]struct{})
+	for _, port := range ports {
+		if len(port) > 0 {
+			p[portSpec(port)] = struct{}{}
+		}
+	}
+	if len(p) > 0 {
 		c["ExposedPorts"] = p
 	}
 
@@ -193,9 +235,12 @@ func (Img *Image) Run(D *Docker, env []string, port string) (C *Container, err e
 		return
 	}
 
-	if len(port) > 0 {
-		C.AddExposedPort(port)
+	for _, port := range ports {
+		if len(port) > 0 {
+			C.AddExposedPort(port)
+		}
 	}
+	C.Dns = D.Dns
 
 	C.AddBind("/mnt", "/foo")
 
@@ -204,11 +249,21 @@ func (Img *Image) Run(D *Docker, env []string, port string) (C *Container, err e
 	return
 }
 
+// portSpec adds the protocol to a port if it has none
+func portSpec(port string) string {
+	if !strings.Contains(port, "/") {
+		return port + "/tcp"
+	}
+	return port
+}
+
 func (C *Container) AddExposedPort(port string) {
 	if C.PortBindings == nil {
 		C.PortBindings = make(map[string][]PortBinding)
 	}
-	C.PortBindings[port+"/tcp"] = append(C.PortBindings[port], PortBinding{"0.0.0.0", port})
+	spec := portSpec(port)
+	host := strings.SplitN(spec, "/", 2)[0]
+	C.PortBindings[spec] = append(C.PortBindings[spec], PortBinding{"0.0.0.0", host})
 }
 
 func (C *Container) AddBind(host string, container string) {
@@ -302,12 +357,22 @@ func (C *Container) Delete() (err error) {
 
 // TagImage tags an already existing image in the repository
 func (Img *Image) AddTag(D *Docker, tag string) (err error) {
+	return Img.TagVersion(D, tag, "")
+}
+
+// TagVersion tags an already existing image into repo under the given tag
+func (Img *Image) TagVersion(D *Docker, repo string, tag string) (err error) {
 	b := strings.NewReader("")
 
-	tag = url.QueryEscape(tag)
+	repo = url.QueryEscape(repo)
 	id := url.QueryEscape(Img.GetName())
 
-	resp, err := D.h.Post("images/"+id+"/tag?repo="+tag+"&force=1", "application/json", b)
+	path := "images/" + id + "/tag?repo=" + repo + "&force=1"
+	if len(tag) > 0 {
+		path += "&tag=" + url.QueryEscape(tag)
+	}
+
+	resp, err := D.h.Post(path, "application/json", b)
 
 	if err != nil {
 		return err
@@ -408,6 +473,63 @@ func (D *Docker) Load(imagename string) (I *Image, err error) {
 	return
 }
 
+// Endpoints lists the ip:port addresses the container's published tcp ports
+// are reachable on, given the ip of its machine
+func (C *Container) Endpoints(ip string) (endpoints []string) {
+	for _, p := range C.Ports {
+		if p.PublicPort > 0 && p.Type == "tcp" {
+			endpoints = append(endpoints, ip+":"+strconv.Itoa(p.PublicPort))
+		}
+	}
+	return
+}
+
+// ImageBaseName strips the registry and tag off an image name, leaving the
+// name of the container it runs, such as web for 10.0.0.1:5000/web:v2
+func ImageBaseName(imageName string) string {
+	if strings.Contains(imageName, "/") {
+		imageName = strings.SplitN(imageName, "/", 2)[1]
+	}
+	if strings.Contains(imageName, ":") {
+		imageName = strings.SplitN(imageName, ":", 2)[0]
+	}
+	return imageName
+}
+
+// Logs copies the last tail lines the container wrote to stdout and stderr
+// to w
+func (C *Container) Logs(w io.Writer, tail int) (err error) {
+	resp, err := C.D.h.Get("containers/" + C.Id + "/logs?stdout=1&stderr=1&tail=" + strconv.Itoa(tail))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return errors.New("Response code is not 200")
+	}
+	return demuxLogs(w, resp.Body)
+}
+
+// demuxLogs strips the header docker puts in front of every chunk of output
+// from a container without a terminal, saying which stream it came from
+func demuxLogs(w io.Writer, r io.Reader) error {
+	header := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(w, r, int64(binary.BigEndian.Uint32(header[4:])))
+		if err != nil {
+			return err
+		}
+	}
+}
+
 // ListContainers gives the state for a specific docker container
 func (D *Docker) ListContainers() (c []*Container, err error) {
 	resp, err := D.h.Get("containers/json")
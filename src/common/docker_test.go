@@ -0,0 +1,50 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEndpoints(t *testing.T) {
+	list := `[{"Id":"abc","Image":"10.0.0.1:5000/web:1","Ports":[
+		{"IP":"0.0.0.0","PrivatePort":80,"PublicPort":49153,"Type":"tcp"},
+		{"PrivatePort":53,"PublicPort":49154,"Type":"udp"},
+		{"PrivatePort":8080,"Type":"tcp"}]}]`
+
+	c := []*Container{}
+	err := json.Unmarshal([]byte(list), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoints := c[0].Endpoints("10.0.0.2")
+	if strings.Join(endpoints, ",") != "10.0.0.2:49153" {
+		t.Error("Endpoints are " + strings.Join(endpoints, ","))
+	}
+}
+
+func TestDemuxLogs(t *testing.T) {
+	frames := []byte{}
+	for _, frame := range []struct {
+		stream byte
+		text   string
+	}{{1, "listening on :80\n"}, {2, "no database yet\n"}, {1, "ready\n"}} {
+		frames = append(frames, frame.stream, 0, 0, 0, 0, 0, 0, byte(len(frame.text)))
+		frames = append(frames, frame.text...)
+	}
+
+	out := &bytes.Buffer{}
+	err := demuxLogs(out, bytes.NewReader(frames))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "listening on :80\nno database yet\nready\n" {
+		t.Error("Logs are " + out.String())
+	}
+
+	if ImageBaseName("10.0.0.1:5000/web:v2") != "web" || ImageBaseName("web") != "web" {
+		t.Error("Image base names are wrong")
+	}
+}
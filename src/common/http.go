@@ -16,6 +16,11 @@ func NewHttpClient(ip string) (h *HttpAPI) {
 	return
 }
 
+// Address is the host:port requests are sent to
+func (h *HttpAPI) Address() string {
+	return h.ip
+}
+
 // Post function to clean up http.Post calls in code, method for http struct
 func (h *HttpAPI) Post(url string, content string, b io.Reader) (resp *http.Response, err error) {
 	c := MakeHttpClient()
@@ -80,3 +85,16 @@ func (h *HttpAPI) Delete(url string) (resp *http.Response, err error) {
 	resp, err = c.Do(req)
 	return
 }
+
+// Request sends a request with any method, for verbs without their own helper
+func (h *HttpAPI) Request(method string, url string, b io.Reader) (resp *http.Response, err error) {
+	c := MakeHttpClient()
+
+	req, err := http.NewRequest(method,
+		"http://"+h.ip+"/"+url, b)
+	if err != nil {
+		return
+	}
+	resp, err = c.Do(req)
+	return
+}
@@ -0,0 +1,148 @@
+package common
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Values in a bonesFile can use variables from the environment, or from a
+// .env file next to the bonesFile. ${NAME} is replaced by the variable,
+// ${NAME:-default} by the default if the variable is unset or empty, and $$
+// by a single $. A value that is nothing but a variable is read as whatever
+// type the bonesFile wants there, so a quantity can come from a variable.
+
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// onlyVariable matches values that are a single variable
+var onlyVariable = regexp.MustCompile(`^\$\{[^}]*\}$`)
+
+// Variables finds variables in the environment, then in the .env file in a
+// directory if there is one
+func Variables(dir string) (func(name string) (string, bool), error) {
+	dotenv, err := ReadDotEnv(filepath.Join(dir, ".env"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return func(name string) (string, bool) {
+		value, found := os.LookupEnv(name)
+		if !found {
+			value, found = dotenv[name]
+		}
+		return value, found
+	}, nil
+}
+
+// ReadDotEnv reads NAME=value lines from a .env file. Blank lines and lines
+// starting with # are skipped, and values can be quoted
+func ReadDotEnv(path string) (variables map[string]string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	variables = make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		equals := strings.IndexByte(line, '=')
+		if equals < 0 || !variableName.MatchString(strings.TrimSpace(line[:equals])) {
+			return nil, parseError(position{path, number, 1}, "expected NAME=value")
+		}
+		name := strings.TrimSpace(line[:equals])
+		value := strings.TrimSpace(line[equals+1:])
+
+		switch {
+		case strings.HasPrefix(value, `"`):
+			value, err = strconv.Unquote(value)
+			if err != nil {
+				return nil, parseError(position{path, number, equals + 2}, "invalid quoted value")
+			}
+		case strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") && len(value) > 1:
+			value = value[1 : len(value)-1]
+		default:
+			comment := strings.Index(value, " #")
+			if comment >= 0 {
+				value = strings.TrimSpace(value[:comment])
+			}
+		}
+		variables[name] = value
+	}
+	return variables, scanner.Err()
+}
+
+// interpolate replaces the variables in a string
+func interpolate(s string, lookup func(string) (string, bool)) (string, string) {
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) || (s[i+1] != '$' && s[i+1] != '{') {
+			b.WriteByte(s[i])
+			continue
+		}
+		if s[i+1] == '$' {
+			b.WriteByte('$')
+			i++
+			continue
+		}
+
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", "${ is missing its }, use $$ for a $"
+		}
+		expression := s[i+2 : i+end]
+		name, fallback, hasDefault := strings.Cut(expression, ":-")
+		if !variableName.MatchString(name) {
+			return "", strconv.Quote(name) + " is not a variable name"
+		}
+		if strings.Contains(fallback, "${") {
+			return "", "the default for " + name + " can't use variables"
+		}
+
+		value, found := lookup(name)
+		if !found || (hasDefault && len(value) == 0) {
+			if !hasDefault {
+				return "", "${" + name + "} is not set in the environment or .env, " +
+					"use ${" + name + ":-default} to give it a default"
+			}
+			value = fallback
+		}
+		b.WriteString(value)
+		i += end
+	}
+	return b.String(), ""
+}
+
+// interpolateNode replaces the variables in every value of a bonesFile.
+// Keys and the names of included files are left alone
+func interpolateNode(n *node, path string, lookup func(string) (string, bool), errs ValidationErrors) ValidationErrors {
+	switch n.kind {
+	case '{':
+		for i, child := range n.children {
+			errs = interpolateNode(child, joinPath(path, n.keys[i]), lookup, errs)
+		}
+	case '[':
+		for i, child := range n.children {
+			errs = interpolateNode(child, path+"["+strconv.Itoa(i)+"]", lookup, errs)
+		}
+	case '"', 'p':
+		value, problem := interpolate(n.value, lookup)
+		if len(problem) > 0 {
+			return append(errs, &ValidationError{File: n.file, Path: path, Line: n.line,
+				Column: n.column, Message: problem})
+		}
+		if onlyVariable.MatchString(n.value) {
+			n.kind = 'p'
+		}
+		n.value = value
+	}
+	return errs
+}
@@ -0,0 +1,96 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	lookup := func(name string) (string, bool) {
+		value, found := map[string]string{"TAG": "v2", "EMPTY": ""}[name]
+		return value, found
+	}
+	tests := []struct {
+		in       string
+		expected string
+		problem  string
+	}{
+		{"local:web-${TAG}", "local:web-v2", ""},
+		{"${EMPTY:-default}", "default", ""},
+		{"${MISSING:-10.0.0.1}", "10.0.0.1", ""},
+		{"costs $$5 or $5", "costs $5 or $5", ""},
+		{"${MISSING}", "", "${MISSING} is not set in the environment or .env, use ${MISSING:-default} to give it a default"},
+		{"${TAG", "", "${ is missing its }, use $$ for a $"},
+		{"${1TAG}", "", `"1TAG" is not a variable name`},
+	}
+
+	for _, test := range tests {
+		out, problem := interpolate(test.in, lookup)
+		if out != test.expected || problem != test.problem {
+			t.Error(errors.New(test.in + " became " + out + ", " + problem))
+		}
+	}
+}
+
+func TestInterpolateBonesFile(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"bonesFile": `{
+  "machines": {"provider": "hardcode", "ip": ["${FIRST_IP}", "${SECOND_IP:-10.0.0.2}"]},
+  "containers": {"web": {"quantity": "${WEB_QUANTITY}", "source": "${WEB_SOURCE}"}}
+}`,
+		".env": `# Set by the inventory
+FIRST_IP=10.0.0.1
+export WEB_QUANTITY=3  # per machine
+WEB_SOURCE="local:web"
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	lookup, err := Variables(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	v := Validator{Lookup: lookup}
+	d, err := v.ValidateFile(filepath.Join(dir, "bonesFile"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if strings.Join(d.Machines.Ip, " ") != "10.0.0.1 10.0.0.2" || d.Containers["web"].Quantity != 3 ||
+		d.Containers["web"].Source != "local:web" {
+		t.Error(errors.New("variables were not filled in"))
+	}
+
+	os.Setenv("WEB_QUANTITY", "5")
+	defer os.Unsetenv("WEB_QUANTITY")
+	d, err = v.ValidateFile(filepath.Join(dir, "bonesFile"))
+	if err != nil || d.Containers["web"].Quantity != 5 {
+		t.Error(errors.New("the environment did not win over .env"))
+	}
+
+	os.Remove(filepath.Join(dir, ".env"))
+	lookup, err = Variables(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = Validator{Lookup: lookup}.ValidateFile(filepath.Join(dir, "bonesFile"))
+	if err == nil || !strings.HasSuffix(strings.Split(err.Error(), "\n")[0],
+		"bonesFile:2:47: machines.ip[0]: ${FIRST_IP} is not set in the environment or .env, use ${FIRST_IP:-default} to give it a default") {
+		t.Error(errors.New("undefined variable was not reported"))
+	}
+}
+
+func TestReadDotEnv(t *testing.T) {
+	dir := writeFiles(t, map[string]string{".env": "GOOD=1\nnot a variable\n"})
+	defer os.RemoveAll(dir)
+
+	_, err := ReadDotEnv(filepath.Join(dir, ".env"))
+	if err == nil || !strings.HasSuffix(err.Error(), ".env:2:1: expected NAME=value") {
+		t.Error(errors.New("bad .env line was not reported"))
+	}
+}
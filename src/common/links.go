@@ -0,0 +1,85 @@
+package common
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// LinkEnv makes the variables docker sets when container from links to alias,
+// such as POSTGRESQL_PORT_5432_TCP_ADDR, for an instance of alias on another
+// machine. ports are published on the same port of that machine, and are tcp
+// unless they end in /udp
+func LinkEnv(from string, alias string, ip string, ports []string) (env []string) {
+	prefix := strings.ToUpper(strings.Replace(alias, "-", "_", -1))
+	env = append(env, prefix+"_NAME=/"+from+"/"+alias)
+
+	for i, port := range ports {
+		spec := strings.SplitN(portSpec(port), "/", 2)
+		number, proto := spec[0], spec[1]
+		url := proto + "://" + ip + ":" + number
+		if i == 0 {
+			env = append(env, prefix+"_PORT="+url)
+		}
+
+		name := prefix + "_PORT_" + number + "_" + strings.ToUpper(proto)
+		env = append(env,
+			name+"="+url,
+			name+"_ADDR="+ip,
+			name+"_PORT="+number,
+			name+"_PROTO="+proto)
+	}
+	return
+}
+
+// StartOrder sorts the containers of a deployment so every container comes
+// after the ones it links to or depends on. It fails on dependencies that
+// aren't in the deployment and on dependencies that go round in a circle
+func StartOrder(d *SkeletonDeployment) (order []string, err error) {
+	names := []string{}
+	for name, _ := range d.Containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			return errors.New("Containers depend on each other in a circle: " +
+				strings.Join(append(path, name), " -> "))
+		}
+
+		state[name] = visiting
+		for _, dependency := range d.Containers[name].Dependencies() {
+			_, found := d.Containers[dependency]
+			if !found {
+				return errors.New(name + " depends on " + dependency + ", which is not a container")
+			}
+			err := visit(dependency, append(path, name))
+			if err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		order = append(order, name)
+		return nil
+	}
+
+	for _, name := range names {
+		err = visit(name, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
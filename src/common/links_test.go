@@ -0,0 +1,92 @@
+package common
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLinkEnv(t *testing.T) {
+	env := LinkEnv("web", "postgresql", "10.0.0.2", []string{"5432", "53/udp"})
+	expected := []string{
+		"POSTGRESQL_NAME=/web/postgresql",
+		"POSTGRESQL_PORT=tcp://10.0.0.2:5432",
+		"POSTGRESQL_PORT_5432_TCP=tcp://10.0.0.2:5432",
+		"POSTGRESQL_PORT_5432_TCP_ADDR=10.0.0.2",
+		"POSTGRESQL_PORT_5432_TCP_PORT=5432",
+		"POSTGRESQL_PORT_5432_TCP_PROTO=tcp",
+		"POSTGRESQL_PORT_53_UDP=udp://10.0.0.2:53",
+		"POSTGRESQL_PORT_53_UDP_ADDR=10.0.0.2",
+		"POSTGRESQL_PORT_53_UDP_PORT=53",
+		"POSTGRESQL_PORT_53_UDP_PROTO=udp",
+	}
+	if strings.Join(env, "\n") != strings.Join(expected, "\n") {
+		t.Error("link environment is:\n" + strings.Join(env, "\n"))
+	}
+}
+
+func deployment(links map[string][]string) *SkeletonDeployment {
+	d := &SkeletonDeployment{Containers: make(map[string]ContainerSpec)}
+	for name, l := range links {
+		d.Containers[name] = ContainerSpec{Links: l}
+	}
+	return d
+}
+
+func TestStartOrder(t *testing.T) {
+	order, err := StartOrder(deployment(map[string][]string{
+		"web":        {"postgresql", "cache"},
+		"worker":     {"postgresql"},
+		"cache":      nil,
+		"postgresql": nil,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(order, ",") != "cache,postgresql,web,worker" {
+		t.Error("start order is " + strings.Join(order, ","))
+	}
+
+	_, err = StartOrder(deployment(map[string][]string{
+		"a": {"b"},
+		"b": {"c"},
+		"c": {"a"},
+	}))
+	if err == nil || !strings.Contains(err.Error(), "a -> b -> c -> a") {
+		t.Error("circle not found: ", err)
+	}
+
+	_, err = StartOrder(deployment(map[string][]string{"web": {"db"}}))
+	if err == nil {
+		t.Error("link to a missing container not found")
+	}
+}
+
+func TestDependsOn(t *testing.T) {
+	d := &SkeletonDeployment{}
+	err := json.Unmarshal([]byte(`{"containers": {
+		"web": {"links": ["cache"], "depends_on": ["migrate"]},
+		"migrate": {"depends_on": ["postgresql"]},
+		"cache": {},
+		"postgresql": {}
+	}}`), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order, err := StartOrder(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(order, ",") != "cache,postgresql,migrate,web" {
+		t.Error("start order is " + strings.Join(order, ","))
+	}
+
+	spec := d.Containers["postgresql"]
+	spec.DependsOn = []string{"web"}
+	d.Containers["postgresql"] = spec
+	_, err = StartOrder(d)
+	if err == nil {
+		t.Error("circle through depends_on not found")
+	}
+}
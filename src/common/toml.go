@@ -0,0 +1,355 @@
+package common
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// skeleton reads the part of TOML a bonesFile needs: tables, arrays of
+// tables, dotted keys, strings, whole numbers, booleans, arrays and inline
+// tables. Multi-line strings and dates are refused rather than misread.
+
+type tomlParser struct {
+	file  string
+	text  string
+	i     int
+	lines []int
+
+	// defined are the tables given a header, which can't be given another
+	defined map[*node]bool
+
+	// arrays are the arrays of tables, whose last table [a.b] refers to
+	arrays map[*node]bool
+}
+
+func parseTOML(file string, b []byte) (*node, error) {
+	p := &tomlParser{file: file, text: string(b), lines: []int{0},
+		defined: make(map[*node]bool), arrays: make(map[*node]bool)}
+	for i, c := range b {
+		if c == '\n' {
+			p.lines = append(p.lines, i+1)
+		}
+	}
+
+	root := &node{position: position{file, 1, 1}, kind: '{'}
+	table := root
+	for {
+		p.space(true)
+		if p.i == len(p.text) {
+			return root, nil
+		}
+
+		var err error
+		if p.text[p.i] == '[' {
+			table, err = p.header(root)
+		} else {
+			err = p.keyValue(table)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Nothing but a comment can follow on the line
+		p.space(false)
+		if p.i < len(p.text) && p.text[p.i] != '\n' {
+			return nil, p.errorAt(p.i, "expected the end of the line")
+		}
+	}
+}
+
+func (p *tomlParser) at(i int) position {
+	line := sort.Search(len(p.lines), func(l int) bool { return p.lines[l] > i })
+	return position{p.file, line, i - p.lines[line-1] + 1}
+}
+
+func (p *tomlParser) errorAt(i int, message string) error {
+	return parseError(p.at(i), message)
+}
+
+// space skips spaces and comments, and new lines if newlines is set
+func (p *tomlParser) space(newlines bool) {
+	for p.i < len(p.text) {
+		switch c := p.text[p.i]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.i++
+		case c == '\n' && newlines:
+			p.i++
+		case c == '#':
+			for p.i < len(p.text) && p.text[p.i] != '\n' {
+				p.i++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// header parses a [table] or [[array.of.tables]] line, returning the table
+// the key values below it go in
+func (p *tomlParser) header(root *node) (*node, error) {
+	start := p.i
+	array := strings.HasPrefix(p.text[p.i:], "[[")
+	p.i++
+	if array {
+		p.i++
+	}
+
+	keys, at, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	close := "]"
+	if array {
+		close = "]]"
+	}
+	if !strings.HasPrefix(p.text[p.i:], close) {
+		return nil, p.errorAt(p.i, "expected "+close)
+	}
+	p.i += len(close)
+
+	table := root
+	for k := 0; k < len(keys)-1; k++ {
+		table, err = p.descend(table, keys[k], at[k])
+		if err != nil {
+			return nil, err
+		}
+	}
+	last := keys[len(keys)-1]
+	existing, _ := table.get(last)
+
+	if array {
+		if existing == nil {
+			existing = &node{position: at[len(at)-1], kind: '['}
+			p.arrays[existing] = true
+			table.keys = append(table.keys, last)
+			table.keyAt = append(table.keyAt, at[len(at)-1])
+			table.children = append(table.children, existing)
+		}
+		if !p.arrays[existing] {
+			return nil, p.errorAt(start, strconv.Quote(last)+" is already a value")
+		}
+		t := &node{position: p.at(start), kind: '{'}
+		existing.children = append(existing.children, t)
+		return t, nil
+	}
+
+	table, err = p.descend(table, last, at[len(at)-1])
+	if err != nil {
+		return nil, err
+	}
+	if p.defined[table] {
+		return nil, p.errorAt(start, "table ["+strings.Join(keys, ".")+"] is defined twice")
+	}
+	p.defined[table] = true
+	return table, nil
+}
+
+// descend finds or makes the table a key names
+func (p *tomlParser) descend(table *node, key string, at position) (*node, error) {
+	child, _ := table.get(key)
+	switch {
+	case child == nil:
+		child = &node{position: at, kind: '{'}
+		table.keys = append(table.keys, key)
+		table.keyAt = append(table.keyAt, at)
+		table.children = append(table.children, child)
+		return child, nil
+	case p.arrays[child]:
+		return child.children[len(child.children)-1], nil
+	case child.kind == '{':
+		return child, nil
+	}
+	return nil, parseError(at, strconv.Quote(key)+" is already a value")
+}
+
+// keyValue parses a key = value into a table
+func (p *tomlParser) keyValue(table *node) error {
+	keys, at, err := p.keys()
+	if err != nil {
+		return err
+	}
+	if p.i == len(p.text) || p.text[p.i] != '=' {
+		return p.errorAt(p.i, "expected =")
+	}
+	p.i++
+	p.space(false)
+
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+	for k := 0; k < len(keys)-1; k++ {
+		table, err = p.descend(table, keys[k], at[k])
+		if err != nil {
+			return err
+		}
+	}
+	last := keys[len(keys)-1]
+	existing, _ := table.get(last)
+	if existing != nil {
+		return parseError(at[len(at)-1], strconv.Quote(last)+" is given twice")
+	}
+	table.keys = append(table.keys, last)
+	table.keyAt = append(table.keyAt, at[len(at)-1])
+	table.children = append(table.children, value)
+	return nil
+}
+
+func isBareKey(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// keys parses a dotted key
+func (p *tomlParser) keys() (keys []string, at []position, err error) {
+	for {
+		p.space(false)
+		if p.i == len(p.text) {
+			return nil, nil, p.errorAt(p.i, "expected a key")
+		}
+		start := p.i
+		var key string
+		switch c := p.text[p.i]; {
+		case c == '"' || c == '\'':
+			key, err = p.str()
+			if err != nil {
+				return
+			}
+		case isBareKey(c):
+			for p.i < len(p.text) && isBareKey(p.text[p.i]) {
+				p.i++
+			}
+			key = p.text[start:p.i]
+		default:
+			return nil, nil, p.errorAt(p.i, "expected a key")
+		}
+		keys = append(keys, key)
+		at = append(at, p.at(start))
+
+		p.space(false)
+		if p.i == len(p.text) || p.text[p.i] != '.' {
+			return
+		}
+		p.i++
+	}
+}
+
+// str parses a basic or literal string
+func (p *tomlParser) str() (string, error) {
+	start := p.i
+	quote := p.text[p.i]
+	if strings.HasPrefix(p.text[p.i:], strings.Repeat(string(quote), 3)) {
+		return "", p.errorAt(start, "multi-line strings are not supported in a bonesFile")
+	}
+	for p.i++; p.i < len(p.text) && p.text[p.i] != '\n'; p.i++ {
+		if quote == '"' && p.text[p.i] == '\\' {
+			p.i++
+			continue
+		}
+		if p.text[p.i] != quote {
+			continue
+		}
+
+		p.i++
+		if quote == '\'' {
+			return p.text[start+1 : p.i-1], nil
+		}
+		s, err := strconv.Unquote(p.text[start:p.i])
+		if err != nil {
+			return "", p.errorAt(start, "invalid escape in string")
+		}
+		return s, nil
+	}
+	return "", p.errorAt(start, "string doesn't end on this line")
+}
+
+// value parses a value
+func (p *tomlParser) value() (n *node, err error) {
+	if p.i == len(p.text) {
+		return nil, p.errorAt(p.i, "expected a value")
+	}
+	n = &node{position: p.at(p.i)}
+
+	switch c := p.text[p.i]; {
+	case c == '"' || c == '\'':
+		n.kind = '"'
+		n.value, err = p.str()
+		return
+
+	case c == '[':
+		n.kind = '['
+		p.i++
+		for {
+			p.space(true)
+			if p.i < len(p.text) && p.text[p.i] == ']' {
+				p.i++
+				return
+			}
+			var child *node
+			child, err = p.value()
+			if err != nil {
+				return
+			}
+			n.children = append(n.children, child)
+
+			p.space(true)
+			switch {
+			case p.i < len(p.text) && p.text[p.i] == ',':
+				p.i++
+			case p.i < len(p.text) && p.text[p.i] == ']':
+			default:
+				return nil, p.errorAt(p.i, "expected , or ]")
+			}
+		}
+
+	case c == '{':
+		n.kind = '{'
+		p.i++
+		p.space(false)
+		if p.i < len(p.text) && p.text[p.i] == '}' {
+			p.i++
+			return
+		}
+		for {
+			err = p.keyValue(n)
+			if err != nil {
+				return
+			}
+			p.space(false)
+			switch {
+			case p.i < len(p.text) && p.text[p.i] == ',':
+				p.i++
+			case p.i < len(p.text) && p.text[p.i] == '}':
+				p.i++
+				return
+			default:
+				return nil, p.errorAt(p.i, "expected , or }")
+			}
+		}
+	}
+
+	start := p.i
+	for p.i < len(p.text) && (isBareKey(p.text[p.i]) || strings.IndexByte("+.:", p.text[p.i]) >= 0) {
+		p.i++
+	}
+	word := p.text[start:p.i]
+	switch {
+	case word == "true" || word == "false":
+		n.kind = 't'
+		n.value = word
+		return
+	case len(word) == 0:
+		return nil, p.errorAt(start, "expected a value")
+	case strings.Contains(word, ":") || strings.Count(word, "-") > 1:
+		return nil, p.errorAt(start, "dates are not supported in a bonesFile")
+	}
+
+	number := strings.TrimPrefix(strings.Replace(word, "_", "", -1), "+")
+	_, err = strconv.ParseFloat(number, 64)
+	if err != nil {
+		return nil, p.errorAt(start, "expected a value, not "+word)
+	}
+	n.kind = '0'
+	n.value = number
+	return n, nil
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const validTOML = `# The same deployment as validBonesFile
+[machines]
+provider = "static"
+ip = [
+  "10.0.0.1",
+  "10.0.0.2",  # a trailing comma is fine
+]
+
+[containers.web]
+source = "local:web"
+quantity = 2
+expose = ["80", "53/udp"]
+links = ["postgresql"]
+health = "/health"
+
+[containers.postgresql]
+mode = 'single'
+granularity = "machine"
+database = "postgresql"
+
+[[routes]]
+host = "example.com"
+path = "/"
+container = "web"
+port = 80
+`
+
+func TestTOML(t *testing.T) {
+	expected, err := Validate([]byte(validBonesFile))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	n, err := parseTOML("bonesFile.toml", []byte(validTOML))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	d, err := Validator{}.validate(n)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(d, expected) {
+		t.Error(errors.New("TOML and JSON bonesFiles differ"))
+	}
+}
+
+func TestTOMLErrors(t *testing.T) {
+	tests := []struct {
+		file     string
+		expected string
+	}{
+		{"[machines]\nprovider = \"static\"\nprovider = \"aws\"\n",
+			`bonesFile.toml:3:1: "provider" is given twice`},
+		{"[machines]\n[machines]\n",
+			"bonesFile.toml:2:1: table [machines] is defined twice"},
+		{"[machines]\nprovider static\n",
+			"bonesFile.toml:2:10: expected ="},
+		{"[containers.web]\nexpose = [80]\n",
+			"bonesFile.toml:2:11: containers.web.expose[0]: expected a string, not a number"},
+		{"[machines]\nprovider = 1979-05-27\n",
+			"bonesFile.toml:2:12: dates are not supported in a bonesFile"},
+	}
+
+	for _, test := range tests {
+		n, err := parseTOML("bonesFile.toml", []byte(test.file))
+		if err == nil {
+			_, err = Validator{}.validate(n)
+		}
+		if err == nil {
+			t.Error(errors.New("no error for " + test.file))
+			continue
+		}
+		if err.Error() != test.expected {
+			t.Error(errors.New("error for " + test.file + " is " + err.Error()))
+		}
+	}
+}
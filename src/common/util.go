@@ -1,23 +1,42 @@
 package common
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
+	"time"
     "crypto/tls"
 )
 
 var hc *http.Client = nil
 
+// RandomKey makes up a 256 bit key, hex encoded
+func RandomKey() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	return hex.EncodeToString(b), err
+}
+
+// httpTimeout bounds connecting to a server and waiting for it to start
+// answering, so a hung server doesn't hang its callers. The answer itself may
+// take longer, as deploys stream their progress
+var httpTimeout = 2 * time.Minute
+
 func MakeHttpClient() *http.Client {
 	if hc == nil {
-        tr := &http.Transport{
-            TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-        }
+		tr := &http.Transport{
+			TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+			DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: httpTimeout,
+		}
 		hc = &http.Client{Transport: tr}
 	}
 	return hc
@@ -0,0 +1,466 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A bonesFile is checked in two passes. The first walks the parsed file
+// against the SkeletonDeployment type, rejecting unknown and repeated keys
+// and values of the wrong type, reading the rest into a SkeletonDeployment
+// and noting where every value came from. The second checks the values make
+// sense together. Every error carries the JSON path of the value at fault,
+// and the file, line and column it starts at.
+
+// ValidationError is one problem found in a bonesFile
+type ValidationError struct {
+	File    string
+	Path    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	at := fmt.Sprintf("%d:%d: ", e.Line, e.Column)
+	if len(e.File) > 0 {
+		at = e.File + ":" + at
+	}
+	if len(e.Path) == 0 {
+		return at + e.Message
+	}
+	return at + e.Path + ": " + e.Message
+}
+
+// ValidationErrors is every problem found in a bonesFile, in file order
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	lines := []string{}
+	for _, v := range e {
+		lines = append(lines, v.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Validator checks bonesFiles
+type Validator struct {
+	// CheckSource, if set, is also called on the source of every container,
+	// defaulted to local:<name> if the file has none
+	CheckSource func(source string) error
+
+	// Lookup, if set, finds the variables the values in a bonesFile read by
+	// ValidateFile or RenderFile use
+	Lookup func(name string) (string, bool)
+}
+
+var modes = []string{"default", "single"}
+var granularities = []string{"deployment", "machine"}
+var databases = []string{"postgresql"}
+var sourceKinds = []string{"local"}
+
+var hostname = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
+
+// Validate checks a JSON bonesFile with no source checks
+func Validate(b []byte) (*SkeletonDeployment, error) {
+	return Validator{}.Validate(b)
+}
+
+// Validate parses a JSON bonesFile, failing with ValidationErrors if anything
+// in it is wrong
+func (v Validator) Validate(b []byte) (*SkeletonDeployment, error) {
+	n, err := parseJSON("", b)
+	if err != nil {
+		return nil, err
+	}
+	return v.validate(n)
+}
+
+// ValidateFile reads a bonesFile in any format, with everything it includes
+// and any overlays merged over it, failing with ValidationErrors if anything
+// in it is wrong
+func (v Validator) ValidateFile(name string, overlays ...string) (*SkeletonDeployment, error) {
+	n, err := v.load(name, overlays)
+	if err != nil {
+		return nil, err
+	}
+	return v.validate(n)
+}
+
+// RenderFile reads a bonesFile like ValidateFile, and writes what it read
+// back out as a single JSON bonesFile
+func (v Validator) RenderFile(name string, overlays ...string) ([]byte, error) {
+	n, err := v.load(name, overlays)
+	if err != nil {
+		return nil, err
+	}
+	_, err = v.validate(n)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(n, "", "    ")
+}
+
+// load reads a bonesFile and its overlays, and fills in their variables
+func (v Validator) load(name string, overlays []string) (*node, error) {
+	n, err := loadOverlaid(name, overlays)
+	if err != nil || v.Lookup == nil {
+		return n, err
+	}
+	c := &checker{errors: interpolateNode(n, "", v.Lookup, nil)}
+	if len(c.errors) > 0 {
+		return nil, c.sorted()
+	}
+	return n, nil
+}
+
+func (v Validator) validate(n *node) (*SkeletonDeployment, error) {
+	c := &checker{positions: make(map[string]position)}
+	d := &SkeletonDeployment{}
+	c.walk(n, reflect.ValueOf(d).Elem(), "")
+	if len(c.errors) > 0 {
+		return nil, c.sorted()
+	}
+
+	c.check(d, v.CheckSource)
+	if len(c.errors) > 0 {
+		return nil, c.sorted()
+	}
+	return d, nil
+}
+
+// checker gathers the errors in a bonesFile
+type checker struct {
+	positions map[string]position
+	errors    ValidationErrors
+}
+
+func (c *checker) errorAt(p position, path string, message string) {
+	c.errors = append(c.errors, &ValidationError{File: p.file, Path: path, Line: p.line,
+		Column: p.column, Message: message})
+}
+
+// errorOn reports a problem with the value at path, or the nearest value
+// above it that is in the file
+func (c *checker) errorOn(path string, message string) {
+	for p := path; ; p = parentPath(p) {
+		at, found := c.positions[p]
+		if found || len(p) == 0 {
+			c.errorAt(at, path, message)
+			return
+		}
+	}
+}
+
+func (c *checker) sorted() ValidationErrors {
+	sort.SliceStable(c.errors, func(i, j int) bool {
+		a, b := c.errors[i], c.errors[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return c.errors
+}
+
+func joinPath(path string, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+// parentPath strips the last key or index off a path
+func parentPath(path string) string {
+	i := strings.LastIndexAny(path, ".[")
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
+
+// jsonName is the key a struct field is read from
+func jsonName(f reflect.StructField) string {
+	tag := strings.Split(f.Tag.Get("json"), ",")[0]
+	if len(tag) > 0 {
+		return tag
+	}
+	return strings.ToLower(f.Name)
+}
+
+var kindNames = map[byte]string{'{': "an object", '[': "a list", '"': "a string",
+	'0': "a number", 't': "true or false", 'p': "a value"}
+
+// walk checks a value against the type it is read into, and reads it. Keys
+// are renamed to the ones JSON uses, and plain values given the type they
+// were read as, so the node can be written out as a JSON bonesFile
+func (c *checker) walk(n *node, v reflect.Value, path string) {
+	c.positions[path] = n.position
+	if n.kind == 'n' {
+		return
+	}
+
+	expected := byte(0)
+	switch v.Kind() {
+	case reflect.Struct, reflect.Map:
+		expected = '{'
+	case reflect.Slice:
+		expected = '['
+	case reflect.String:
+		expected = '"'
+	case reflect.Int:
+		expected = '0'
+	case reflect.Bool:
+		expected = 't'
+	}
+	scalar := expected == '"' || expected == '0' || expected == 't'
+	if n.kind != expected && !(n.kind == 'p' && scalar) {
+		c.errorAt(n.position, path, "expected "+kindNames[expected]+", not "+kindNames[n.kind])
+		return
+	}
+
+	if n.kind == 'p' {
+		n.kind = expected
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		seen := make(map[string]bool)
+		for i, key := range n.keys {
+			f, found := field(v.Type(), key)
+			if !found {
+				message := fmt.Sprintf("unknown field %q", key)
+				suggestion := suggest(v.Type(), key)
+				if len(suggestion) > 0 {
+					message += fmt.Sprintf(", did you mean %q?", suggestion)
+				}
+				c.errorAt(n.keyAt[i], joinPath(path, key), message)
+				continue
+			}
+			name := jsonName(f)
+			if seen[name] {
+				c.errorAt(n.keyAt[i], joinPath(path, name), fmt.Sprintf("%q is given twice", key))
+				continue
+			}
+			seen[name] = true
+			n.keys[i] = name
+			c.walk(n.children[i], v.FieldByIndex(f.Index), joinPath(path, name))
+		}
+
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		seen := make(map[string]bool)
+		for i, key := range n.keys {
+			if seen[key] {
+				c.errorAt(n.keyAt[i], joinPath(path, key), fmt.Sprintf("%q is given twice", key))
+				continue
+			}
+			seen[key] = true
+			e := reflect.New(v.Type().Elem()).Elem()
+			c.walk(n.children[i], e, joinPath(path, key))
+			v.SetMapIndex(reflect.ValueOf(key), e)
+		}
+
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), len(n.children), len(n.children)))
+		for i, child := range n.children {
+			c.walk(child, v.Index(i), path+"["+strconv.Itoa(i)+"]")
+		}
+
+	case reflect.String:
+		v.SetString(n.value)
+
+	case reflect.Int:
+		i, err := strconv.ParseInt(n.value, 10, 64)
+		if err != nil {
+			c.errorAt(n.position, path, "expected a whole number, not "+n.value)
+			return
+		}
+		v.SetInt(i)
+
+	case reflect.Bool:
+		if n.value != "true" && n.value != "false" {
+			c.errorAt(n.position, path, "expected true or false, not "+n.value)
+			return
+		}
+		v.SetBool(n.value == "true")
+	}
+}
+
+// field finds the struct field a key is read into, the way encoding/json does
+func field(t reflect.Type, key string) (f reflect.StructField, found bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" && jsonName(t.Field(i)) == key {
+			return t.Field(i), true
+		}
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" && strings.EqualFold(jsonName(t.Field(i)), key) {
+			return t.Field(i), true
+		}
+	}
+	return
+}
+
+// suggest finds a field name a mistyped key is close to
+func suggest(t reflect.Type, key string) (best string) {
+	distance := 3
+	for i := 0; i < t.NumField(); i++ {
+		name := jsonName(t.Field(i))
+		d := editDistance(strings.ToLower(key), name)
+		if d < distance {
+			best, distance = name, d
+		}
+	}
+	return
+}
+
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func oneOf(value string, allowed []string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *checker) checkChoice(path string, value string, allowed []string) {
+	if len(value) > 0 && !oneOf(value, allowed) {
+		c.errorOn(path, fmt.Sprintf("%q is not one of %s", value, strings.Join(allowed, ", ")))
+	}
+}
+
+// checkPort checks a port such as 80, 80/tcp or 53/udp
+func (c *checker) checkPort(path string, port string) {
+	spec := strings.SplitN(portSpec(port), "/", 2)
+	number, err := strconv.Atoi(spec[0])
+	if err != nil || number < 1 || number > 65535 || (spec[1] != "tcp" && spec[1] != "udp") {
+		c.errorOn(path, fmt.Sprintf("%q is not a port such as 80, 80/tcp or 53/udp", port))
+	}
+}
+
+// check looks at the values of a deployment once it is known to parse
+func (c *checker) check(d *SkeletonDeployment, checkSource func(string) error) {
+	seen := make(map[string]bool)
+	for i, ip := range d.Machines.Ip {
+		path := "machines.ip[" + strconv.Itoa(i) + "]"
+		if net.ParseIP(ip) == nil && !hostname.MatchString(ip) {
+			c.errorOn(path, fmt.Sprintf("%q is not an address", ip))
+		}
+		if seen[ip] {
+			c.errorOn(path, fmt.Sprintf("%q is listed twice", ip))
+		}
+		seen[ip] = true
+	}
+
+	names := []string{}
+	for name := range d.Containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		spec := d.Containers[name]
+		path := joinPath("containers", name)
+
+		if !hostname.MatchString(name) || strings.Contains(name, ".") {
+			c.errorOn(path, fmt.Sprintf("%q is not a container name, use letters, digits and -", name))
+		}
+		if spec.Quantity < 0 {
+			c.errorOn(path+".quantity", "quantity can't be negative")
+		}
+		c.checkChoice(path+".mode", spec.Mode, modes)
+		c.checkChoice(path+".granularity", spec.Granularity, granularities)
+		c.checkChoice(path+".database", spec.Database, databases)
+		if len(spec.Health) > 0 && !strings.HasPrefix(spec.Health, "/") {
+			c.errorOn(path+".health", "health must be a path starting with /")
+		}
+
+		source := spec.Source
+		if len(source) == 0 {
+			source = "local:" + name
+		}
+		kind := strings.SplitN(source, ":", 2)
+		if len(kind) != 2 || len(kind[1]) == 0 {
+			c.errorOn(path+".source", fmt.Sprintf("%q is not a source such as local:<directory>", source))
+		} else if !oneOf(kind[0], sourceKinds) {
+			c.errorOn(path+".source", fmt.Sprintf("%q sources are not supported, use %s",
+				kind[0], strings.Join(sourceKinds, ", ")))
+		} else if checkSource != nil {
+			err := checkSource(source)
+			if err != nil {
+				c.errorOn(path+".source", err.Error())
+			}
+		}
+
+		for i, port := range spec.Expose {
+			c.checkPort(path+".expose["+strconv.Itoa(i)+"]", port)
+		}
+		for i, link := range spec.Links {
+			_, found := d.Containers[link]
+			if !found {
+				c.errorOn(path+".links["+strconv.Itoa(i)+"]", fmt.Sprintf("%q is not a container", link))
+			}
+		}
+		for i, dependency := range spec.DependsOn {
+			_, found := d.Containers[dependency]
+			if !found {
+				c.errorOn(path+".depends_on["+strconv.Itoa(i)+"]", fmt.Sprintf("%q is not a container", dependency))
+			}
+		}
+	}
+
+	// Missing containers were reported above, only circles are left
+	_, err := StartOrder(d)
+	if err != nil && strings.Contains(err.Error(), "circle") {
+		c.errorOn("containers", err.Error())
+	}
+
+	for i, r := range d.Routes {
+		path := "routes[" + strconv.Itoa(i) + "]"
+		_, found := d.Containers[r.Container]
+		if !found {
+			c.errorOn(path+".container", fmt.Sprintf("%q is not a container", r.Container))
+		}
+		if len(r.Path) > 0 && !strings.HasPrefix(r.Path, "/") {
+			c.errorOn(path+".path", "path must start with /")
+		}
+		if len(r.Health) > 0 && !strings.HasPrefix(r.Health, "/") {
+			c.errorOn(path+".health", "health must be a path starting with /")
+		}
+		if r.Port < 0 || r.Port > 65535 {
+			c.errorOn(path+".port", strconv.Itoa(r.Port)+" is not a port")
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const validBonesFile = `{
+  "machines": {"provider": "static", "ip": ["10.0.0.1", "10.0.0.2"]},
+  "containers": {
+    "web": {"source": "local:web", "quantity": 2, "expose": ["80", "53/udp"],
+            "links": ["postgresql"], "health": "/health"},
+    "postgresql": {"mode": "single", "granularity": "machine", "database": "postgresql"}
+  },
+  "routes": [{"host": "example.com", "path": "/", "container": "web", "port": 80}]
+}`
+
+func TestValidate(t *testing.T) {
+	d, err := Validate([]byte(validBonesFile))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if d.Containers["web"].Quantity != 2 || d.Routes[0].Port != 80 {
+		t.Error(errors.New("bonesFile was not read"))
+	}
+
+	// skeleton sends the orchestrator every field, empty ones included
+	b, err := json.Marshal(d)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = Validate(b)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// bonesFiles without a machine provider still load
+	_, err = Validate([]byte(`{"machines": {"ip": ["10.0.0.1"]}, "containers": {}}`))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateErrors(t *testing.T) {
+	tests := []struct {
+		file     string
+		expected string
+	}{
+		{"{\n  \"machines\": {\"provider\": \"static\"},\n  \"contaners\": {}\n}",
+			`3:3: contaners: unknown field "contaners", did you mean "containers"?`},
+		{`{"machines": {"provider": "static", "ip": "10.0.0.1"}}`,
+			"1:43: machines.ip: expected a list, not a string"},
+		{`{"machines": {"provider": "static"}, "machines": {}}`,
+			`1:38: machines: "machines" is given twice`},
+		{`{"machines": {"provider": "static"}, "containers": {"web": {"quantity": 1.5}}}`,
+			"1:73: containers.web.quantity: expected a whole number, not 1.5"},
+		{`{"machines": {"provider": "static"}, "containers": {"web": {"mode": "many"}}}`,
+			`1:69: containers.web.mode: "many" is not one of default, single`},
+		{`{"machines": {"provider": "static"}, "containers": {"web": {"expose": ["80", "70000"]}}}`,
+			`1:78: containers.web.expose[1]: "70000" is not a port such as 80, 80/tcp or 53/udp`},
+		{`{"machines": {"provider": "static"}, "containers": {"web": {"source": "git:web"}}}`,
+			`1:71: containers.web.source: "git" sources are not supported, use local`},
+		{`{"machines": {"provider": "static"}, "containers": {"web": {"links": ["db"]}}}`,
+			`1:71: containers.web.links[0]: "db" is not a container`},
+		{`{"machines": {"provider": "static", "ip": ["10.0.0.1", "10.0.0.1"]}}`,
+			`1:56: machines.ip[1]: "10.0.0.1" is listed twice`},
+		{`{"machines": {"provider": "static"}, "routes": [{"container": "web"}]}`,
+			`1:63: routes[0].container: "web" is not a container`},
+		{"{\n  \"machines\": {\"provider\": \"static\",}\n}",
+			"2:37: invalid JSON: invalid character '}' looking for beginning of object key string"},
+	}
+
+	for _, test := range tests {
+		_, err := Validate([]byte(test.file))
+		if err == nil {
+			t.Error(errors.New("no error for " + test.file))
+			continue
+		}
+		if err.Error() != test.expected {
+			t.Error(errors.New("error for " + test.file + " is " + err.Error()))
+		}
+	}
+}
+
+func TestValidateEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"", " \n\t\n"} {
+		name := filepath.Join(dir, "bonesFile")
+		err = ioutil.WriteFile(name, []byte(file), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Validator{}.ValidateFile(name)
+		if err == nil || !strings.HasSuffix(err.Error(), "1:1: bonesFile is empty") {
+			t.Errorf("error for %q is %v", file, err)
+		}
+		_, err = Validate([]byte(file))
+		if err == nil || err.Error() != "1:1: bonesFile is empty" {
+			t.Errorf("error for %q is %v", file, err)
+		}
+	}
+}
+
+func TestValidateSource(t *testing.T) {
+	v := Validator{CheckSource: func(source string) error {
+		return errors.New(source + " does not exist")
+	}}
+	_, err := v.Validate([]byte(`{"machines": {"provider": "static"}, "containers": {"web": {}}}`))
+	if err == nil || !strings.HasSuffix(err.Error(), "containers.web.source: local:web does not exist") {
+		t.Error(errors.New("source was not checked"))
+	}
+}
@@ -0,0 +1,388 @@
+package common
+
+import (
+	"strconv"
+	"strings"
+)
+
+// skeleton reads the part of YAML a bonesFile needs: block mappings and
+// lists, flow lists and mappings on a single line, quoted and plain scalars
+// and comments. Anchors, tags and multi-line strings are refused rather than
+// misread. Plain scalars are read as whatever type the bonesFile wants there,
+// so expose: [80] and expose: ["80"] are the same.
+
+// yamlLine is a line with something on it
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	file  string
+	lines []yamlLine
+	i     int
+}
+
+func parseYAML(file string, b []byte) (*node, error) {
+	p := &yamlParser{file: file}
+	for i, raw := range strings.Split(string(b), "\n") {
+		raw = strings.TrimRight(raw, "\r")
+		text := strings.TrimLeft(raw, " ")
+		indent := len(raw) - len(text)
+		if strings.HasPrefix(text, "\t") {
+			return nil, parseError(position{file, i + 1, indent + 1}, "indent with spaces, not tabs")
+		}
+		text = strings.TrimRight(yamlComment(text), " \t")
+		if indent == 0 && text == "..." {
+			break
+		}
+		if len(text) == 0 || (indent == 0 && text == "---") {
+			continue
+		}
+		p.lines = append(p.lines, yamlLine{i + 1, indent, text})
+	}
+
+	if len(p.lines) == 0 {
+		return &node{position: position{file, 1, 1}, kind: 'n'}, nil
+	}
+	n, err := p.block(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.i < len(p.lines) {
+		return nil, p.errorAt(p.lines[p.i], 0, "unexpected indentation")
+	}
+	return n, nil
+}
+
+// yamlComment strips a comment off a line
+func yamlComment(text string) string {
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case quote != 0:
+			if text[i] == quote {
+				quote = 0
+			}
+		case text[i] == '"' || text[i] == '\'':
+			quote = text[i]
+		case text[i] == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+func (p *yamlParser) at(l yamlLine, offset int) position {
+	return position{p.file, l.number, l.indent + offset + 1}
+}
+
+func (p *yamlParser) errorAt(l yamlLine, offset int, message string) error {
+	return parseError(p.at(l, offset), message)
+}
+
+func isListItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// block parses the mapping, list or scalar starting at the current line
+func (p *yamlParser) block(indent int) (*node, error) {
+	l := p.lines[p.i]
+	if isListItem(l.text) {
+		return p.list(indent)
+	}
+	_, _, _, ok, err := p.key(l)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return p.mapping(indent)
+	}
+	p.i++
+	return p.inline(l, 0, l.text)
+}
+
+// key splits a key: value line, ok is false if it isn't one
+func (p *yamlParser) key(l yamlLine) (key string, rest string, offset int, ok bool, err error) {
+	text := l.text
+	end := -1
+	switch text[0] {
+	case '"', '\'':
+		var n int
+		key, n, err = p.quoted(l, 0, text)
+		if err != nil {
+			return
+		}
+		end = n + len(text[n:]) - len(strings.TrimLeft(text[n:], " "))
+		if end >= len(text) || text[end] != ':' {
+			return "", "", 0, false, nil
+		}
+	case '[', '{':
+		return
+	default:
+		for i := 0; i < len(text); i++ {
+			if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return
+		}
+		key = strings.TrimRight(text[:end], " ")
+	}
+	if end+1 < len(text) && text[end+1] != ' ' {
+		return "", "", 0, false, nil
+	}
+
+	rest = strings.TrimLeft(text[end+1:], " ")
+	return key, rest, len(text) - len(rest), true, nil
+}
+
+// mapping parses key: value lines at an indentation
+func (p *yamlParser) mapping(indent int) (*node, error) {
+	n := &node{position: p.at(p.lines[p.i], 0), kind: '{'}
+	for p.i < len(p.lines) {
+		l := p.lines[p.i]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, p.errorAt(l, 0, "unexpected indentation")
+		}
+		key, rest, offset, ok, err := p.key(l)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, p.errorAt(l, 0, "expected key: value")
+		}
+		p.i++
+
+		value, err := p.value(l, rest, offset, indent, true)
+		if err != nil {
+			return nil, err
+		}
+		n.keys = append(n.keys, key)
+		n.keyAt = append(n.keyAt, p.at(l, 0))
+		n.children = append(n.children, value)
+	}
+	return n, nil
+}
+
+// list parses - item lines at an indentation
+func (p *yamlParser) list(indent int) (*node, error) {
+	n := &node{position: p.at(p.lines[p.i], 0), kind: '['}
+	for p.i < len(p.lines) {
+		l := p.lines[p.i]
+		if l.indent < indent || (l.indent == indent && !isListItem(l.text)) {
+			break
+		}
+		if l.indent > indent {
+			return nil, p.errorAt(l, 0, "unexpected indentation")
+		}
+
+		rest := strings.TrimLeft(l.text[1:], " ")
+		offset := len(l.text) - len(rest)
+		isKey := false
+		var err error
+		if len(rest) > 0 {
+			_, _, _, isKey, err = p.key(yamlLine{l.number, l.indent + offset, rest})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var child *node
+		if isListItem(rest) || isKey {
+			// A mapping or list starting after the dash is read as if it
+			// were on a line of its own, indented to where it starts
+			p.lines[p.i] = yamlLine{l.number, l.indent + offset, rest}
+			child, err = p.block(l.indent + offset)
+		} else {
+			p.i++
+			child, err = p.value(l, rest, offset, indent, false)
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.children = append(n.children, child)
+	}
+	return n, nil
+}
+
+// value parses what follows a key or a dash, which is either the rest of the
+// line or the block below it. Lists under a key can be at the key's
+// indentation
+func (p *yamlParser) value(l yamlLine, rest string, offset int, indent int, underKey bool) (*node, error) {
+	if len(rest) > 0 {
+		return p.inline(l, offset, rest)
+	}
+	if p.i < len(p.lines) {
+		next := p.lines[p.i]
+		if next.indent > indent || (underKey && next.indent == indent && isListItem(next.text)) {
+			return p.block(next.indent)
+		}
+	}
+	return &node{position: p.at(l, offset), kind: 'n'}, nil
+}
+
+// inline parses a value that takes up the rest of a line
+func (p *yamlParser) inline(l yamlLine, offset int, text string) (n *node, err error) {
+	end := len(text)
+	switch text[0] {
+	case '[', '{':
+		n, end, err = p.flow(l, offset, text, 0, false)
+	case '"', '\'':
+		n = &node{position: p.at(l, offset), kind: '"'}
+		n.value, end, err = p.quoted(l, offset, text)
+	default:
+		n, err = p.plain(l, offset, text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(text[end:])) > 0 {
+		return nil, p.errorAt(l, offset+end, "unexpected text after the value")
+	}
+	return n, nil
+}
+
+// plain reads an unquoted scalar
+func (p *yamlParser) plain(l yamlLine, offset int, text string) (*node, error) {
+	at := p.at(l, offset)
+	if strings.IndexByte("&*!|>%@`", text[0]) >= 0 {
+		return nil, parseError(at, "YAML "+text[:1]+" is not supported in a bonesFile")
+	}
+	switch text {
+	case "null", "Null", "NULL", "~":
+		return &node{position: at, kind: 'n'}, nil
+	}
+	return &node{position: at, kind: 'p', value: text}, nil
+}
+
+// quoted reads a quoted scalar at the start of text, returning where it ends
+func (p *yamlParser) quoted(l yamlLine, offset int, text string) (value string, end int, err error) {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		if quote == '"' && text[i] == '\\' {
+			i++
+			continue
+		}
+		if text[i] != quote {
+			continue
+		}
+		if quote == '\'' && i+1 < len(text) && text[i+1] == '\'' {
+			i++
+			continue
+		}
+
+		if quote == '\'' {
+			return strings.Replace(text[1:i], "''", "'", -1), i + 1, nil
+		}
+		value, err = strconv.Unquote(strings.Replace(text[:i+1], `\/`, "/", -1))
+		if err != nil {
+			return "", 0, p.errorAt(l, offset, "invalid escape in string")
+		}
+		return value, i + 1, nil
+	}
+	return "", 0, p.errorAt(l, offset, "string doesn't end on this line")
+}
+
+// flow parses a flow list or mapping, or a scalar inside one, starting at
+// text[i]. It returns where the value ends
+func (p *yamlParser) flow(l yamlLine, offset int, text string, i int, isKey bool) (n *node, end int, err error) {
+	for i < len(text) && text[i] == ' ' {
+		i++
+	}
+	if i == len(text) {
+		return nil, 0, p.errorAt(l, offset+i, "flow lists and mappings must end on the line they start")
+	}
+	at := p.at(l, offset+i)
+
+	switch text[i] {
+	case '[', '{':
+		n = &node{position: at, kind: text[i]}
+		close := byte(']')
+		if n.kind == '{' {
+			close = '}'
+		}
+		i++
+		for {
+			for i < len(text) && text[i] == ' ' {
+				i++
+			}
+			if i < len(text) && text[i] == close {
+				return n, i + 1, nil
+			}
+
+			if n.kind == '{' {
+				var key *node
+				key, i, err = p.flow(l, offset, text, i, true)
+				if err != nil {
+					return
+				}
+				if key.kind == '[' || key.kind == '{' {
+					return nil, 0, parseError(key.position, "keys must be strings")
+				}
+				for i < len(text) && text[i] == ' ' {
+					i++
+				}
+				if i == len(text) || text[i] != ':' {
+					return nil, 0, p.errorAt(l, offset+i, "expected :")
+				}
+				n.keys = append(n.keys, key.value)
+				n.keyAt = append(n.keyAt, key.position)
+				i++
+			}
+
+			var child *node
+			child, i, err = p.flow(l, offset, text, i, false)
+			if err != nil {
+				return
+			}
+			n.children = append(n.children, child)
+
+			for i < len(text) && text[i] == ' ' {
+				i++
+			}
+			switch {
+			case i == len(text):
+				return nil, 0, p.errorAt(l, offset+i, "flow lists and mappings must end on the line they start")
+			case text[i] == ',':
+				i++
+			case text[i] != close:
+				return nil, 0, p.errorAt(l, offset+i, "expected , or "+string(close))
+			}
+		}
+
+	case '"', '\'':
+		n = &node{position: at, kind: '"'}
+		var length int
+		n.value, length, err = p.quoted(l, offset+i, text[i:])
+		return n, i + length, err
+	}
+
+	stop := ",[]{}"
+	if isKey {
+		stop += ":"
+	}
+	j := i
+	for j < len(text) && strings.IndexByte(stop, text[j]) < 0 {
+		// Variables are part of the value, braces and all
+		end := strings.IndexByte(text[j:], '}')
+		if strings.HasPrefix(text[j:], "${") && end > 0 && !strings.ContainsAny(text[j+2:j+end], stop) {
+			j += end
+		}
+		j++
+	}
+	value := strings.TrimRight(text[i:j], " ")
+	if len(value) == 0 {
+		return nil, 0, parseError(at, "expected a value")
+	}
+	n, err = p.plain(l, offset+i, value)
+	return n, j, err
+}
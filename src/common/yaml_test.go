@@ -0,0 +1,96 @@
+package common
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const validYAML = `# The same deployment as validBonesFile
+machines:
+  provider: static
+  ip: [10.0.0.1, "10.0.0.2"]
+
+containers:
+  web:
+    source: local:web
+    quantity: 2
+    expose:
+    - 80
+    - 53/udp
+    links: [postgresql]
+    health: /health   # answered once it is up
+  postgresql: {mode: single, granularity: machine, database: 'postgresql'}
+
+routes:
+  - host: example.com
+    path: /
+    container: web
+    port: 80
+`
+
+func TestYAML(t *testing.T) {
+	expected, err := Validate([]byte(validBonesFile))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	n, err := parseYAML("bonesFile.yaml", []byte(validYAML))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	d, err := Validator{}.validate(n)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(d, expected) {
+		t.Error(errors.New("YAML and JSON bonesFiles differ"))
+	}
+
+	n, err = parseYAML("bonesFile.yaml", []byte("machines: {ip: [${FIRST_IP}, '${SECOND_IP}']}\n"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ips := n.children[0].children[0]
+	if len(ips.children) != 2 || ips.children[0].value != "${FIRST_IP}" {
+		t.Error(errors.New("variables in a flow list were not read"))
+	}
+}
+
+func TestYAMLErrors(t *testing.T) {
+	tests := []struct {
+		file     string
+		expected string
+	}{
+		{"machines:\n  provider: static\n   ip: []\n",
+			"bonesFile.yaml:3:4: unexpected indentation"},
+		{"machines:\n\tprovider: static\n",
+			"bonesFile.yaml:2:1: indent with spaces, not tabs"},
+		{"containers:\n  web: {quantity: 1\n",
+			"bonesFile.yaml:2:20: flow lists and mappings must end on the line they start"},
+		{"machines: {ip: [${FIRST_IP], provider: static}\n",
+			"bonesFile.yaml:1:18: expected , or ]"},
+		{"containers:\n  web: &web {}\n",
+			"bonesFile.yaml:2:8: YAML & is not supported in a bonesFile"},
+		{"machines:\n  provider: static\ncontainers:\n  web:\n    quantity: two\n",
+			"bonesFile.yaml:5:15: containers.web.quantity: expected a whole number, not two"},
+	}
+
+	for _, test := range tests {
+		n, err := parseYAML("bonesFile.yaml", []byte(test.file))
+		if err == nil {
+			_, err = Validator{}.validate(n)
+		}
+		if err == nil {
+			t.Error(errors.New("no error for " + test.file))
+			continue
+		}
+		if err.Error() != test.expected {
+			t.Error(errors.New("error for " + test.file + " is " + err.Error()))
+		}
+	}
+}
@@ -3,12 +3,49 @@ package main
 import (
 	"libgatekeeper"
 	"log"
+	"os"
+	"strings"
 )
 
 func main() {
 
 	g := libgatekeeper.NewServer()
-	err := g.Listen(":800")
+
+	if len(os.Getenv("ADMIN_KEY")) > 0 {
+		g.SetAdmin(os.Getenv("ADMIN_KEY"))
+	}
+
+	// The audit log lives in the /foo volume so it outlives the container
+	audit := os.Getenv("AUDIT_LOG")
+	if len(audit) == 0 {
+		audit = "/foo/gatekeeper.audit"
+	}
+	// Keys are hashed with the administrator key, so the administrator can
+	// find the events about a key and nobody else can tell whose they are
+	err := g.SetAuditLog(audit, os.Getenv("ADMIN_KEY"))
+	if err != nil {
+		log.Print(err, ", keeping the audit log in memory only")
+	}
+
+	// Replicas are reached on port 800 of the machine named by HOST, and
+	// join the replica set through any of the comma separated PEERS. They
+	// only talk to replicas holding the same PEER_KEY
+	g.SetPeerKey(os.Getenv("PEER_KEY"))
+	host := os.Getenv("HOST")
+	if len(host) > 0 {
+		var peers []string
+		if len(os.Getenv("PEERS")) > 0 {
+			peers = strings.Split(os.Getenv("PEERS"), ",")
+		}
+		go func() {
+			err := g.Join(host+":800", peers)
+			if err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+
+	err = g.Listen(":800")
 	log.Fatal(err)
 
 }
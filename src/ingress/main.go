@@ -0,0 +1,61 @@
+package main
+
+import (
+	"common"
+	"encoding/json"
+	"libgatekeeper"
+	"libingress"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// refreshInterval is how often the routes and the service catalog are read
+// from the gatekeeper
+var refreshInterval = 5 * time.Second
+
+// refresh keeps the proxy in line with the routes the orchestrator published
+// and the endpoints in the service catalog. A container whose endpoints can't
+// be looked up keeps the ones it had
+func refresh(c *libgatekeeper.Client, p *libingress.Proxy) {
+	known := make(map[string][]string)
+	for ; ; time.Sleep(refreshInterval) {
+		v, err := c.Get("ingress")
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		routes := []common.Route{}
+		err = json.Unmarshal([]byte(v), &routes)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		services := make(map[string][]string)
+		for _, r := range routes {
+			endpoints, err := c.Lookup(r.Container)
+			if err != nil {
+				log.Print(err)
+				endpoints = known[r.Container]
+			}
+			services[r.Container] = endpoints
+		}
+		known = services
+		p.Update(routes, services)
+	}
+}
+
+func main() {
+	c, err := libgatekeeper.NewOneTimeClient(os.Getenv("GATEKEEPER"), os.Getenv("GATEKEEPER_KEY"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p := libingress.NewProxy()
+	go p.StartHealthChecks()
+	go refresh(c, p)
+
+	log.Fatal(http.ListenAndServe(":8080", p))
+}
@@ -0,0 +1,147 @@
+package libgatekeeper
+
+import (
+	"errors"
+	"strings"
+)
+
+// Level is how much a key may do with an item. Each level includes the ones
+// below it. Read lets a key fetch the value, write lets it change the value,
+// and admin lets it delete the item and decide who else may use it
+type Level int
+
+const (
+	None Level = iota
+	Read
+	Write
+	Admin
+)
+
+var levelNames = []string{"none", "read", "write", "admin"}
+
+func (l Level) String() string {
+	if l < None || l > Admin {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *Level) UnmarshalText(b []byte) (err error) {
+	*l, err = ParseLevel(string(b))
+	return
+}
+
+// ParseLevel turns "read", "write" or "admin" into a Level
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if name == s && i > 0 {
+			return Level(i), nil
+		}
+	}
+	return None, errors.New("Unknown permission level " + s)
+}
+
+// SetAdmin makes key the server administrator, which has admin access to
+// every item and role and is the only key allowed to revoke other keys
+func (g *Server) SetAdmin(key string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.admin = key
+}
+
+// access works out what key may do with item from the item and its parents.
+// The owner has admin access, keys get whatever they were given, and the
+// members of a role get whatever the role was granted. Parents created after
+// item pass nothing down, so nobody gains access to an item by creating a
+// parent for it later. Nor do parents with another owner, so nobody gains
+// access to the items others create below theirs. It must be called with the
+// lock held
+func (g *Server) access(item, key string) (l Level) {
+	if len(g.admin) > 0 && key == g.admin {
+		return Admin
+	}
+
+	// Unredeemed one time keys are owned by nobody, which must not make
+	// them anybody's. See Redeem for how they are used up
+	if len(key) == 0 || strings.HasPrefix(item, reservedPrefix) {
+		return None
+	}
+
+	self, exists := g.objects[item]
+	for _, i := range ancestry(item) {
+		o, found := g.objects[i]
+		if !found || (exists && i != item &&
+			(o.Created > self.Created || o.Owner != self.Owner)) {
+			continue
+		}
+		if o.Owner == key {
+			return Admin
+		}
+		if l < o.Permissions[key] {
+			l = o.Permissions[key]
+		}
+		for name, granted := range o.Grants {
+			if g.roles[name].Members[key] && l < granted {
+				l = granted
+			}
+		}
+	}
+	return
+}
+
+// Permissions describes who may use an item. Keys and Roles only hold what
+// was given on the item itself, Access is what the asking key may do counting
+// everything inherited
+type Permissions struct {
+	Owner  string           `json:",omitempty"`
+	Keys   map[string]Level `json:",omitempty"`
+	Roles  map[string]Level `json:",omitempty"`
+	Access Level
+}
+
+// Inspect tells key what it may do with item. Keys with admin access are also
+// shown the full list of who else may use it
+func (g *Server) Inspect(item, key string) (p Permissions, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	o, found := g.objects[item]
+	p.Access = g.access(item, key)
+	if !found || p.Access < Read {
+		return p, errors.New("No Such Item or Permission Denied")
+	}
+
+	if p.Access == Admin {
+		p.Owner = o.Owner
+		p.Keys = make(map[string]Level)
+		for k, l := range o.Permissions {
+			p.Keys[k] = l
+		}
+		p.Roles = make(map[string]Level)
+		for name, l := range o.Grants {
+			p.Roles[name] = l
+		}
+	}
+	return p, nil
+}
+
+// canRead checks key may read item. It must be called with the lock held
+func (g *Server) canRead(item, key string) bool {
+	return g.access(item, key) >= Read
+}
+
+// canWrite checks key may change item's value. It must be called with the lock
+// held
+func (g *Server) canWrite(item, key string) bool {
+	return g.access(item, key) >= Write
+}
+
+// owns checks key may delete item or change who can use it. It must be called
+// with the lock held
+func (g *Server) owns(item, key string) bool {
+	return g.access(item, key) >= Admin
+}
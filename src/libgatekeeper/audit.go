@@ -0,0 +1,269 @@
+package libgatekeeper
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditMemory is how many recent events are kept in memory for queries, the
+// log file keeps all of them
+const auditMemory = 10000
+
+// Event is one gatekeeper operation as recorded in the audit log. Each event
+// carries the hash of the one before it, so editing or removing an event in
+// the log breaks the chain from that point on
+type Event struct {
+	Time   time.Time
+	Key    string
+	Item   string
+	Op     string
+	Result string
+	Remote string
+	Prev   string
+	Hash   string
+}
+
+// hash works out the hash an event should carry
+func (e Event) hash() string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashKey identifies a key in the log without giving it away. The hash is
+// keyed, so only whoever holds the log's secret can tell which key it is
+func (a *auditLog) hashKey(key string) string {
+	m := hmac.New(sha256.New, a.secret)
+	m.Write([]byte(key))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// hashItem hides the names of key items, as the name of a one time key is
+// the key itself
+func (a *auditLog) hashItem(item string) string {
+	if !strings.HasPrefix(item, keyPrefix) {
+		return item
+	}
+	return keyPrefix + a.hashKey(strings.TrimPrefix(item, keyPrefix))
+}
+
+type auditLog struct {
+	lock   sync.Mutex
+	w      io.Writer
+	secret []byte
+	events []Event
+	last   string
+}
+
+// newAuditLog makes a log writing to w, hashing keys with secret. Without a
+// secret a random one is used, so keys can't be told apart across restarts
+func newAuditLog(w io.Writer, secret string) *auditLog {
+	a := &auditLog{w: w, secret: []byte(secret)}
+	if len(secret) == 0 {
+		a.secret = make([]byte, 32)
+		rand.Read(a.secret)
+	}
+	return a
+}
+
+// openAuditLog appends to the log file at path, carrying on the chain of
+// whatever is already in it. If that chain is broken, by a crash halfway
+// through a line or by tampering, the file is set aside and a new one is
+// started, beginning with an event saying so
+func openAuditLog(path string, secret string) (a *auditLog, err error) {
+	a = newAuditLog(nil, secret)
+
+	broken := ""
+	f, err := os.Open(path)
+	if err == nil {
+		err = a.load(f)
+		f.Close()
+		if err != nil {
+			aside := path + "." + time.Now().UTC().Format("20060102T150405")
+			log.Print(err, ", starting a new audit log and keeping the old one as ", aside)
+			broken = err.Error() + ", the old log is " + aside
+			a.last = ""
+			err = os.Rename(path, aside)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	a.w, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if len(broken) > 0 {
+		err = a.record("", "", "audit", broken, "")
+	}
+	return
+}
+
+// load reads back a log, checking the chain as it goes
+func (a *auditLog) load(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1000000)
+	for line := 1; s.Scan(); line++ {
+		e := Event{}
+		err := json.Unmarshal(s.Bytes(), &e)
+		if err != nil {
+			return fmt.Errorf("Audit log line %d: %s", line, err)
+		}
+		if e.Prev != a.last || e.Hash != e.hash() {
+			return fmt.Errorf("Audit log line %d: hash chain broken", line)
+		}
+		a.remember(e)
+	}
+	return s.Err()
+}
+
+// remember keeps an event for queries. It must be called with the lock held
+func (a *auditLog) remember(e Event) {
+	a.last = e.Hash
+	a.events = append(a.events, e)
+	if len(a.events) > auditMemory {
+		a.events = append([]Event{}, a.events[len(a.events)-auditMemory:]...)
+	}
+}
+
+func (a *auditLog) record(key, item, op, result, remote string) (err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	e := Event{time.Now(), a.hashKey(key), a.hashItem(item), op, result, remote, a.last, ""}
+	e.Hash = e.hash()
+	a.remember(e)
+
+	if a.w != nil {
+		var b []byte
+		b, err = json.Marshal(e)
+		if err == nil {
+			_, err = a.w.Write(append(b, '\n'))
+		}
+	}
+	return
+}
+
+// query gives the remembered events about item, or every item if it is "",
+// since a time
+func (a *auditLog) query(item string, since time.Time) (events []Event) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, e := range a.events {
+		if (len(item) == 0 || e.Item == item) && !e.Time.Before(since) {
+			events = append(events, e)
+		}
+	}
+	return
+}
+
+// VerifyAudit checks the hash chain of an audit log
+func VerifyAudit(r io.Reader) error {
+	return newAuditLog(nil, "").load(r)
+}
+
+// SetAuditLog appends audit events to the file at path as well as keeping
+// them in memory. Keys are hashed with secret
+func (g *Server) SetAuditLog(path string, secret string) (err error) {
+	a, err := openAuditLog(path, secret)
+	if err != nil {
+		return
+	}
+	g.lock.Lock()
+	g.audit = a
+	g.lock.Unlock()
+	return
+}
+
+// Audit gives the recorded events about item since a time, for the server
+// administrator only
+func (g *Server) Audit(item, key string, since time.Time) (events []Event, err error) {
+	g.lock.Lock()
+	a := g.audit
+	admin := len(g.admin) > 0 && key == g.admin
+	g.lock.Unlock()
+
+	if !admin {
+		return nil, errors.New("Permission Denied")
+	}
+	return a.query(item, since), nil
+}
+
+// statusWriter remembers the status a handler answered with
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// audited records every call to a handler serving /name/. Heartbeats between
+// replicas answer 204 and are left out, there are several a second
+func (g *Server) audited(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := &statusWriter{w, 200}
+		h(s, r)
+		if s.status == 204 {
+			return
+		}
+
+		result := "ok"
+		if s.status >= 400 {
+			result = strconv.Itoa(s.status) + " " + http.StatusText(s.status)
+		}
+
+		g.lock.Lock()
+		a := g.audit
+		g.lock.Unlock()
+		err := a.record(r.FormValue("key"), itemPath(r.URL.Path, "/"+name),
+			r.Method+" "+name, result, r.RemoteAddr)
+		if err != nil {
+			log.Print("Audit log not written: ", err)
+		}
+	}
+}
+
+func (g *Server) auditQuery(w http.ResponseWriter, r *http.Request) {
+	since := time.Time{}
+	var err error
+	if len(r.FormValue("since")) > 0 {
+		since, err = time.Parse(time.RFC3339, r.FormValue("since"))
+	}
+
+	var events []Event
+	if err == nil {
+		events, err = g.Audit(r.FormValue("item"), r.FormValue("key"), since)
+	}
+
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,126 @@
+package libgatekeeper
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditChain(t *testing.T) {
+	b := new(bytes.Buffer)
+	a := newAuditLog(b, "secret")
+	a.record("key", "apps/web", "GET object", "ok", "127.0.0.1:1000")
+	a.record("key", "apps/web", "POST object", "ok", "127.0.0.1:1000")
+	a.record("other", "apps/api", "GET object", "400 Bad Request", "127.0.0.1:1001")
+
+	log := b.String()
+	if strings.Contains(log, "\"key\"") {
+		t.Error("audit log contains a raw key")
+	}
+
+	err := VerifyAudit(strings.NewReader(log))
+	if err != nil {
+		t.Error(err)
+	}
+
+	events := a.query("apps/web", time.Time{})
+	if len(events) != 2 {
+		t.Errorf("found %d events about apps/web", len(events))
+	}
+
+	// Dropping an event breaks the chain
+	lines := strings.SplitAfter(log, "\n")
+	err = VerifyAudit(strings.NewReader(lines[0] + lines[2]))
+	if err == nil {
+		t.Error("removed event went unnoticed")
+	}
+
+	// So does editing one
+	tampered := strings.Replace(log, "400 Bad Request", "ok", 1)
+	err = VerifyAudit(strings.NewReader(tampered))
+	if err == nil {
+		t.Error("edited event went unnoticed")
+	}
+}
+
+func TestAuditAdminOnly(t *testing.T) {
+	g := NewServer()
+	g.SetAdmin("admin")
+
+	_, err := g.Audit("", "key", time.Time{})
+	if err == nil {
+		t.Error("non administrator read the audit log")
+	}
+	_, err = g.Audit("", "admin", time.Time{})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuditHidesKeys(t *testing.T) {
+	b := new(bytes.Buffer)
+	a := newAuditLog(b, "secret")
+	a.record("containerkey", "key.onetime", "POST redeem", "ok", "127.0.0.1:1000")
+
+	if strings.Contains(b.String(), "onetime") || strings.Contains(b.String(), "containerkey") {
+		t.Error("audit log contains a one time key")
+	}
+
+	// Without the secret the hash of a key can't be worked out
+	if a.hashKey("containerkey") == newAuditLog(nil, "other").hashKey("containerkey") {
+		t.Error("key hashes don't depend on the secret")
+	}
+}
+
+func TestAuditBrokenChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gatekeeper.audit")
+
+	a, err := openAuditLog(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.record("key", "apps/web", "GET object", "ok", "127.0.0.1:1000")
+	a.record("key", "apps/web", "POST object", "ok", "127.0.0.1:1000")
+
+	// A crash tears the last line
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Time": "2014`)
+	f.Close()
+
+	a, err = openAuditLog(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.record("key", "apps/web", "GET object", "ok", "127.0.0.1:1000")
+
+	// The old log is kept aside and the new one starts a chain of its own
+	matches, _ := filepath.Glob(path + ".*")
+	if len(matches) != 1 {
+		t.Fatalf("%d logs set aside", len(matches))
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = VerifyAudit(bytes.NewReader(b))
+	if err != nil {
+		t.Error(err)
+	}
+	events := a.query("", time.Time{})
+	last := events[len(events)-2]
+	if last.Op != "audit" || !strings.Contains(last.Result, "line 3") {
+		t.Error("broken chain not recorded: " + last.Result)
+	}
+}
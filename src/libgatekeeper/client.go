@@ -2,41 +2,119 @@ package libgatekeeper
 
 import (
 	"common"
+	"encoding/json"
 	"errors"
 	"io/ioutil"
-	"log"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type Client struct {
-	h   *common.HttpAPI
-	key string
+	lock    sync.Mutex
+	hs      []*common.HttpAPI
+	current int
+	key     string
 }
 
 func NewOneTimeClient(address string, onetimekey string) (g *Client, err error) {
 	g = NewClient(address, "")
 
-	// Fetch the key & delete it
-	key, err := g.Get("key." + onetimekey)
+	// Fetch the key, using it up
+	key, err := g.Redeem("key." + onetimekey)
 	if err != nil {
 		return
 	}
-
-	err = g.Delete("key." + onetimekey)
-	if err != nil {
-		log.Print("error deleting onetime key")
-	}
 	g.key = key
 	return
 }
 
+// NewClient makes a client for the gatekeeper at address. address may be a
+// comma separated list of replicas, which the client fails over between
 func NewClient(address string, key string) (g *Client) {
-	g = &Client{common.NewHttpClient(address), key}
+	g = &Client{key: key}
+	for _, a := range strings.Split(address, ",") {
+		g.AddReplica(a)
+	}
 	return
 }
 
+// AddReplica tells the client about another gatekeeper replica
+func (g *Client) AddReplica(address string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.addReplica(address)
+}
+
+func (g *Client) addReplica(address string) int {
+	for i, h := range g.hs {
+		if h.Address() == address {
+			return i
+		}
+	}
+	g.hs = append(g.hs, common.NewHttpClient(address))
+	return len(g.hs) - 1
+}
+
+// request sends a request to the current replica. When that replica is down,
+// or it is a follower turning away a write, the client moves on to the leader
+// it points at or else to the next replica
+func (g *Client) request(method string, url string, body string) (resp *http.Response, err error) {
+	g.lock.Lock()
+	tries := 2 * len(g.hs)
+	g.lock.Unlock()
+
+	// The lock isn't held during the request, so a long poll doesn't hold up
+	// everything else
+	for ; tries >= 0; tries-- {
+		g.lock.Lock()
+		current := g.current
+		h := g.hs[current]
+		g.lock.Unlock()
+
+		resp, err = h.Request(method, url, strings.NewReader(body))
+		if err == nil && resp.StatusCode != 503 {
+			return
+		}
+
+		g.lock.Lock()
+		if g.current == current {
+			g.current = (current + 1) % len(g.hs)
+		}
+		if err == nil {
+			leader := resp.Header.Get("X-Gatekeeper-Leader")
+			resp.Body.Close()
+			if len(leader) > 0 && leader != h.Address() {
+				g.current = g.addReplica(leader)
+			}
+		}
+		g.lock.Unlock()
+
+		if err != nil && !retryable(method, err) {
+			return nil, err
+		}
+	}
+
+	if err == nil {
+		err = errors.New("No gatekeeper replica available")
+	}
+	return nil, err
+}
+
+// retryable tells whether a request that failed with err may be sent to the
+// next replica. A write whose connection broke may already have been applied,
+// so only reads and requests that never got through are sent again. A 503
+// means the replica applied nothing, so those are always retried
+func retryable(method string, err error) bool {
+	return method == "GET" || method == "LIST" || errors.Is(err, syscall.ECONNREFUSED)
+}
+
 func (g *Client) Get(key string) (value string, err error) {
-	resp, err := g.h.Get("object/" + key + "?key=" + g.key)
+	resp, err := g.request("GET", "object/"+key+"?key="+g.key, "")
 	if err != nil {
 		return
 	}
@@ -51,9 +129,44 @@ func (g *Client) Get(key string) (value string, err error) {
 	return
 }
 
+// List gives the names directly below prefix which this client can read
+func (g *Client) List(prefix string) (children []string, err error) {
+	resp, err := g.request("LIST", "object/"+prefix+"?key="+g.key, "")
+	if err != nil {
+		return
+	}
+
+	c, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errors.New("Status code is " + resp.Status)
+		return
+	}
+	if len(c) > 0 {
+		children = strings.Split(string(c), "\n")
+	}
+	return
+}
+
+// Redeem fetches item and deletes it in one step, failing if somebody else
+// got there first
+func (g *Client) Redeem(item string) (value string, err error) {
+	resp, err := g.request("POST", "redeem/"+item+"?key="+g.key, "")
+	if err != nil {
+		return
+	}
+	c, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errors.New("Status code is " + resp.Status)
+		return
+	}
+	value = string(c)
+	return
+}
+
 func (g *Client) Set(item string, value string) (err error) {
-	b := strings.NewReader(value)
-	resp, err := g.h.Post("object/"+item+"?key="+g.key, "text/plain", b)
+	resp, err := g.request("POST", "object/"+item+"?key="+g.key, value)
 	if err != nil {
 		return
 	}
@@ -65,8 +178,7 @@ func (g *Client) Set(item string, value string) (err error) {
 }
 
 func (g *Client) New(item string, value string) (err error) {
-	b := strings.NewReader(value)
-	resp, err := g.h.Put("object/"+item+"?key="+g.key, "text/plain", b)
+	resp, err := g.request("PUT", "object/"+item+"?key="+g.key, value)
 	if err != nil {
 		return
 	}
@@ -78,7 +190,7 @@ func (g *Client) New(item string, value string) (err error) {
 }
 
 func (g *Client) Delete(item string) (err error) {
-	resp, err := g.h.Delete("object/" + item + "?key=" + g.key)
+	resp, err := g.request("DELETE", "object/"+item+"?key="+g.key, "")
 	if err != nil {
 		return
 	}
@@ -91,8 +203,7 @@ func (g *Client) Delete(item string) (err error) {
 }
 
 func (g *Client) AddAccess(item string, newkey string) (err error) {
-	b := strings.NewReader(newkey)
-	resp, err := g.h.Post("permissions/"+item+"?key="+g.key, "text/plain", b)
+	resp, err := g.request("POST", "permissions/"+item+"?key="+g.key, newkey)
 	if err != nil {
 		return
 	}
@@ -103,15 +214,380 @@ func (g *Client) AddAccess(item string, newkey string) (err error) {
 	return
 }
 
+// SetAccess gives newkey a level of access to item and everything below it
+func (g *Client) SetAccess(item string, newkey string, l Level) (err error) {
+	return g.simple("POST", "permissions/"+item+"?key="+g.key+"&level="+l.String(), newkey)
+}
+
+// Inspect asks what this client may do with item, and for items it
+// administers who else may use them
+func (g *Client) Inspect(item string) (p Permissions, err error) {
+	resp, err := g.request("GET", "permissions/"+item+"?key="+g.key, "")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errors.New("Status code is " + resp.Status)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&p)
+	return
+}
+
+// Exists tells whether item exists and this client may read it. To anybody
+// else a missing item and one they can't read look the same
+func (g *Client) Exists(item string) (found bool, err error) {
+	resp, err := g.request("GET", "permissions/"+item+"?key="+g.key, "")
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 400:
+		return false, nil
+	}
+	return false, errors.New("Status code is " + resp.Status)
+}
+
 func (g *Client) SwitchOwner(item string, newkey string) (err error) {
-	b := strings.NewReader(newkey)
-	resp, err := g.h.Put("permissions/"+item+"?key="+g.key, "text/plain", b)
+	resp, err := g.request("PUT", "permissions/"+item+"?key="+g.key, newkey)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return errors.New("Status code is " + resp.Status)
+	}
+	return
+}
+
+// simple sends a request whose only interesting result is success or failure
+func (g *Client) simple(method string, url string, body string) (err error) {
+	resp, err := g.request(method, url, body)
+	if err != nil {
+		return
+	}
+	v, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return errors.New("Status code is " + resp.Status + "\n body is: " + string(v))
+	}
+	return
+}
+
+func (g *Client) NewRole(name string) (err error) {
+	return g.simple("PUT", "roles/"+name+"?key="+g.key, "")
+}
+
+func (g *Client) DeleteRole(name string) (err error) {
+	return g.simple("DELETE", "roles/"+name+"?key="+g.key, "")
+}
+
+func (g *Client) AddMember(name string, member string) (err error) {
+	return g.simple("POST", "roles/"+name+"?key="+g.key, member)
+}
+
+func (g *Client) RemoveMember(name string, member string) (err error) {
+	return g.simple("DELETE", "roles/"+name+"?key="+g.key, member)
+}
+
+func (g *Client) Members(name string) (members []string, err error) {
+	resp, err := g.request("GET", "roles/"+name+"?key="+g.key, "")
+	if err != nil {
+		return
+	}
+	c, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errors.New("Status code is " + resp.Status)
+		return
+	}
+	if len(c) > 0 {
+		members = strings.Split(string(c), "\n")
+	}
+	return
+}
+
+// Grant gives the members of a role access to item and everything below it
+func (g *Client) Grant(item string, name string, l Level) (err error) {
+	return g.simple("POST", "grants/"+item+"?key="+g.key+"&role="+
+		url.QueryEscape(name)+"&level="+l.String(), "")
+}
+
+func (g *Client) Revoke(item string, name string) (err error) {
+	return g.simple("DELETE", "grants/"+item+"?key="+g.key+"&role="+
+		url.QueryEscape(name), "")
+}
+
+// RevokeKey removes a key from every role and item, this client's key must be
+// the gatekeeper's administrator
+func (g *Client) RevokeKey(revoked string) (err error) {
+	return g.simple("POST", "revoke?key="+g.key, revoked)
+}
+
+// GetVersion fetches an older value of item
+func (g *Client) GetVersion(item string, number int) (value string, err error) {
+	resp, err := g.request("GET", "object/"+item+"?key="+g.key+
+		"&version="+strconv.Itoa(number), "")
 	if err != nil {
 		return
 	}
+	c, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errors.New("Status code is " + resp.Status)
+		return
+	}
+	value = string(c)
+	return
+}
+
+// Latest fetches item along with the number of its latest version, for
+// SetVersion
+func (g *Client) Latest(item string) (value string, current int, err error) {
+	resp, err := g.request("GET", "object/"+item+"?key="+g.key, "")
+	if err != nil {
+		return
+	}
+	c, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errors.New("Status code is " + resp.Status)
+		return
+	}
+	current, err = strconv.Atoi(resp.Header.Get("X-Gatekeeper-Version"))
+	value = string(c)
+	return
+}
+
+// SetVersion changes item only if its latest version is still number. If
+// somebody else changed it first it fails with ErrConflict
+func (g *Client) SetVersion(item string, value string, number int) (err error) {
+	resp, err := g.request("POST", "object/"+item+"?key="+g.key+
+		"&version="+strconv.Itoa(number), value)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode == 409 {
+		return ErrConflict
+	}
 	if resp.StatusCode != 200 {
 		return errors.New("Status code is " + resp.Status)
 	}
 	return
 }
+
+// Versions lists the versions of item that are still kept
+func (g *Client) Versions(item string) (versions []Version, err error) {
+	resp, err := g.request("GET", "versions/"+item+"?key="+g.key, "")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errors.New("Status code is " + resp.Status)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&versions)
+	return
+}
+
+// Rollback makes an older value of item the latest again
+func (g *Client) Rollback(item string, number int) (err error) {
+	return g.simple("POST", "versions/"+item+"?key="+g.key+
+		"&version="+strconv.Itoa(number), "")
+}
+
+// SetRetention sets how many versions of item are kept
+func (g *Client) SetRetention(item string, keep int) (err error) {
+	return g.simple("PUT", "versions/"+item+"?key="+g.key, strconv.Itoa(keep))
+}
+
+// SetTTL makes item expire after ttl, or never if ttl is 0
+func (g *Client) SetTTL(item string, ttl time.Duration) (err error) {
+	return g.simple("PUT", "ttl/"+item+"?key="+g.key+"&ttl="+ttl.String(), "")
+}
+
+// Expires tells when item expires, the zero time meaning never
+func (g *Client) Expires(item string) (expires time.Time, err error) {
+	resp, err := g.request("GET", "ttl/"+item+"?key="+g.key, "")
+	if err != nil {
+		return
+	}
+	c, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errors.New("Status code is " + resp.Status)
+		return
+	}
+	if len(c) > 0 {
+		expires, err = time.Parse(time.RFC3339, string(c))
+	}
+	return
+}
+
+// Audit fetches the audit events about item, or every item if it is "",
+// since a time. This client's key must be the gatekeeper's administrator
+func (g *Client) Audit(item string, since time.Time) (events []Event, err error) {
+	resp, err := g.request("GET", "audit?key="+g.key+"&item="+url.QueryEscape(item)+
+		"&since="+url.QueryEscape(since.Format(time.RFC3339)), "")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errors.New("Status code is " + resp.Status)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&events)
+	return
+}
+
+// watchRetry is how long Watch waits after failing to reach the gatekeeper
+var watchRetry = 5 * time.Second
+
+// Watch sends every new value of item down the channel. The channel is
+// closed when the item is deleted or this client can no longer read it. stop
+// ends the watch without the channel having to be drained, closing it once
+// the request in flight is answered
+func (g *Client) Watch(item string) (values <-chan string, stop func()) {
+	out := make(chan string)
+	done := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() { close(done) })
+	}
+
+	// wait sleeps for d, returning false if stopped meanwhile
+	wait := func(d time.Duration) bool {
+		select {
+		case <-done:
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+
+	go func() {
+		defer close(out)
+		since := -1
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			resp, err := g.request("GET", "watch/"+item+"?key="+g.key+
+				"&version="+strconv.Itoa(since), "")
+			if err != nil {
+				if !wait(watchRetry) {
+					return
+				}
+				continue
+			}
+
+			c, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == 304 {
+				continue
+			}
+			if resp.StatusCode != 200 {
+				return
+			}
+			if err != nil {
+				if !wait(watchRetry) {
+					return
+				}
+				continue
+			}
+
+			current, err := strconv.Atoi(resp.Header.Get("X-Gatekeeper-Version"))
+			if err != nil {
+				return
+			}
+
+			// The first answer is just where we start from
+			if since >= 0 {
+				select {
+				case out <- string(c):
+				case <-done:
+					return
+				}
+			}
+			since = current
+		}
+	}()
+
+	return out, stop
+}
+
+// AddDatabase lets the gatekeeper hand out users of a database, this client's
+// key must be the gatekeeper's administrator
+func (g *Client) AddDatabase(name string, d Database) (err error) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	return g.simple("PUT", "database/"+name+"?key="+g.key, string(b))
+}
+
+// Credential asks for a new user on a database, which lives until its lease
+// runs out unless it is renewed
+func (g *Client) Credential(name string) (c Credential, err error) {
+	resp, err := g.request("POST", "database/"+name+"?key="+g.key, "")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errors.New("Status code is " + resp.Status)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&c)
+	return
+}
+
+// RenewCredential extends the lease on a database user
+func (g *Client) RenewCredential(user string) (expires time.Time, err error) {
+	resp, err := g.request("PUT", "credentials/"+user+"?key="+g.key, "")
+	if err != nil {
+		return
+	}
+	c, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errors.New("Status code is " + resp.Status)
+		return
+	}
+	return time.Parse(time.RFC3339, string(c))
+}
+
+// RevokeCredential drops a database user straight away
+func (g *Client) RevokeCredential(user string) (err error) {
+	return g.simple("DELETE", "credentials/"+user+"?key="+g.key, "")
+}
+
+// RevokeCredentials drops every database user held by a key
+func (g *Client) RevokeCredentials(holder string) (err error) {
+	return g.simple("DELETE", "credentials/?key="+g.key, holder)
+}
+
+// Lookup gives the ip:port endpoints of a deployed container from the service
+// catalog the orchestrator keeps
+func (g *Client) Lookup(name string) (endpoints []string, err error) {
+	v, err := g.Get("service/" + name)
+	if err == nil && len(v) > 0 {
+		endpoints = strings.Split(v, "\n")
+	}
+	return
+}
+
+// Services lists the containers in the service catalog
+func (g *Client) Services() (names []string, err error) {
+	return g.List("service")
+}
@@ -0,0 +1,442 @@
+package libgatekeeper
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Gatekeeper hands out short lived database users instead of a shared
+// password. The administrator registers a database with an account allowed to
+// create roles. Any key that can read database/<name> may then ask for a user
+// of its own, which is dropped when its lease runs out or when its holder is
+// revoked. The configuration and the leases are kept as objects in the
+// reserved namespace, which only the administrator can create, so they
+// replicate and expire like everything else.
+
+// CredentialTTL is how long a database user lives unless it is renewed
+const CredentialTTL = time.Hour
+
+// Database is a PostgreSQL server gatekeeper creates users on
+type Database struct {
+	Address  string
+	User     string
+	Password string
+	Database string
+
+	// Role is granted to every user handed out, so they get its privileges
+	Role string `json:",omitempty"`
+
+	// TTL is how long users live, CredentialTTL if it is 0
+	TTL time.Duration `json:",omitempty"`
+}
+
+// Credential is a database user handed out to a key
+type Credential struct {
+	Name     string
+	Address  string
+	Database string
+	User     string
+	Password string
+	Expires  time.Time
+}
+
+// credentialLease records which database a user is on and which key holds it
+type credentialLease struct {
+	Name   string
+	Holder string
+}
+
+func databaseItem(name string) string {
+	return "database/" + name
+}
+
+func databaseConfigItem(name string) string {
+	return ".databases/" + name
+}
+
+func leaseItem(user string) string {
+	return ".leases/" + user
+}
+
+// adminObject fetches an object only if the administrator owns it, so nobody
+// can plant a database or a lease of their own. It must be called with the
+// lock held
+func (g *Server) adminObject(item string) (o object, found bool) {
+	o, found = g.objects[item]
+	return o, found && len(g.admin) > 0 && o.Owner == g.admin
+}
+
+// putAdmin stores an object only the administrator can use. It must be called
+// with the lock held
+func (g *Server) putAdmin(item, value string, expires time.Time) {
+	o, found := g.adminObject(item)
+	if !found {
+		o = object{Owner: g.admin, Permissions: make(map[string]Level), Keep: 1,
+			Created: g.nextSeq()}
+	}
+	o.addVersion(value)
+	o.Expires = expires
+	g.objects[item] = o
+	g.replicate(item)
+}
+
+// databaseConfig reads how to reach a database. It must be called with the
+// lock held
+func (g *Server) databaseConfig(name string) (d Database, err error) {
+	o, found := g.adminObject(databaseConfigItem(name))
+	if !found {
+		return d, errors.New("No Such Database or Permission Denied")
+	}
+	err = json.Unmarshal([]byte(o.Value), &d)
+	return
+}
+
+// lease reads who holds a database user. It must be called with the lock held
+func (g *Server) lease(user string) (l credentialLease, expires time.Time, err error) {
+	o, found := g.adminObject(leaseItem(user))
+	if !found || len(user) == 0 {
+		return l, expires, errors.New("No Such Credential or Permission Denied")
+	}
+	err = json.Unmarshal([]byte(o.Value), &l)
+	return l, o.Expires, err
+}
+
+// exec runs statements on the database as the configured account
+func (d Database) exec(query string) (err error) {
+	p, err := dialPostgres(d.Address, d.User, d.Password, d.Database)
+	if err != nil {
+		return
+	}
+	defer p.close()
+	return p.exec(query)
+}
+
+func (d Database) ttl() time.Duration {
+	if d.TTL > 0 {
+		return d.TTL
+	}
+	return CredentialTTL
+}
+
+func randomHex(n int) (s string, err error) {
+	b := make([]byte, n)
+	_, err = rand.Read(b)
+	return hex.EncodeToString(b), err
+}
+
+// validUntil is a timestamp PostgreSQL understands
+func validUntil(t time.Time) string {
+	return pgLiteral(t.UTC().Format(time.RFC3339))
+}
+
+// AddDatabase lets gatekeeper hand out users of a database to keys that can
+// read database/<name>. Only the administrator may add databases
+func (g *Server) AddDatabase(name, key string, d Database) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if len(g.admin) == 0 || key != g.admin || len(name) == 0 || strings.Contains(name, "/") {
+		return errors.New("Permission Denied")
+	}
+
+	// Whoever owns a parent of database/<name> could give access to it away
+	for _, i := range ancestry(parent(databaseItem(name))) {
+		_, exists := g.objects[i]
+		_, found := g.adminObject(i)
+		if exists && !found {
+			return errors.New("Not owned by the administrator: " + i)
+		}
+		if !exists {
+			g.putAdmin(i, "", time.Time{})
+		}
+	}
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	g.putAdmin(databaseConfigItem(name), string(b), time.Time{})
+
+	// database/<name> only exists so access to it can be given out
+	_, found := g.adminObject(databaseItem(name))
+	if !found {
+		g.putAdmin(databaseItem(name), "", time.Time{})
+	}
+	return nil
+}
+
+// IssueCredential creates a new user on a database for key, which lives until
+// its lease runs out
+func (g *Server) IssueCredential(name, key string) (c Credential, err error) {
+	g.lock.Lock()
+	d, err := g.databaseConfig(name)
+	if err == nil && !g.canRead(databaseItem(name), key) {
+		err = errors.New("No Such Database or Permission Denied")
+	}
+	g.lock.Unlock()
+	if err != nil {
+		return
+	}
+
+	c = Credential{Name: name, Address: d.Address, Database: d.Database}
+	c.User, err = randomHex(8)
+	if err != nil {
+		return
+	}
+	c.User = "gatekeeper_" + c.User
+	c.Password, err = randomHex(16)
+	if err != nil {
+		return
+	}
+	c.Expires = time.Now().Add(d.ttl())
+
+	// The database expires the user itself too, in case we never get to drop it
+	query := "CREATE ROLE " + pgIdent(c.User) + " WITH LOGIN PASSWORD " +
+		pgLiteral(c.Password) + " VALID UNTIL " + validUntil(c.Expires)
+	if len(d.Role) > 0 {
+		query += " IN ROLE " + pgIdent(d.Role)
+	}
+	err = d.exec(query)
+	if err != nil {
+		return
+	}
+
+	b, err := json.Marshal(credentialLease{name, key})
+	if err != nil {
+		return
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.putAdmin(leaseItem(c.User), string(b), c.Expires)
+	return c, nil
+}
+
+// RenewCredential extends the lease on a database user. Only its holder and
+// the administrator may renew it
+func (g *Server) RenewCredential(user, key string) (expires time.Time, err error) {
+	g.lock.Lock()
+	l, current, err := g.lease(user)
+	var d Database
+	if err == nil && ((l.Holder != key && (len(g.admin) == 0 || key != g.admin)) || time.Now().After(current)) {
+		err = errors.New("No Such Credential or Permission Denied")
+	}
+	if err == nil {
+		d, err = g.databaseConfig(l.Name)
+	}
+	g.lock.Unlock()
+	if err != nil {
+		return
+	}
+
+	expires = time.Now().Add(d.ttl())
+	err = d.exec("ALTER ROLE " + pgIdent(user) + " VALID UNTIL " + validUntil(expires))
+	if err != nil {
+		return
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	o, found := g.adminObject(leaseItem(user))
+	if !found {
+		return expires, errors.New("No Such Credential or Permission Denied")
+	}
+	o.Expires = expires
+	g.objects[leaseItem(user)] = o
+	g.replicate(leaseItem(user))
+	return expires, nil
+}
+
+// RevokeCredential drops a database user before its lease runs out. Only its
+// holder and the administrator may revoke it
+func (g *Server) RevokeCredential(user, key string) (err error) {
+	g.lock.Lock()
+	l, _, err := g.lease(user)
+	if err == nil && l.Holder != key && (len(g.admin) == 0 || key != g.admin) {
+		err = errors.New("No Such Credential or Permission Denied")
+	}
+	g.lock.Unlock()
+	if err != nil {
+		return
+	}
+	return g.dropCredential(user)
+}
+
+// RevokeCredentials drops every database user held by holder, for when the
+// container holding them is removed. Only the holder itself and the
+// administrator may do this
+func (g *Server) RevokeCredentials(holder, key string) (err error) {
+	g.lock.Lock()
+	if key != holder && (len(g.admin) == 0 || key != g.admin) {
+		g.lock.Unlock()
+		return errors.New("Permission Denied")
+	}
+
+	users := []string{}
+	for item, _ := range g.objects {
+		if !strings.HasPrefix(item, leaseItem("")) {
+			continue
+		}
+		user := strings.TrimPrefix(item, leaseItem(""))
+		l, _, lerr := g.lease(user)
+		if lerr == nil && l.Holder == holder {
+			users = append(users, user)
+		}
+	}
+	g.lock.Unlock()
+
+	for _, user := range users {
+		derr := g.dropCredential(user)
+		if derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return
+}
+
+// dropCredential drops a database user and then forgets its lease. The lease
+// is kept if the database can't be reached, so the janitor tries again
+func (g *Server) dropCredential(user string) (err error) {
+	g.lock.Lock()
+	l, _, err := g.lease(user)
+	var d Database
+	if err == nil {
+		d, err = g.databaseConfig(l.Name)
+	}
+	g.lock.Unlock()
+
+	// With the database gone there is nobody left to drop the user from
+	if err == nil {
+		err = d.exec("REASSIGN OWNED BY " + pgIdent(user) + " TO " + pgIdent(d.User) +
+			"; DROP OWNED BY " + pgIdent(user) + "; DROP ROLE " + pgIdent(user))
+		e, ok := err.(*pgErr)
+		if ok && e.Code == pgUndefinedObject {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	_, found := g.objects[leaseItem(user)]
+	if found {
+		g.remove(leaseItem(user))
+		g.replicate(leaseItem(user))
+	}
+	return nil
+}
+
+// expiredCredentials lists the users whose leases have run out. It must be
+// called with the lock held
+func (g *Server) expiredCredentials() (users []string) {
+	for item, o := range g.objects {
+		if strings.HasPrefix(item, leaseItem("")) && o.expired() {
+			users = append(users, strings.TrimPrefix(item, leaseItem("")))
+		}
+	}
+	return
+}
+
+func (g *Server) database(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	name := itemPath(r.URL.Path, "/database/")
+	log.Print(name)
+	log.Print("Handling")
+
+	if !g.isLeader() {
+		g.notLeader(w)
+		return
+	}
+
+	var v []byte
+	value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1000000))
+
+	switch r.Method {
+
+	case "PUT":
+		d := Database{}
+		if err == nil {
+			err = json.Unmarshal(value, &d)
+		}
+		if err == nil {
+			err = g.AddDatabase(name, key, d)
+		}
+
+	case "POST":
+		var c Credential
+		if err == nil {
+			c, err = g.IssueCredential(name, key)
+		}
+		if err == nil {
+			v, err = json.Marshal(c)
+		}
+
+	default:
+		err = errors.New("Add a database with PUT or get a user with POST")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(v)
+}
+
+func (g *Server) credential(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	user := itemPath(r.URL.Path, "/credentials/")
+	log.Print(user)
+	log.Print("Handling")
+
+	if !g.isLeader() {
+		g.notLeader(w)
+		return
+	}
+
+	var v string
+	value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1000000))
+
+	switch r.Method {
+
+	case "PUT":
+		var expires time.Time
+		if err == nil {
+			expires, err = g.RenewCredential(user, key)
+		}
+		v = expires.Format(time.RFC3339)
+
+	case "DELETE":
+		if err == nil && len(user) == 0 {
+			err = g.RevokeCredentials(string(value), key)
+		} else if err == nil {
+			err = g.RevokeCredential(user, key)
+		}
+
+	default:
+		err = errors.New("Renew a user with PUT or revoke it with DELETE")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+	io.WriteString(w, v)
+}
@@ -0,0 +1,370 @@
+package libgatekeeper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePostgres speaks enough of the PostgreSQL protocol to log in with md5, or
+// SCRAM-SHA-256 when scram is set, and keep track of the roles created and
+// dropped
+type fakePostgres struct {
+	lock     sync.Mutex
+	l        net.Listener
+	password string
+	scram    bool
+	roles    map[string]bool
+}
+
+func newFakePostgres(t *testing.T, password string) *fakePostgres {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakePostgres{l: l, password: password, roles: make(map[string]bool)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func (f *fakePostgres) has(role string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.roles[role]
+}
+
+func (f *fakePostgres) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	send := func(t byte, m string) {
+		b := new(bytes.Buffer)
+		b.WriteByte(t)
+		binary.Write(b, binary.BigEndian, int32(len(m)+4))
+		b.WriteString(m)
+		c.Write(b.Bytes())
+	}
+	fail := func(code, message string) {
+		send('E', "SERROR\x00C"+code+"\x00M"+message+"\x00\x00")
+	}
+
+	var length int32
+	binary.Read(r, binary.BigEndian, &length)
+	startup := make([]byte, length-4)
+	io.ReadFull(r, startup)
+	user := strings.Split(string(startup[4:]), "\x00")[1]
+
+	receive := func() (byte, string) {
+		t, _ := r.ReadByte()
+		binary.Read(r, binary.BigEndian, &length)
+		m := make([]byte, length-4)
+		io.ReadFull(r, m)
+		return t, string(m)
+	}
+
+	f.lock.Lock()
+	scram := f.scram
+	f.lock.Unlock()
+
+	salt := "salt"
+	if scram {
+		send('R', "\x00\x00\x00\x0aSCRAM-SHA-256\x00\x00")
+		_, m := receive()
+		first := strings.SplitN(m, "\x00", 2)[1][4:]
+		bare := strings.TrimPrefix(first, "n,,")
+		serverFirst := "r=" + scramAttributes(bare)["r"] + "server,s=" +
+			base64.StdEncoding.EncodeToString([]byte(salt)) + ",i=4096"
+		send('R', "\x00\x00\x00\x0b"+serverFirst)
+		_, final := receive()
+		i := strings.Index(final, ",p=")
+		if i < 0 {
+			fail("28P01", "password authentication failed")
+			return
+		}
+		proof, signature := scramProof(f.password, []byte(salt), 4096,
+			bare+","+serverFirst+","+final[:i])
+		if final[i+3:] != base64.StdEncoding.EncodeToString(proof) {
+			fail("28P01", "password authentication failed")
+			return
+		}
+		send('R', "\x00\x00\x00\x0cv="+base64.StdEncoding.EncodeToString(signature))
+	} else {
+		send('R', "\x00\x00\x00\x05"+salt)
+		t, password := receive()
+		if t != 'p' || password != pgMD5(user, f.password, []byte(salt))+"\x00" {
+			fail("28P01", "password authentication failed")
+			return
+		}
+	}
+	send('R', "\x00\x00\x00\x00")
+	send('Z', "I")
+
+	for {
+		t, err := r.ReadByte()
+		if err != nil || t == 'X' {
+			return
+		}
+		binary.Read(r, binary.BigEndian, &length)
+		query := make([]byte, length-4)
+		io.ReadFull(r, query)
+
+		// The role is the first quoted identifier
+		fields := strings.Split(string(query), `"`)
+		role := ""
+		if len(fields) > 1 {
+			role = fields[1]
+		}
+
+		f.lock.Lock()
+		switch {
+		case strings.HasPrefix(string(query), "CREATE ROLE"):
+			f.roles[role] = true
+			send('C', "CREATE ROLE\x00")
+		case strings.Contains(string(query), "DROP ROLE") && !f.roles[role]:
+			fail(pgUndefinedObject, "role does not exist")
+		case strings.Contains(string(query), "DROP ROLE"):
+			delete(f.roles, role)
+			send('C', "DROP ROLE\x00")
+		default:
+			send('C', "ALTER ROLE\x00")
+		}
+		f.lock.Unlock()
+		send('Z', "I")
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	f := newFakePostgres(t, "secret")
+	defer f.l.Close()
+
+	g := NewServer()
+	g.SetAdmin("admin")
+	d := Database{Address: f.l.Addr().String(), User: "postgres", Password: "secret"}
+
+	err := g.AddDatabase("db", "app", d)
+	if err == nil {
+		t.Error(errors.New("Only the administrator should add databases"))
+	}
+	err = g.AddDatabase("db", "admin", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.AddAccess("database/db", "admin", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the administrator may use the configuration
+	for _, item := range []string{".databases", ".databases/other", ".mine"} {
+		err = g.New(item, "{}", "app")
+		if err == nil {
+			t.Error(errors.New("A key created the reserved item " + item))
+		}
+	}
+	_, err = g.Get(databaseConfigItem("db"), "app")
+	if err == nil {
+		t.Error(errors.New("A key read the database configuration"))
+	}
+
+	_, err = g.IssueCredential("db", "other")
+	if err == nil {
+		t.Error(errors.New("A key without access got a database user"))
+	}
+
+	c, err := g.IssueCredential("db", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.has(c.User) || len(c.Password) == 0 || c.Address != d.Address {
+		t.Error(errors.New("Database user not created"))
+	}
+	if c.Expires.Before(time.Now().Add(CredentialTTL - time.Minute)) {
+		t.Error(errors.New("Lease is too short: " + c.Expires.String()))
+	}
+
+	// Nobody can read the superuser password or the lease
+	_, err = g.Get(databaseConfigItem("db"), "app")
+	if err == nil {
+		t.Error(errors.New("Database configuration is readable"))
+	}
+	_, err = g.Get(leaseItem(c.User), "app")
+	if err == nil {
+		t.Error(errors.New("Lease is readable"))
+	}
+
+	_, err = g.RenewCredential(c.User, "other")
+	if err == nil {
+		t.Error(errors.New("Somebody else renewed the lease"))
+	}
+	_, err = g.RenewCredential(c.User, "app")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Removing the holder drops its users
+	err = g.RevokeCredentials("app", "other")
+	if err == nil {
+		t.Error(errors.New("Somebody else revoked the users"))
+	}
+	err = g.RevokeCredentials("app", "admin")
+	if err != nil {
+		t.Error(err)
+	}
+	if f.has(c.User) {
+		t.Error(errors.New("Database user not dropped"))
+	}
+	err = g.RevokeCredential(c.User, "app")
+	if err == nil {
+		t.Error(errors.New("Revoked a user twice"))
+	}
+
+	// Users are dropped when their lease runs out
+	d.TTL = 10 * time.Millisecond
+	err = g.AddDatabase("db", "admin", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = g.IssueCredential("db", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	g.expire()
+	if f.has(c.User) {
+		t.Error(errors.New("Expired database user not dropped"))
+	}
+	_, err = g.RenewCredential(c.User, "app")
+	if err == nil {
+		t.Error(errors.New("Renewed an expired user"))
+	}
+
+	d.Password = "wrong"
+	err = g.AddDatabase("db", "admin", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.IssueCredential("db", "app")
+	if err == nil {
+		t.Error(errors.New("Logged in with the wrong password"))
+	}
+}
+
+// TestSCRAMProof checks the client proof against the example in RFC 7677
+func TestSCRAMProof(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	auth := "n=user,r=rOprNGfwEbeRWgbNEkqO," +
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096," +
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	proof, signature := scramProof("pencil", salt, 4096, auth)
+	if base64.StdEncoding.EncodeToString(proof) != "dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=" {
+		t.Error(errors.New("Wrong SCRAM client proof"))
+	}
+	if base64.StdEncoding.EncodeToString(signature) != "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=" {
+		t.Error(errors.New("Wrong SCRAM server signature"))
+	}
+}
+
+func TestSCRAMLogin(t *testing.T) {
+	f := newFakePostgres(t, "secret")
+	defer f.l.Close()
+	f.lock.Lock()
+	f.scram = true
+	f.lock.Unlock()
+
+	p, err := dialPostgres(f.l.Addr().String(), "postgres", "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.close()
+
+	_, err = dialPostgres(f.l.Addr().String(), "postgres", "wrong", "")
+	if err == nil {
+		t.Error(errors.New("Logged in with the wrong password"))
+	}
+}
+
+func TestDatabaseAncestry(t *testing.T) {
+	g := NewServer()
+	g.SetAdmin("admin")
+
+	// Left over from before database was reserved for the administrator
+	g.objects["database"] = object{Owner: "squatter",
+		Permissions: map[string]Level{"squatter": Admin}, Created: g.nextSeq()}
+
+	err := g.AddDatabase("db", "admin", Database{Address: "localhost:5432"})
+	if err == nil {
+		t.Error(errors.New("Added a database below someone else's item"))
+	}
+	_, found := g.objects["database/db"]
+	if found {
+		t.Error(errors.New("Created database/db below someone else's item"))
+	}
+
+	delete(g.objects, "database")
+	err = g.AddDatabase("db", "admin", Database{Address: "localhost:5432"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, found = g.adminObject("database")
+	if !found {
+		t.Error(errors.New("database not created for the administrator"))
+	}
+}
+
+func TestCredentialsClient(t *testing.T) {
+	f := newFakePostgres(t, "secret")
+	defer f.l.Close()
+
+	g := NewServer()
+	g.SetAdmin("admin")
+	go g.Listen("localhost:1344")
+	defer g.Close()
+	waitListening(t, "localhost:1344")
+
+	admin := NewClient("localhost:1344", "admin")
+	err := admin.AddDatabase("db", Database{Address: f.l.Addr().String(), User: "postgres", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = admin.AddAccess("database/db", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := NewClient("localhost:1344", "app")
+	c, err := app.Credential("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.has(c.User) {
+		t.Error(errors.New("Database user not created"))
+	}
+
+	_, err = app.RenewCredential(c.User)
+	if err != nil {
+		t.Error(err)
+	}
+	err = app.RevokeCredential(c.User)
+	if err != nil {
+		t.Error(err)
+	}
+	if f.has(c.User) {
+		t.Error(errors.New("Database user not dropped"))
+	}
+}
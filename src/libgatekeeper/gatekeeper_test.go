@@ -10,6 +10,7 @@ func TestGateKeeper(t *testing.T) {
 		err := g.Listen(":1337")
 		t.Fatal(err)
 	}()
+	waitListening(t, "localhost:1337")
 
 	c := NewClient("localhost:1337", "key")
 	err := c.New("key.onetime", "onetimekey")
@@ -25,6 +26,18 @@ func TestGateKeeper(t *testing.T) {
 		t.Fatal("key is: " + v)
 	}
 
+	err = c.New("apps/web/token", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, err := c.List("apps")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(children) != 1 || children[0] != "web" {
+		t.Fatal("children are: ", children)
+	}
+
 	err = c.SwitchOwner("key.onetime", "")
 	if err != nil {
 		t.Fatal(err.Error())
@@ -34,4 +47,9 @@ func TestGateKeeper(t *testing.T) {
 	if err != nil {
 		t.Fatal(err.Error())
 	}
+
+	_, err = NewOneTimeClient("localhost:1337", "onetime")
+	if err == nil {
+		t.Fatal("one time key was used twice")
+	}
 }
@@ -0,0 +1,59 @@
+package libgatekeeper
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	g := NewServer()
+	g.SetAdmin("orchestrator")
+	go g.Listen("localhost:1345")
+	defer g.Close()
+	waitListening(t, "localhost:1345")
+
+	// The orchestrator publishes the catalog and lets the containers read it
+	orchestrator := NewClient("localhost:1345", "orchestrator")
+	err := orchestrator.New("service", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = orchestrator.New("service/web", "10.0.0.1:49153\n10.0.0.2:49160")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = orchestrator.NewRole("containers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = orchestrator.AddMember("containers", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = orchestrator.Grant("service", "containers", Read)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := NewClient("localhost:1345", "app")
+	endpoints, err := app.Lookup("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(endpoints, ",") != "10.0.0.1:49153,10.0.0.2:49160" {
+		t.Error("endpoints are: " + strings.Join(endpoints, ","))
+	}
+
+	names, err := app.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "web" {
+		t.Error("services are: " + strings.Join(names, ","))
+	}
+
+	_, err = NewClient("localhost:1345", "other").Lookup("web")
+	if err == nil {
+		t.Error("a key outside the containers role looked up a service")
+	}
+}
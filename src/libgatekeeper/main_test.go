@@ -2,6 +2,7 @@ package libgatekeeper
 
 import (
 	"errors"
+	"strings"
 	"testing"
 )
 
@@ -55,3 +56,178 @@ func TestPermission(t *testing.T) {
 		t.Error(errors.New("No permission denied thrown"))
 	}
 }
+
+func TestNamespaces(t *testing.T) {
+	g := NewServer()
+
+	err := g.New("apps/web", "", "owner")
+	if err != nil {
+		t.Error(err)
+	}
+	err = g.New("apps/web/db_password", "hunter2", "owner")
+	if err != nil {
+		t.Error(err)
+	}
+	err = g.New("apps/web/api/token", "abc", "owner")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Nobody else may create items in the owner's namespace
+	err = g.New("apps/web/planted", "value", "other")
+	if err == nil {
+		t.Error(errors.New("Created item under someone else's namespace"))
+	}
+
+	// Access to the parent is inherited
+	err = g.AddAccess("apps/web", "owner", "reader")
+	if err != nil {
+		t.Error(err)
+	}
+	v, err := g.Get("apps/web/api/token", "reader")
+	if err != nil {
+		t.Error(err)
+	}
+	if v != "abc" {
+		t.Error(errors.New("inherited value is not abc"))
+	}
+
+	children, err := g.List("apps/web", "reader")
+	if err != nil {
+		t.Error(err)
+	}
+	if strings.Join(children, ",") != "api,db_password" {
+		t.Error(errors.New("children are " + strings.Join(children, ",")))
+	}
+
+	_, err = g.List("apps/web", "stranger")
+	if err == nil {
+		t.Error(errors.New("Stranger could list apps/web"))
+	}
+}
+
+func TestPermissionLevels(t *testing.T) {
+	g := NewServer()
+
+	err := g.New("token", "value", "owner")
+	if err != nil {
+		t.Error(err)
+	}
+	err = g.SetAccess("token", "owner", "writer", Write)
+	if err != nil {
+		t.Error(err)
+	}
+	err = g.AddAccess("token", "owner", "reader")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = g.Set("token", "rotated", "reader")
+	if err == nil {
+		t.Error(errors.New("Reader changed the value"))
+	}
+	err = g.Set("token", "rotated", "writer")
+	if err != nil {
+		t.Error(err)
+	}
+	err = g.AddAccess("token", "writer", "friend")
+	if err == nil {
+		t.Error(errors.New("Writer granted access"))
+	}
+	err = g.Delete("token", "writer")
+	if err == nil {
+		t.Error(errors.New("Writer deleted the item"))
+	}
+
+	p, err := g.Inspect("token", "writer")
+	if err != nil {
+		t.Error(err)
+	}
+	if p.Access != Write || p.Keys != nil {
+		t.Error(errors.New("Writer sees " + p.Access.String()))
+	}
+	p, err = g.Inspect("token", "owner")
+	if err != nil {
+		t.Error(err)
+	}
+	if p.Owner != "owner" || p.Keys["writer"] != Write || p.Keys["reader"] != Read {
+		t.Error(errors.New("Owner sees the wrong permissions"))
+	}
+}
+
+func TestParentTakeover(t *testing.T) {
+	g := NewServer()
+
+	err := g.New("apps/web/db_password", "hunter2", "victim")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Nobody may create a parent over somebody else's items
+	err = g.New("apps", "", "attacker")
+	if err == nil {
+		t.Error(errors.New("Created a parent over someone else's item"))
+	}
+	_, err = g.Get("apps/web/db_password", "attacker")
+	if err == nil {
+		t.Error(errors.New("Attacker read the victim's secret"))
+	}
+
+	// A parent created afterwards by the owner passes nothing down
+	err = g.New("apps", "", "victim")
+	if err != nil {
+		t.Error(err)
+	}
+	err = g.AddAccess("apps", "victim", "reader")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = g.Get("apps/web/db_password", "reader")
+	if err == nil {
+		t.Error(errors.New("Parent created later passed its access down"))
+	}
+
+	// Items created below it afterwards inherit as usual
+	err = g.New("apps/api", "abc", "victim")
+	if err != nil {
+		t.Error(err)
+	}
+	v, err := g.Get("apps/api", "reader")
+	if err != nil || v != "abc" {
+		t.Error(errors.New("Item created later did not inherit"))
+	}
+}
+
+func TestSystemItems(t *testing.T) {
+	g := NewServer()
+	g.SetAdmin("admin")
+
+	// Nobody but the administrator may claim the system items
+	for _, item := range []string{"database", "service/web", "ingress",
+		"orchestrator.lease"} {
+		err := g.New(item, "", "squatter")
+		if err == nil {
+			t.Error(errors.New("Created system item " + item))
+		}
+	}
+
+	// Nor does owning a parent give anything over items others create below
+	err := g.New("apps", "", "squatter")
+	if err != nil {
+		t.Error(err)
+	}
+	err = g.AddAccess("apps", "squatter", "friend")
+	if err != nil {
+		t.Error(err)
+	}
+	err = g.New("apps/db_password", "hunter2", "admin")
+	if err != nil {
+		t.Error(err)
+	}
+	for _, key := range []string{"squatter", "friend"} {
+		_, err = g.Get("apps/db_password", key)
+		if err == nil {
+			t.Error(errors.New(key + " read an item created below its parent"))
+		}
+	}
+}
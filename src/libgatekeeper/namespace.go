@@ -0,0 +1,115 @@
+package libgatekeeper
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Items are paths like apps/web/db_password. Access granted on an item is
+// inherited by everything below it, so granting apps/web lets a key read every
+// secret of the web app. The owner of an item also owns everything below it
+// that it was there before and that has the same owner. See access.go for how
+// access is worked out.
+
+// reservedPrefix starts the items only the administrator may create or use,
+// such as the database configuration in credentials.go
+const reservedPrefix = "."
+
+// systemItems are the top level items the deployment keeps its own things
+// below: database users, the service catalog, the ingress routes and the
+// orchestrator's items. Only the administrator may create them or anything
+// below them while they are missing, so no key can claim them first
+var systemItems = []string{"database", "service", "ingress", "orchestrator."}
+
+// systemItem tells whether item is a system item or below one
+func systemItem(item string) bool {
+	top := strings.SplitN(item, "/", 2)[0]
+	for _, s := range systemItems {
+		if top == s || (strings.HasSuffix(s, ".") && strings.HasPrefix(top, s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// itemPath turns a request path into an item name
+func itemPath(path string, prefix string) string {
+	return strings.Trim(strings.TrimPrefix(path, prefix), "/")
+}
+
+// parent gives the item one level up, or "" at the top
+func parent(item string) string {
+	i := strings.LastIndex(item, "/")
+	if i < 0 {
+		return ""
+	}
+	return item[:i]
+}
+
+// ancestry lists item and every prefix above it, nearest first
+func ancestry(item string) (items []string) {
+	for ; len(item) > 0; item = parent(item) {
+		items = append(items, item)
+	}
+	return
+}
+
+// mayCreate checks key may write below the nearest existing parent of item,
+// so keys can't plant items in each other's namespaces. Nor may a key create
+// a parent over items somebody else owns, anything in the reserved namespace,
+// or a system item. It must be called with the lock held
+func (g *Server) mayCreate(item, key string) bool {
+	if len(g.admin) > 0 && key == g.admin {
+		return true
+	}
+	if strings.HasPrefix(item, reservedPrefix) {
+		return false
+	}
+
+	below := item + "/"
+	for i, o := range g.objects {
+		if strings.HasPrefix(i, below) && o.Owner != key {
+			return false
+		}
+	}
+
+	for _, i := range ancestry(parent(item)) {
+		_, found := g.objects[i]
+		if found {
+			return g.canWrite(i, key)
+		}
+	}
+	return !systemItem(item)
+}
+
+// List gives the names directly below prefix which key can read, or which have
+// something key can read further down. Keys are never listed
+func (g *Server) List(prefix, key string) (children []string, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	start := ""
+	if len(prefix) > 0 {
+		start = prefix + "/"
+	}
+
+	seen := make(map[string]bool)
+	for item, _ := range g.objects {
+		if !strings.HasPrefix(item, start) || strings.HasPrefix(item, keyPrefix) ||
+			!g.canRead(item, key) {
+			continue
+		}
+		child := strings.SplitN(strings.TrimPrefix(item, start), "/", 2)[0]
+		if !seen[child] {
+			seen[child] = true
+			children = append(children, child)
+		}
+	}
+
+	if len(children) == 0 && !g.canRead(prefix, key) {
+		return nil, errors.New("No Such Item or Permission Denied")
+	}
+	sort.Strings(children)
+	return children, nil
+}
@@ -0,0 +1,331 @@
+package libgatekeeper
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pgConn is just enough of the PostgreSQL frontend/backend protocol (version
+// 3) to log in and run statements that return no rows
+type pgConn struct {
+	c     net.Conn
+	r     *bufio.Reader
+	scram *scramClient
+}
+
+// dialPostgres logs in to a PostgreSQL server with cleartext, md5 or
+// SCRAM-SHA-256 password authentication, the last being the default since
+// PostgreSQL 14. Passwords aren't normalized with SASLprep, which makes no
+// difference to the ASCII ones the orchestrator makes up
+func dialPostgres(address, user, password, database string) (p *pgConn, err error) {
+	c, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return
+	}
+	p = &pgConn{c: c, r: bufio.NewReader(c)}
+
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.BigEndian, int32(196608))
+	b.WriteString("user\x00" + user + "\x00")
+	if len(database) > 0 {
+		b.WriteString("database\x00" + database + "\x00")
+	}
+	b.WriteByte(0)
+	err = p.send(0, b.Bytes())
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	for {
+		t, m, err := p.receive()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		switch t {
+		case 'R':
+			err = p.authenticate(m, user, password)
+		case 'E':
+			err = pgError(m)
+		case 'Z':
+			return p, nil
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+}
+
+func (p *pgConn) authenticate(m []byte, user, password string) error {
+	if len(m) < 4 {
+		return errors.New("Short authentication message")
+	}
+
+	switch binary.BigEndian.Uint32(m) {
+	case 0:
+		return nil
+	case 3:
+		return p.send('p', []byte(password+"\x00"))
+	case 5:
+		if len(m) < 8 {
+			return errors.New("Short md5 salt")
+		}
+		return p.send('p', []byte(pgMD5(user, password, m[4:8])+"\x00"))
+	case 10:
+		if !bytes.Contains(m[4:], []byte("SCRAM-SHA-256\x00")) {
+			break
+		}
+		c, err := newScramClient(password)
+		if err != nil {
+			return err
+		}
+		p.scram = c
+		b := new(bytes.Buffer)
+		b.WriteString("SCRAM-SHA-256\x00")
+		binary.Write(b, binary.BigEndian, int32(len(c.first())))
+		b.WriteString(c.first())
+		return p.send('p', b.Bytes())
+	case 11:
+		if p.scram == nil {
+			break
+		}
+		final, err := p.scram.final(string(m[4:]))
+		if err != nil {
+			return err
+		}
+		return p.send('p', []byte(final))
+	case 12:
+		if p.scram == nil {
+			break
+		}
+		return p.scram.verify(string(m[4:]))
+	}
+	return errors.New("Unsupported PostgreSQL authentication method")
+}
+
+// scramClient is the client side of a SCRAM-SHA-256 exchange (RFC 5802 and
+// 7677) without channel binding
+type scramClient struct {
+	password  string
+	nonce     string
+	signature []byte
+}
+
+func newScramClient(password string) (c *scramClient, err error) {
+	b := make([]byte, 18)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+	return &scramClient{password: password,
+		nonce: base64.StdEncoding.EncodeToString(b)}, nil
+}
+
+// first is the client-first-message. PostgreSQL takes the user from the
+// startup message, so none is named here
+func (c *scramClient) first() string {
+	return "n,," + c.firstBare()
+}
+
+func (c *scramClient) firstBare() string {
+	return "n=,r=" + c.nonce
+}
+
+// final answers the server-first-message with the client proof, and keeps
+// the signature the server must answer with
+func (c *scramClient) final(serverFirst string) (final string, err error) {
+	attrs := scramAttributes(serverFirst)
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 {
+		return "", errors.New("Bad SCRAM iteration count")
+	}
+	if !strings.HasPrefix(attrs["r"], c.nonce) || len(attrs["r"]) == len(c.nonce) {
+		return "", errors.New("Bad SCRAM nonce")
+	}
+
+	final = "c=biws,r=" + attrs["r"]
+	auth := c.firstBare() + "," + serverFirst + "," + final
+	proof, signature := scramProof(c.password, salt, iterations, auth)
+	c.signature = signature
+	return final + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verify checks the server-final-message proves the server knows the password
+func (c *scramClient) verify(serverFinal string) error {
+	v, err := base64.StdEncoding.DecodeString(scramAttributes(serverFinal)["v"])
+	if err != nil || c.signature == nil || !hmac.Equal(v, c.signature) {
+		return errors.New("PostgreSQL server signature mismatch")
+	}
+	return nil
+}
+
+// scramAttributes splits a SCRAM message into its a=value attributes
+func scramAttributes(m string) map[string]string {
+	attrs := make(map[string]string)
+	for _, a := range strings.Split(m, ",") {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) == 2 {
+			attrs[kv[0]] = kv[1]
+		}
+	}
+	return attrs
+}
+
+// scramProof works out the client proof for auth, and the signature the
+// server proves itself with
+func scramProof(password string, salt []byte, iterations int, auth string) (proof, signature []byte) {
+	// Hi() is PBKDF2 with HMAC-SHA-256 and a single block
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	salted := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(nil)
+		for j := range salted {
+			salted[j] ^= u[j]
+		}
+	}
+
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof = scramHMAC(storedKey[:], auth)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	signature = scramHMAC(scramHMAC(salted, "Server Key"), auth)
+	return
+}
+
+func scramHMAC(key []byte, m string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(m))
+	return mac.Sum(nil)
+}
+
+// pgMD5 is the md5 password response: md5(md5(password user) salt)
+func pgMD5(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// exec runs statements through the simple query protocol
+func (p *pgConn) exec(query string) (err error) {
+	err = p.send('Q', []byte(query+"\x00"))
+	if err != nil {
+		return
+	}
+
+	for {
+		t, m, rerr := p.receive()
+		if rerr != nil {
+			return rerr
+		}
+		if t == 'E' && err == nil {
+			err = pgError(m)
+		}
+		if t == 'Z' {
+			return
+		}
+	}
+}
+
+func (p *pgConn) close() {
+	p.send('X', nil)
+	p.c.Close()
+}
+
+// send writes a message, type 0 being the untyped startup message
+func (p *pgConn) send(t byte, m []byte) error {
+	b := new(bytes.Buffer)
+	if t != 0 {
+		b.WriteByte(t)
+	}
+	binary.Write(b, binary.BigEndian, int32(len(m)+4))
+	b.Write(m)
+	_, err := p.c.Write(b.Bytes())
+	return err
+}
+
+func (p *pgConn) receive() (t byte, m []byte, err error) {
+	p.c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	t, err = p.r.ReadByte()
+	if err != nil {
+		return
+	}
+	var length int32
+	err = binary.Read(p.r, binary.BigEndian, &length)
+	if err != nil {
+		return
+	}
+	if length < 4 {
+		err = errors.New("Bad PostgreSQL message length")
+		return
+	}
+	m = make([]byte, length-4)
+	_, err = io.ReadFull(p.r, m)
+	return
+}
+
+// pgErr is an ErrorResponse from the server. Code is the SQLSTATE
+type pgErr struct {
+	Code    string
+	Message string
+}
+
+func (e *pgErr) Error() string {
+	return "PostgreSQL: " + e.Message
+}
+
+// pgUndefinedObject is the SQLSTATE for dropping a role that doesn't exist
+const pgUndefinedObject = "42704"
+
+// pgError pulls the code and message out of an ErrorResponse
+func pgError(m []byte) error {
+	e := &pgErr{Message: "error"}
+	for _, field := range bytes.Split(m, []byte{0}) {
+		if len(field) < 2 {
+			continue
+		}
+		switch field[0] {
+		case 'C':
+			e.Code = string(field[1:])
+		case 'M':
+			e.Message = string(field[1:])
+		}
+	}
+	return e
+}
+
+// pgIdent quotes an identifier
+func pgIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// pgLiteral quotes a string constant
+func pgLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
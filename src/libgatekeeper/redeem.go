@@ -0,0 +1,66 @@
+package libgatekeeper
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// keyPrefix starts the names of the items holding keys. They are never listed
+const keyPrefix = "key."
+
+// oneTime checks an item is an unredeemed one time key. Its owner gave it
+// away, so its name is the only thing needed to redeem it
+func oneTime(item string, o object) bool {
+	return strings.HasPrefix(item, keyPrefix) && len(o.Owner) == 0
+}
+
+// Redeem fetches item and deletes it in one step, so only one caller ever
+// gets the value. It is how one time keys are used up
+func (g *Server) Redeem(item, key string) (value string, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	err = errors.New("No Such Item or Permission Denied")
+
+	o, found := g.objects[item]
+	if !found || o.expired() || !(g.owns(item, key) || oneTime(item, o)) {
+		return
+	}
+
+	g.remove(item)
+	g.replicate(item)
+	return o.Value, nil
+}
+
+func (g *Server) redeem(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	item := itemPath(r.URL.Path, "/redeem/")
+	log.Print(item)
+	log.Print("Handling")
+
+	if !g.isLeader() {
+		g.notLeader(w)
+		return
+	}
+
+	var err error
+	var v string
+
+	if r.Method == "POST" {
+		v, err = g.Redeem(item, key)
+	} else {
+		err = errors.New("Redeem with POST")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+	io.WriteString(w, v)
+}
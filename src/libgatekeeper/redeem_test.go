@@ -0,0 +1,90 @@
+package libgatekeeper
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestRedeemOnce(t *testing.T) {
+	g := NewServer()
+
+	err := g.New("key.onetime", "containerkey", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.SwitchOwner("key.onetime", "key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan string, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := g.Redeem("key.onetime", "")
+			if err == nil {
+				results <- v
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	redeemed := 0
+	for v := range results {
+		redeemed++
+		if v != "containerkey" {
+			t.Error("redeemed value is: " + v)
+		}
+	}
+	if redeemed != 1 {
+		t.Fatalf("key was redeemed %d times", redeemed)
+	}
+
+	_, err = g.Redeem("key.onetime", "")
+	if err == nil {
+		t.Error("key was redeemed after being used up")
+	}
+}
+
+func TestOneTimeKeysHidden(t *testing.T) {
+	g := NewServer()
+
+	err := g.New("key.onetime", "containerkey", "orchestrator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.SwitchOwner("key.onetime", "orchestrator", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.New("public", "value", "orchestrator")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody finds the one time key without being told its name
+	for _, key := range []string{"", "orchestrator"} {
+		children, _ := g.List("", key)
+		for _, child := range children {
+			if child == "key.onetime" {
+				t.Fatal("one time key listed for " + key)
+			}
+		}
+	}
+	_, err = g.Get("key.onetime", "")
+	if err == nil {
+		t.Fatal("empty key read the one time key")
+	}
+	_, err = g.Inspect("public", "")
+	if err == nil {
+		t.Fatal("empty key inspected an item")
+	}
+
+	v, err := g.Redeem("key.onetime", "")
+	if err != nil || v != "containerkey" {
+		t.Fatal("one time key could not be redeemed")
+	}
+}
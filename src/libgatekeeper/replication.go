@@ -0,0 +1,640 @@
+package libgatekeeper
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Replication is primary/backup log shipping. Every replica knows the list of
+// peers in order of succession. The leader applies each write and queues the
+// changed object to be shipped to every follower, and sends heartbeats
+// carrying its sequence number in between. Writes are answered before any
+// follower has them, so a write answered just before the leader dies can be
+// lost. A follower that falls behind is sent a full snapshot. A
+// follower that misses heartbeats for electionTimeout elects the first live
+// peer in the list, which takes over from whichever replica has seen the most.
+// Elections need a majority of the replicas alive, and a leader that hasn't
+// heard from a majority for electionTimeout stops taking writes.
+// Replicas prove themselves to each other with a peer key that containers are
+// never given, as a snapshot holds every secret and every key.
+
+var heartbeatInterval = 500 * time.Millisecond
+var electionTimeout = 2 * time.Second
+
+// replicationClient gives up quickly so a dead peer can't stall the leader
+var replicationClient = &http.Client{Timeout: time.Second}
+
+// peerKeyHeader carries the peer key on every request between replicas
+const peerKeyHeader = "X-Gatekeeper-Peer-Key"
+
+// entry is a single replicated change to an item or a role. An entry with
+// neither is just a heartbeat, and an entry without an object or role data is
+// a delete
+type entry struct {
+	Seq      int
+	Leader   string
+	Peers    []string
+	Item     string
+	Object   *object
+	Role     string
+	RoleData *role
+}
+
+// snapshot is the complete state of a replica
+type snapshot struct {
+	Seq        int
+	Leader     string
+	Peers      []string
+	Objects    map[string]object
+	Roles      map[string]role
+	Tombstones map[string]tombstone
+}
+
+// SetPeerKey sets the key replicas present to each other. Without one the
+// server refuses to replicate
+func (g *Server) SetPeerKey(key string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.peerKey = key
+}
+
+// peerRequest sends a request to another replica, presenting the peer key
+func peerRequest(key, method, url string, body []byte) (resp *http.Response, err error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set(peerKeyHeader, key)
+	return replicationClient.Do(req)
+}
+
+// fromPeer checks a request comes from another replica of our set. It must be
+// called with the lock held
+func (g *Server) fromPeer(r *http.Request) bool {
+	presented := []byte(r.Header.Get(peerKeyHeader))
+	return g.peers != nil && len(g.peerKey) > 0 &&
+		subtle.ConstantTimeCompare(presented, []byte(g.peerKey)) == 1
+}
+
+// Join makes the server part of a replica set. self is the address the other
+// replicas reach this server on. The first of addresses to accept the join
+// becomes our leader, and if none do we start a new replica set
+func (g *Server) Join(self string, addresses []string) (err error) {
+	g.lock.Lock()
+	if g.peers != nil {
+		g.lock.Unlock()
+		return errors.New("Already replicating")
+	}
+	if len(g.peerKey) == 0 {
+		g.lock.Unlock()
+		return errors.New("No peer key to replicate with")
+	}
+	g.self = self
+	key := g.peerKey
+	g.lock.Unlock()
+
+	for _, address := range addresses {
+		if address == self {
+			continue
+		}
+
+		s, err := joinAt(address, self, key)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		g.lock.Lock()
+		g.restore(s)
+		g.lock.Unlock()
+		log.Print("Joined replica set led by ", s.Leader)
+		go g.monitor()
+		go g.shipper()
+		return nil
+	}
+
+	g.lock.Lock()
+	g.peers = []string{self}
+	g.lead()
+	g.lock.Unlock()
+	log.Print("Leading new replica set")
+	go g.monitor()
+	go g.shipper()
+	return nil
+}
+
+// joinAt asks the replica at address to add self, following it to the leader
+func joinAt(address, self, key string) (s snapshot, err error) {
+	for tries := 0; tries < 2; tries++ {
+		var resp *http.Response
+		resp, err = peerRequest(key, "POST", "http://"+address+"/join", []byte(self))
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == 200 {
+			err = json.NewDecoder(resp.Body).Decode(&s)
+			return
+		}
+
+		leader := resp.Header.Get("X-Gatekeeper-Leader")
+		if resp.StatusCode != 503 || len(leader) == 0 || leader == self {
+			break
+		}
+		address = leader
+	}
+	err = errors.New("Could not join replica set at " + address)
+	return
+}
+
+// isLeader is true for the leader of a replica set and for a lone server
+func (g *Server) isLeader() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.peers == nil || g.leader == g.self
+}
+
+// notLeader turns away a write, pointing the client at the leader
+func (g *Server) notLeader(w http.ResponseWriter) {
+	g.lock.Lock()
+	leader := g.leader
+	g.lock.Unlock()
+
+	w.Header().Set("X-Gatekeeper-Leader", leader)
+	w.WriteHeader(503)
+	io.WriteString(w, "Not Leader")
+}
+
+// nextSeq is the sequence number the next change will be given. It must be
+// called with the lock held
+func (g *Server) nextSeq() int {
+	return g.seq + 1
+}
+
+// replicate numbers the change to item and queues its current state for the
+// followers. It must be called with the lock held, right after the change
+func (g *Server) replicate(item string) {
+	g.notify()
+	g.seq++
+	if g.peers == nil {
+		return
+	}
+
+	e := entry{Seq: g.seq, Leader: g.self, Peers: g.peers, Item: item}
+	o, found := g.objects[item]
+	if found {
+		e.Object = &o
+	}
+	g.enqueue(e)
+}
+
+// replicateRole queues the current state of a role for the followers. It must
+// be called with the lock held, right after the change
+func (g *Server) replicateRole(name string) {
+	g.notify()
+	g.seq++
+	if g.peers == nil {
+		return
+	}
+
+	e := entry{Seq: g.seq, Leader: g.self, Peers: g.peers, Role: name}
+	r, found := g.roles[name]
+	if found {
+		e.RoleData = &r
+	}
+	g.enqueue(e)
+}
+
+// enqueue hands an entry to the shipper. Nothing is sent with the lock held,
+// so a dead follower never holds up a write. It must be called with the lock
+// held
+func (g *Server) enqueue(e entry) {
+	g.queue = append(g.queue, e)
+	select {
+	case g.wake <- struct{}{}:
+	default:
+	}
+}
+
+// shipper sends the queued entries to the followers while we lead, and a
+// heartbeat when there is nothing to send
+func (g *Server) shipper() {
+	t := time.NewTicker(heartbeatInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-g.wake:
+		case <-t.C:
+		}
+
+		g.lock.Lock()
+		if g.leader != g.self {
+			g.queue = nil
+			g.lock.Unlock()
+			continue
+		}
+		entries := g.queue
+		g.queue = nil
+		if len(entries) == 0 {
+			entries = []entry{{Seq: g.seq, Leader: g.self, Peers: g.peers}}
+		}
+		peers := g.peers
+		key := g.peerKey
+		g.lock.Unlock()
+
+		g.ship(peers, key, entries)
+	}
+}
+
+// ship sends entries to every follower at once, and a snapshot to any that
+// has fallen behind. It returns once every follower has answered or timed out,
+// so each one sees the entries in order
+func (g *Server) ship(peers []string, key string, entries []entry) {
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		if peer == g.self {
+			continue
+		}
+
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			for _, e := range entries {
+				b, err := json.Marshal(e)
+				if err != nil {
+					log.Print(err)
+					return
+				}
+
+				resp, err := peerRequest(key, "POST", "http://"+peer+"/replicate", b)
+				if err != nil {
+					return
+				}
+				resp.Body.Close()
+
+				// The snapshot covers the rest of the entries as well
+				if resp.StatusCode == 409 {
+					g.sendSnapshot(peer)
+					return
+				}
+				if resp.StatusCode >= 300 {
+					return
+				}
+				g.heardFrom(peer)
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+// heardFrom notes that a follower answered us
+func (g *Server) heardFrom(peer string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.acked[peer] = time.Now()
+}
+
+// sendSnapshot brings a follower up to date
+func (g *Server) sendSnapshot(peer string) {
+	g.lock.Lock()
+	b, err := json.Marshal(g.snapshot())
+	key := g.peerKey
+	g.lock.Unlock()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	resp, err := peerRequest(key, "PUT", "http://"+peer+"/replicate", b)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 300 {
+		g.heardFrom(peer)
+	}
+}
+
+func (g *Server) snapshot() snapshot {
+	return snapshot{g.seq, g.leader, g.peers, g.objects, g.roles, g.tombstones}
+}
+
+// restore replaces our state with a snapshot. It must be called with the lock
+// held
+func (g *Server) restore(s snapshot) {
+	g.seq = s.Seq
+	g.leader = s.Leader
+	g.peers = s.Peers
+	g.objects = s.Objects
+	if g.objects == nil {
+		g.objects = make(map[string]object)
+	}
+	g.roles = s.Roles
+	if g.roles == nil {
+		g.roles = make(map[string]role)
+	}
+	g.tombstones = s.Tombstones
+	if g.tombstones == nil {
+		g.tombstones = make(map[string]tombstone)
+	}
+	g.lastHeard = time.Now()
+	g.notify()
+}
+
+// lead makes us the leader, counting every peer as heard from so none is
+// taken for dead straight away. It must be called with the lock held
+func (g *Server) lead() {
+	g.leader = g.self
+	g.acked = make(map[string]time.Time)
+	for _, peer := range g.peers {
+		g.acked[peer] = time.Now()
+	}
+}
+
+// majority is true if more than half the replica set has been heard from
+// lately, counting ourselves. It must be called with the lock held
+func (g *Server) majority() bool {
+	heard := 0
+	for _, peer := range g.peers {
+		if peer == g.self || time.Since(g.acked[peer]) <= electionTimeout {
+			heard++
+		}
+	}
+	return 2*heard > len(g.peers)
+}
+
+// monitor steps down while we lead without a majority, and holds an election
+// when the leader goes quiet. The network is only used with the lock released
+func (g *Server) monitor() {
+	t := time.NewTicker(heartbeatInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-t.C:
+		}
+
+		g.lock.Lock()
+		leading := g.leader == g.self
+		if leading && !g.majority() {
+			// The others may have elected somebody else, so taking writes
+			// now could lose them
+			log.Print("Lost contact with the majority, stepping down")
+			g.leader = ""
+			g.lastHeard = time.Now()
+		}
+		quiet := !leading && time.Since(g.lastHeard) > electionTimeout
+		peers := g.peers
+		g.lock.Unlock()
+
+		if quiet {
+			g.elect(peers)
+		}
+	}
+}
+
+// elect picks the first live peer as leader, as long as a majority of the
+// replica set is alive
+func (g *Server) elect(peers []string) {
+	chosen := ""
+	live := 0
+	for _, peer := range peers {
+		if peer != g.self && !alive(peer) {
+			continue
+		}
+		live++
+		if len(chosen) == 0 {
+			chosen = peer
+		}
+	}
+	if 2*live <= len(peers) {
+		log.Print("No majority of replicas alive, not electing")
+		return
+	}
+
+	var latest *snapshot
+	if chosen == g.self {
+		latest = g.catchUp(peers)
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	// A leader may have been heard from while we were asking around
+	if g.leader == g.self || time.Since(g.lastHeard) <= electionTimeout {
+		return
+	}
+
+	log.Print("Electing ", chosen)
+	g.leader = chosen
+	g.lastHeard = time.Now()
+	if chosen != g.self {
+		return
+	}
+	if latest != nil && latest.Seq > g.seq {
+		g.seq = latest.Seq
+		g.objects = latest.Objects
+		if latest.Roles != nil {
+			g.roles = latest.Roles
+		}
+		if latest.Tombstones != nil {
+			g.tombstones = latest.Tombstones
+		}
+		g.notify()
+	}
+	g.lead()
+}
+
+// catchUp finds the state of whichever live peer has seen the most writes, in
+// case the old leader shipped to some followers but not to us
+func (g *Server) catchUp(peers []string) (latest *snapshot) {
+	g.lock.Lock()
+	seq := g.seq
+	key := g.peerKey
+	g.lock.Unlock()
+
+	for _, peer := range peers {
+		if peer == g.self {
+			continue
+		}
+
+		resp, err := peerRequest(key, "GET", "http://"+peer+"/replicate", nil)
+		if err != nil {
+			continue
+		}
+		s := snapshot{}
+		err = json.NewDecoder(resp.Body).Decode(&s)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+
+		if s.Seq > seq && s.Objects != nil {
+			seq = s.Seq
+			latest = &s
+		}
+	}
+	return
+}
+
+func alive(peer string) bool {
+	resp, err := replicationClient.Get("http://" + peer + "/version")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// replication receives entries and snapshots from the leader, and hands out
+// our snapshot to a newly elected leader. Only other replicas may use it
+func (g *Server) replication(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		g.handOutSnapshot(w, r)
+		return
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if !g.fromPeer(r) {
+		w.WriteHeader(403)
+		io.WriteString(w, "Permission Denied")
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		e := entry{}
+		err := json.NewDecoder(r.Body).Decode(&e)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+
+		heartbeat := len(e.Item) == 0 && len(e.Role) == 0 && e.Seq == g.seq
+		if !heartbeat && e.Seq != g.seq+1 {
+			w.WriteHeader(409)
+			return
+		}
+
+		if len(e.Item) > 0 {
+			if e.Object == nil {
+				g.remove(e.Item)
+			} else {
+				g.objects[e.Item] = *e.Object
+				delete(g.tombstones, e.Item)
+			}
+		}
+		if len(e.Role) > 0 {
+			if e.RoleData == nil {
+				delete(g.roles, e.Role)
+			} else {
+				g.roles[e.Role] = *e.RoleData
+			}
+		}
+		if !heartbeat {
+			g.notify()
+		}
+		g.seq = e.Seq
+		g.leader = e.Leader
+		g.peers = e.Peers
+		g.lastHeard = time.Now()
+
+		// Heartbeats are left out of the audit log, see audited
+		if heartbeat {
+			w.WriteHeader(204)
+		}
+
+	case "PUT":
+		s := snapshot{}
+		err := json.NewDecoder(r.Body).Decode(&s)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		g.restore(s)
+
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+// handOutSnapshot sends our snapshot to another replica. It is copied under
+// the lock and sent without it, so a slow peer doesn't hold up everything else
+func (g *Server) handOutSnapshot(w http.ResponseWriter, r *http.Request) {
+	g.lock.Lock()
+	permitted := g.fromPeer(r)
+	b, err := json.Marshal(g.snapshot())
+	g.lock.Unlock()
+	if !permitted {
+		w.WriteHeader(403)
+		io.WriteString(w, "Permission Denied")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(b)
+}
+
+// join adds a new replica to the set and hands it our snapshot. Only holders
+// of the peer key may join
+func (g *Server) join(w http.ResponseWriter, r *http.Request) {
+	g.lock.Lock()
+	permitted := g.fromPeer(r)
+	leading := g.peers != nil && g.leader == g.self
+	g.lock.Unlock()
+	if !permitted {
+		w.WriteHeader(403)
+		io.WriteString(w, "Permission Denied")
+		return
+	}
+	if !leading {
+		g.notLeader(w)
+		return
+	}
+
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1000))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	peer := string(b)
+
+	g.lock.Lock()
+
+	// A restarted replica rejoins at the back of the line
+	peers := []string{}
+	for _, p := range g.peers {
+		if p != peer {
+			peers = append(peers, p)
+		}
+	}
+	g.peers = append(peers, peer)
+	g.acked[peer] = time.Now()
+
+	b, err = json.Marshal(g.snapshot())
+	g.lock.Unlock()
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(b)
+}
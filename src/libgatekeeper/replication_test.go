@@ -0,0 +1,253 @@
+package libgatekeeper
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitListening blocks until something accepts connections on address
+func waitListening(t *testing.T, address string) {
+	for i := 0; i < 100; i++ {
+		c, err := net.Dial("tcp", address)
+		if err == nil {
+			c.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Nothing listening on " + address)
+}
+
+// waitValue waits for a replica to have item set to value, as shipping to the
+// followers happens after the write is answered
+func waitValue(t *testing.T, g *Server, item string, value string) {
+	var v string
+	var err error
+	for i := 0; i < 100; i++ {
+		v, err = g.Get(item, "key")
+		if err == nil && v == value {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("replicated value is %q, %v", v, err)
+}
+
+func TestReplicationFailover(t *testing.T) {
+	addresses := []string{"localhost:1340", "localhost:1341", "localhost:1342"}
+	servers := make([]*Server, len(addresses))
+
+	for i, address := range addresses {
+		servers[i] = NewServer()
+		servers[i].SetPeerKey("peer")
+		go servers[i].Listen(address)
+		waitListening(t, address)
+
+		err := servers[i].Join(address, addresses)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, g := range servers {
+			g.Close()
+		}
+	}()
+
+	c := NewClient("localhost:1341,localhost:1342,localhost:1340", "key")
+	err := c.New("secret", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every follower gets the write
+	for _, g := range servers[1:] {
+		waitValue(t, g, "secret", "one")
+	}
+
+	// Kill the leader, writes should carry on once a new one is elected
+	servers[0].Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for err = c.Set("secret", "two"); err != nil; err = c.Set("secret", "two") {
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, g := range servers[1:] {
+		waitValue(t, g, "secret", "two")
+	}
+}
+
+func TestReplicationNeedsPeerKey(t *testing.T) {
+	g := NewServer()
+	g.SetAdmin("admin")
+	g.SetPeerKey("peer")
+	go g.Listen("localhost:1353")
+	defer g.Close()
+	waitListening(t, "localhost:1353")
+
+	err := g.New("secret", "hunter2", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A server outside any replica set hands its state to nobody
+	resp, err := peerRequest("peer", "GET", "http://localhost:1353/replicate", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 403 {
+		t.Fatal("Unreplicated server answered " + resp.Status)
+	}
+
+	err = g.Join("localhost:1353", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", "wrong"} {
+		for _, path := range []string{"replicate", "join"} {
+			method := "GET"
+			if path == "join" {
+				method = "POST"
+			}
+			resp, err = peerRequest(key, method, "http://localhost:1353/"+path, []byte("localhost:1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != 403 {
+				t.Fatal(method + " " + path + " with key " + key + " answered " + resp.Status)
+			}
+		}
+	}
+
+	req, err := http.NewRequest("PUT", "http://localhost:1353/replicate",
+		strings.NewReader(`{"Seq": 100}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	v, err := g.Get("secret", "key")
+	if err != nil || v != "hunter2" {
+		t.Fatal("Snapshot without the peer key replaced the store")
+	}
+
+	resp, err = peerRequest("peer", "GET", "http://localhost:1353/replicate", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("Peer was refused with " + resp.Status)
+	}
+
+	events, err := g.Audit("", "admin", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := 0
+	for _, e := range events {
+		if strings.HasSuffix(e.Op, "replicate") && strings.HasPrefix(e.Result, "403") {
+			refused++
+		}
+	}
+	if refused != 4 {
+		t.Fatalf("%d refused replications audited", refused)
+	}
+}
+
+func TestLeaderStepsDown(t *testing.T) {
+	addresses := []string{"localhost:1350", "localhost:1351", "localhost:1352"}
+	servers := make([]*Server, len(addresses))
+
+	for i, address := range addresses {
+		servers[i] = NewServer()
+		servers[i].SetPeerKey("peer")
+		go servers[i].Listen(address)
+		waitListening(t, address)
+
+		err := servers[i].Join(address, addresses)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer servers[0].Close()
+
+	// Dead followers don't hold up writes
+	servers[1].Close()
+	servers[2].Close()
+	start := time.Now()
+	err := servers[0].New("secret", "one", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatal("Write took " + time.Since(start).String())
+	}
+
+	// Without a majority the leader stops taking writes
+	deadline := time.Now().Add(10 * time.Second)
+	for servers[0].isLeader() {
+		if time.Now().After(deadline) {
+			t.Fatal("Leader kept leading without a majority")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// and nobody takes over until a majority is back
+	time.Sleep(2 * electionTimeout)
+	if servers[0].isLeader() {
+		t.Fatal("Leader elected itself without a majority")
+	}
+}
+
+func TestClientRetriesOnlyReads(t *testing.T) {
+	g := NewServer()
+	go g.Listen("localhost:1356")
+	defer g.Close()
+	waitListening(t, "localhost:1356")
+	err := NewClient("localhost:1356", "key").New("item", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A replica that hangs up after reading the request, which may have
+	// been applied
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Read(make([]byte, 4096))
+			c.Close()
+		}
+	}()
+
+	c := NewClient(l.Addr().String()+",localhost:1356", "key")
+	err = c.Set("item", "changed")
+	if err == nil {
+		t.Error("write sent again after the connection broke")
+	}
+	v, err := NewClient(l.Addr().String()+",localhost:1356", "key").Get("item")
+	if err != nil || v != "value" {
+		t.Errorf("read not retried, got %q, %v", v, err)
+	}
+}
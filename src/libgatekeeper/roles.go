@@ -0,0 +1,292 @@
+package libgatekeeper
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// role is a named group of keys. Items grant a level of access to roles, and
+// every member of the role gets that access
+type role struct {
+	Owner   string
+	Members map[string]bool
+}
+
+// ownsRole checks key may change a role. It must be called with the lock held
+func (g *Server) ownsRole(name, key string) bool {
+	r, found := g.roles[name]
+	return found && (r.Owner == key || (len(g.admin) > 0 && key == g.admin))
+}
+
+func (g *Server) NewRole(name, key string) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	_, found := g.roles[name]
+	if found || len(name) == 0 {
+		return errors.New("Permission Denied")
+	}
+
+	g.roles[name] = role{key, make(map[string]bool)}
+	g.replicateRole(name)
+	return nil
+}
+
+func (g *Server) DeleteRole(name, key string) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if !g.ownsRole(name, key) {
+		return errors.New("Permission Denied")
+	}
+
+	// Take back everything it was granted, or whoever makes a role of the
+	// same name next would get it
+	for item, v := range g.objects {
+		_, granted := v.Grants[name]
+		if granted {
+			delete(v.Grants, name)
+			g.objects[item] = v
+			g.replicate(item)
+		}
+	}
+
+	delete(g.roles, name)
+	g.replicateRole(name)
+	return nil
+}
+
+func (g *Server) AddMember(name, key, member string) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if !g.ownsRole(name, key) {
+		return errors.New("Permission Denied")
+	}
+
+	g.roles[name].Members[member] = true
+	g.replicateRole(name)
+	return nil
+}
+
+func (g *Server) RemoveMember(name, key, member string) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if !g.ownsRole(name, key) {
+		return errors.New("Permission Denied")
+	}
+
+	delete(g.roles[name].Members, member)
+	g.replicateRole(name)
+	return nil
+}
+
+// Members lists the keys in a role, for its owner and its members
+func (g *Server) Members(name, key string) (members []string, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if !g.ownsRole(name, key) && !g.roles[name].Members[key] {
+		return nil, errors.New("No Such Role or Permission Denied")
+	}
+
+	for member, _ := range g.roles[name].Members {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// Grant gives every member of a role access to item and everything below it.
+// key must administer item and own the role
+func (g *Server) Grant(item, key, name string, l Level) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	err = errors.New("Permission Denied")
+
+	v, found := g.objects[item]
+
+	if !found || !g.owns(item, key) || !g.ownsRole(name, key) {
+		return
+	}
+
+	if v.Grants == nil {
+		v.Grants = make(map[string]Level)
+	}
+	v.Grants[name] = l
+	g.objects[item] = v
+	g.replicate(item)
+	return nil
+}
+
+// Revoke takes away the access a role was granted on item
+func (g *Server) Revoke(item, key, name string) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	err = errors.New("Permission Denied")
+
+	v, found := g.objects[item]
+
+	if !found || !g.owns(item, key) {
+		return
+	}
+
+	delete(v.Grants, name)
+	g.objects[item] = v
+	g.replicate(item)
+	return nil
+}
+
+// RevokeKey removes a compromised key from every role and item. Items it owned
+// pass to the administrator. Only the administrator may revoke keys
+func (g *Server) RevokeKey(key, revoked string) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if len(g.admin) == 0 || key != g.admin || revoked == g.admin {
+		return errors.New("Permission Denied")
+	}
+
+	for name, r := range g.roles {
+		if r.Members[revoked] || r.Owner == revoked {
+			delete(r.Members, revoked)
+			if r.Owner == revoked {
+				r.Owner = g.admin
+			}
+			g.roles[name] = r
+			g.replicateRole(name)
+		}
+	}
+
+	for item, v := range g.objects {
+		_, permitted := v.Permissions[revoked]
+		if permitted || v.Owner == revoked {
+			delete(v.Permissions, revoked)
+			if v.Owner == revoked {
+				v.Owner = g.admin
+			}
+			g.objects[item] = v
+			g.replicate(item)
+		}
+	}
+	return nil
+}
+
+func (g *Server) role(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	name := itemPath(r.URL.Path, "/roles/")
+	log.Print(name)
+	log.Print("Handling")
+
+	var err error
+	var v string
+
+	if r.Method != "GET" && !g.isLeader() {
+		g.notLeader(w)
+		return
+	}
+
+	value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1000000))
+
+	switch r.Method {
+
+	case "GET":
+		var members []string
+		members, err = g.Members(name, key)
+		v = strings.Join(members, "\n")
+
+	case "PUT":
+		if err == nil {
+			err = g.NewRole(name, key)
+		}
+
+	case "POST":
+		if err == nil {
+			err = g.AddMember(name, key, string(value))
+		}
+
+	case "DELETE":
+		if err == nil && len(value) == 0 {
+			err = g.DeleteRole(name, key)
+		} else if err == nil {
+			err = g.RemoveMember(name, key, string(value))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+	io.WriteString(w, v)
+}
+
+func (g *Server) grant(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	name := r.FormValue("role")
+	item := itemPath(r.URL.Path, "/grants/")
+	log.Print(item)
+	log.Print("Handling")
+
+	var err error
+
+	if !g.isLeader() {
+		g.notLeader(w)
+		return
+	}
+
+	switch r.Method {
+
+	case "POST":
+		var l Level
+		l, err = ParseLevel(r.FormValue("level"))
+		if err == nil {
+			err = g.Grant(item, key, name, l)
+		}
+
+	case "DELETE":
+		err = g.Revoke(item, key, name)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func (g *Server) revoke(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	log.Print("Handling revoke")
+
+	if !g.isLeader() {
+		g.notLeader(w)
+		return
+	}
+
+	value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1000000))
+	if err == nil && r.Method == "POST" {
+		err = g.RevokeKey(key, string(value))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+}
@@ -0,0 +1,117 @@
+package libgatekeeper
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	g := NewServer()
+	g.SetAdmin("admin")
+
+	for _, item := range []string{"apps/web", "apps/web/db_password", "apps/api"} {
+		err := g.New(item, "value", "owner")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err := g.NewRole("web", "owner")
+	if err != nil {
+		t.Error(err)
+	}
+	err = g.AddMember("web", "owner", "webkey")
+	if err != nil {
+		t.Error(err)
+	}
+	err = g.Grant("apps/web", "owner", "web", Write)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The role reaches below the granted item, and no further
+	err = g.Set("apps/web/db_password", "rotated", "webkey")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = g.Get("apps/api", "webkey")
+	if err == nil {
+		t.Error(errors.New("Role member could read apps/api"))
+	}
+
+	// Write access doesn't let members re-grant
+	err = g.AddAccess("apps/web", "webkey", "friend")
+	if err == nil {
+		t.Error(errors.New("Role member with write access granted access"))
+	}
+
+	// Revoking the key takes it out of the role
+	err = g.RevokeKey("owner", "webkey")
+	if err == nil {
+		t.Error(errors.New("Non administrator revoked a key"))
+	}
+	err = g.RevokeKey("admin", "webkey")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = g.Get("apps/web/db_password", "webkey")
+	if err == nil {
+		t.Error(errors.New("Revoked key could still read"))
+	}
+	members, err := g.Members("web", "owner")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(members) != 0 {
+		t.Error(errors.New("Revoked key is still a member"))
+	}
+}
+
+func TestRoleSquatting(t *testing.T) {
+	g := NewServer()
+
+	err := g.New("db_password", "s3cret", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Grants need a role the granting key owns
+	err = g.Grant("db_password", "owner", "dba", Read)
+	if err == nil {
+		t.Error(errors.New("Granted to a role that doesn't exist"))
+	}
+	err = g.NewRole("mine", "attacker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.Grant("db_password", "owner", "mine", Read)
+	if err == nil {
+		t.Error(errors.New("Granted to somebody else's role"))
+	}
+
+	// Deleting a role takes back its grants
+	err = g.NewRole("dba", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.Grant("db_password", "owner", "dba", Read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.DeleteRole("dba", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.NewRole("dba", "attacker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.AddMember("dba", "attacker", "attacker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.Get("db_password", "attacker")
+	if err == nil {
+		t.Error(errors.New("Squatted role inherited the old grants"))
+	}
+}
@@ -1,72 +1,128 @@
 package libgatekeeper
 
 import (
+	"common"
+	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// object is a single stored item. The fields are exported so that replicas
+// can ship objects to each other as JSON
+type object struct {
+	Value       string
+	Owner       string
+	Permissions map[string]Level
+	Grants      map[string]Level
+	Versions    []version
+	Keep        int
+	Expires     time.Time
+
+	// Created is the sequence number of the write that created the object.
+	// Only parents created before it pass their access down to it
+	Created int
+}
+
 type Server struct {
-	objects map[string]struct {
-		value       string
-		owner       string
-		permissions map[string]bool
-	}
+	lock    sync.Mutex
+	objects map[string]object
+	roles   map[string]role
+	admin   string
+
+	// tombstones keep version numbers going up across a delete, see
+	// versions.go
+	tombstones map[string]tombstone
+
+	audit   *auditLog
+	changed chan struct{}
+	server  *http.Server
+
+	// Replication state, see replication.go
+	peerKey   string
+	self      string
+	peers     []string
+	leader    string
+	seq       int
+	lastHeard time.Time
+	acked     map[string]time.Time
+	queue     []entry
+	wake      chan struct{}
+	done      chan struct{}
 }
 
 func NewServer() (g *Server) {
 	g = new(Server)
-	g.objects = make(map[string]struct {
-		value       string
-		owner       string
-		permissions map[string]bool
-	})
+	g.objects = make(map[string]object)
+	g.roles = make(map[string]role)
+	g.tombstones = make(map[string]tombstone)
+	g.audit = newAuditLog(nil, "")
+	g.changed = make(chan struct{})
+	g.wake = make(chan struct{}, 1)
+	g.done = make(chan struct{})
 	return g
 
 }
 
 func (g *Server) Get(item, key string) (value string, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
 	err = errors.New("No Such Item or Permission Denied")
 
 	o, ok := g.objects[item]
-	if !ok {
+	if !ok || o.expired() {
 		return
 	}
 
-	ok = o.permissions[key]
+	ok = g.canRead(item, key)
 	if !ok {
 		return
 	}
 
-	return o.value, nil
+	return o.Value, nil
 }
 
 func (g *Server) New(item, value, key string) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
 	err = errors.New("Permission Denied")
 
 	v, found := g.objects[item]
 
-	if found {
+	if (found && !v.expired()) || !g.mayCreate(item, key) {
 		return
 	}
 
-	v.owner = key
-	v.permissions = make(map[string]bool)
-	v.permissions[key] = true
-	v.value = value
+	// Numbering carries on from whatever was here before, so a watch or a
+	// conditional write holding an old number isn't fooled
+	last := g.lastNumber(item)
+	v = object{}
+	v.Created = g.nextSeq()
+	v.Owner = key
+	v.Permissions = make(map[string]Level)
+	v.Permissions[key] = Admin
+	v.addVersion(value)
+	v.Versions[0].Number += last
 	g.objects[item] = v
+	delete(g.tombstones, item)
+	g.replicate(item)
 	return nil
 }
 
 func (g *Server) Set(item, value, key string) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
 	err = errors.New("Permission Denied")
 
 	v, found := g.objects[item]
 
-	if found && v.owner != key {
+	if found && !g.canWrite(item, key) {
 		return
 	}
 
@@ -74,17 +130,20 @@ func (g *Server) Set(item, value, key string) (err error) {
 		return
 	}
 
-	v.value = value
+	v.addVersion(value)
 	g.objects[item] = v
+	g.replicate(item)
 	return nil
 }
 
 func (g *Server) Delete(item, key string) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
 	err = errors.New("Permission Denied")
 
-	v, found := g.objects[item]
+	_, found := g.objects[item]
 
-	if found && v.owner != key {
+	if found && !g.owns(item, key) {
 		return
 	}
 
@@ -92,11 +151,20 @@ func (g *Server) Delete(item, key string) (err error) {
 		return
 	}
 
-	delete(g.objects, item)
+	g.remove(item)
+	g.replicate(item)
 	return nil
 }
 
+// AddAccess lets newkey read item and everything below it
 func (g *Server) AddAccess(item, key, newkey string) (err error) {
+	return g.SetAccess(item, key, newkey, Read)
+}
+
+// SetAccess gives newkey a level of access to item and everything below it
+func (g *Server) SetAccess(item, key, newkey string, l Level) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
 	err = errors.New("Permission Denied")
 
 	v, found := g.objects[item]
@@ -105,16 +173,19 @@ func (g *Server) AddAccess(item, key, newkey string) (err error) {
 		return
 	}
 
-	if found && v.owner != key {
+	if found && !g.owns(item, key) {
 		return
 	}
 
-	v.permissions[newkey] = true
+	v.Permissions[newkey] = l
 	g.objects[item] = v
+	g.replicate(item)
 	return nil
 }
 
 func (g *Server) SwitchOwner(item, key, newkey string) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
 	err = errors.New("Permission Denied")
 
 	v, found := g.objects[item]
@@ -123,17 +194,20 @@ func (g *Server) SwitchOwner(item, key, newkey string) (err error) {
 		return
 	}
 
-	if found && v.owner != key {
+	if found && !g.owns(item, key) {
 		return
 	}
 
-	v.permissions[newkey] = true
-	v.owner = newkey
+	v.Permissions[newkey] = Admin
+	v.Owner = newkey
 	g.objects[item] = v
+	g.replicate(item)
 	return nil
 }
 
 func (g *Server) RemoveAccess(item, key, newkey string) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
 	err = errors.New("Permission Denied")
 
 	v, found := g.objects[item]
@@ -142,32 +216,53 @@ func (g *Server) RemoveAccess(item, key, newkey string) (err error) {
 		return
 	}
 
-	if found && v.owner != key {
+	if found && !g.owns(item, key) {
 		return
 	}
-	delete(v.permissions, newkey)
+	delete(v.Permissions, newkey)
 	g.objects[item] = v
+	g.replicate(item)
 	return nil
 }
 
 func (g *Server) object(w http.ResponseWriter, r *http.Request) {
 	key := r.FormValue("key")
-	item := r.URL.Path
+	item := itemPath(r.URL.Path, "/object/")
 	log.Print(item)
-	s := strings.Split(item, "/")
-	log.Print(s)
-	item = s[len(s)-1]
 	log.Print("Handling")
 
 	var err error
 	var v string
 
+	if r.Method != "GET" && r.Method != "LIST" && !g.isLeader() {
+		g.notLeader(w)
+		return
+	}
+
 	value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1000000))
 
 	switch r.Method {
 
 	case "GET":
-		v, err = g.Get(item, key)
+		number := 0
+		if len(r.FormValue("version")) > 0 {
+			number, err = strconv.Atoi(r.FormValue("version"))
+		}
+		if err == nil {
+			var current int
+			v, current, err = g.GetVersion(item, key, number)
+			w.Header().Set("X-Gatekeeper-Version", strconv.Itoa(current))
+		}
+		if err == nil {
+			var expires time.Time
+			expires, err = g.Expires(item, key)
+			setExpiresHeader(w, expires)
+		}
+
+	case "LIST":
+		var children []string
+		children, err = g.List(item, key)
+		v = strings.Join(children, "\n")
 
 	case "PUT":
 		if err == nil {
@@ -175,7 +270,14 @@ func (g *Server) object(w http.ResponseWriter, r *http.Request) {
 		}
 
 	case "POST":
-		if err == nil {
+		if err == nil && len(r.FormValue("version")) > 0 {
+			var number, current int
+			number, err = strconv.Atoi(r.FormValue("version"))
+			if err == nil {
+				current, err = g.SetVersion(item, string(value), key, number)
+				w.Header().Set("X-Gatekeeper-Version", strconv.Itoa(current))
+			}
+		} else if err == nil {
 			err = g.Set(item, string(value), key)
 		}
 	case "DELETE":
@@ -185,6 +287,11 @@ func (g *Server) object(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "text/plain; chaset=utf-8")
+	if err == ErrConflict {
+		w.WriteHeader(409)
+		io.WriteString(w, err.Error())
+		return
+	}
 	if err != nil {
 		w.WriteHeader(400)
 		io.WriteString(w, err.Error())
@@ -197,27 +304,41 @@ func (g *Server) object(w http.ResponseWriter, r *http.Request) {
 
 func (g *Server) permission(w http.ResponseWriter, r *http.Request) {
 	key := r.FormValue("key")
-	item := r.URL.Path
+	item := itemPath(r.URL.Path, "/permissions/")
 	log.Print(item)
-	s := strings.Split(item, "/")
-	log.Print(s)
-	item = s[len(s)-1]
 	log.Print("Handling")
 
 	var err error
+	var v []byte
+
+	if r.Method != "GET" && !g.isLeader() {
+		g.notLeader(w)
+		return
+	}
 
 	value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1000000))
 
 	switch r.Method {
 
+	case "GET":
+		var p Permissions
+		p, err = g.Inspect(item, key)
+		if err == nil {
+			v, err = json.Marshal(p)
+		}
+
 	case "PUT":
 		if err == nil {
 			err = g.SwitchOwner(item, key, string(value))
 		}
 
 	case "POST":
+		l := Read
+		if err == nil && len(r.FormValue("level")) > 0 {
+			l, err = ParseLevel(r.FormValue("level"))
+		}
 		if err == nil {
-			err = g.AddAccess(item, key, string(value))
+			err = g.SetAccess(item, key, string(value), l)
 		}
 
 	case "DELETE":
@@ -234,17 +355,53 @@ func (g *Server) permission(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.WriteHeader(200)
+	w.Write(v)
 }
 
 func (g *Server) Listen(address string) (err error) {
+	mux := http.NewServeMux()
 
-	http.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
-		io.WriteString(w, "gatekeeper v0")
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "gatekeeper "+common.Version)
 	})
 
-	http.HandleFunc("/object/", g.object)
-	http.HandleFunc("/permissions/", g.permission)
+	mux.HandleFunc("/object/", g.audited("object", g.object))
+	mux.HandleFunc("/permissions/", g.audited("permissions", g.permission))
+	mux.HandleFunc("/roles/", g.audited("roles", g.role))
+	mux.HandleFunc("/grants/", g.audited("grants", g.grant))
+	mux.HandleFunc("/revoke", g.audited("revoke", g.revoke))
+	mux.HandleFunc("/versions/", g.audited("versions", g.versions))
+	mux.HandleFunc("/ttl/", g.audited("ttl", g.ttl))
+	mux.HandleFunc("/redeem/", g.audited("redeem", g.redeem))
+	mux.HandleFunc("/audit", g.audited("audit", g.auditQuery))
+	mux.HandleFunc("/watch/", g.audited("watch", g.watch))
+	mux.HandleFunc("/database/", g.audited("database", g.database))
+	mux.HandleFunc("/credentials/", g.audited("credentials", g.credential))
+	mux.HandleFunc("/replicate", g.audited("replicate", g.replication))
+	mux.HandleFunc("/join", g.audited("join", g.join))
+
+	g.lock.Lock()
+	g.server = &http.Server{Addr: address, Handler: mux}
+	g.lock.Unlock()
+
+	go g.janitor()
+	err = g.server.ListenAndServe()
+	return
+}
+
+// Close stops the server listening and takes it out of replication
+func (g *Server) Close() (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	select {
+	case <-g.done:
+	default:
+		close(g.done)
+	}
 
-	err = http.ListenAndServe(address, nil)
+	if g.server != nil {
+		err = g.server.Close()
+	}
 	return
 }
@@ -0,0 +1,146 @@
+package libgatekeeper
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OneTimeKeyTTL is how long a one time key lives if nobody redeems it
+const OneTimeKeyTTL = 10 * time.Minute
+
+// janitorInterval is how often expired objects are cleared out
+var janitorInterval = 10 * time.Second
+
+// expired is true once an object's time to live has passed
+func (o *object) expired() bool {
+	return !o.Expires.IsZero() && time.Now().After(o.Expires)
+}
+
+// SetTTL makes item expire after ttl, or never if ttl is 0
+func (g *Server) SetTTL(item, key string, ttl time.Duration) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	err = errors.New("Permission Denied")
+
+	o, found := g.objects[item]
+	if !found || o.expired() || !g.owns(item, key) {
+		return
+	}
+
+	o.Expires = time.Time{}
+	if ttl > 0 {
+		o.Expires = time.Now().Add(ttl)
+	}
+	g.objects[item] = o
+	g.replicate(item)
+	return nil
+}
+
+// Expires tells when item expires, the zero time meaning never
+func (g *Server) Expires(item, key string) (expires time.Time, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	o, found := g.objects[item]
+	if !found || o.expired() || !g.canRead(item, key) {
+		return expires, errors.New("No Such Item or Permission Denied")
+	}
+	return o.Expires, nil
+}
+
+// expire deletes every object whose time to live has passed, and drops the
+// database users whose leases have run out. Only the leader deletes, followers
+// are told through replication
+func (g *Server) expire() {
+	if !g.isLeader() {
+		return
+	}
+
+	g.lock.Lock()
+	users := g.expiredCredentials()
+	for item, o := range g.objects {
+		if o.expired() && !strings.HasPrefix(item, leaseItem("")) {
+			log.Print("Expired ", item)
+			g.remove(item)
+			g.replicate(item)
+		}
+	}
+	g.lock.Unlock()
+
+	// Database users are dropped without the lock held, see credentials.go
+	for _, user := range users {
+		log.Print("Expired database user ", user)
+		err := g.dropCredential(user)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// janitor clears out expired objects until the server is closed
+func (g *Server) janitor() {
+	t := time.NewTicker(janitorInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-t.C:
+			g.expire()
+		}
+	}
+}
+
+// setExpiresHeader tells HTTP clients when an item expires
+func setExpiresHeader(w http.ResponseWriter, expires time.Time) {
+	if !expires.IsZero() {
+		w.Header().Set("X-Gatekeeper-Expires", expires.Format(time.RFC3339))
+	}
+}
+
+func (g *Server) ttl(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	item := itemPath(r.URL.Path, "/ttl/")
+	log.Print(item)
+	log.Print("Handling")
+
+	var err error
+	var v string
+
+	if r.Method != "GET" && !g.isLeader() {
+		g.notLeader(w)
+		return
+	}
+
+	switch r.Method {
+
+	case "GET":
+		var expires time.Time
+		expires, err = g.Expires(item, key)
+		if err == nil && !expires.IsZero() {
+			v = expires.Format(time.RFC3339)
+		}
+
+	case "PUT":
+		var ttl time.Duration
+		ttl, err = time.ParseDuration(r.FormValue("ttl"))
+		if err == nil {
+			err = g.SetTTL(item, key, ttl)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+	io.WriteString(w, v)
+}
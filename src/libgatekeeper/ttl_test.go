@@ -0,0 +1,40 @@
+package libgatekeeper
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	g := NewServer()
+
+	err := g.New("key.onetime", "containerkey", "key")
+	if err != nil {
+		t.Error(err)
+	}
+	err = g.SetTTL("key.onetime", "key", 50*time.Millisecond)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expires, err := g.Expires("key.onetime", "key")
+	if err != nil {
+		t.Error(err)
+	}
+	if expires.IsZero() {
+		t.Error(errors.New("expiry was not set"))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = g.Get("key.onetime", "key")
+	if err == nil {
+		t.Error(errors.New("expired item could still be read"))
+	}
+
+	g.expire()
+	if _, found := g.objects["key.onetime"]; found {
+		t.Error(errors.New("janitor left the expired item"))
+	}
+}
@@ -0,0 +1,265 @@
+package libgatekeeper
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrConflict is returned by a conditional write when item has moved on from
+// the version the caller read
+var ErrConflict = errors.New("Version Conflict")
+
+// defaultKeep is how many versions an object keeps unless its owner says
+// otherwise
+const defaultKeep = 10
+
+// version is one value an object has held
+type version struct {
+	Number int
+	Value  string
+	Time   time.Time
+}
+
+// Version describes a stored version without giving away its value
+type Version struct {
+	Number int
+	Time   time.Time
+}
+
+// tombstoneTTL is how long the number of the last version of a deleted object
+// is remembered, so an object made again in its place carries on from it
+var tombstoneTTL = 24 * time.Hour
+
+// tombstone is what is left of a deleted object
+type tombstone struct {
+	Number int
+	Time   time.Time
+}
+
+// remove deletes item, leaving a tombstone with its last version number and
+// dropping tombstones older than tombstoneTTL. It must be called with the
+// lock held
+func (g *Server) remove(item string) {
+	o, found := g.objects[item]
+	if !found {
+		return
+	}
+	delete(g.objects, item)
+
+	for name, t := range g.tombstones {
+		if time.Since(t.Time) > tombstoneTTL {
+			delete(g.tombstones, name)
+		}
+	}
+	latest, _ := o.find(0)
+	g.tombstones[item] = tombstone{latest.Number, time.Now()}
+}
+
+// lastNumber is the number of the last version item has had, whether it is
+// still there, expired or deleted. It must be called with the lock held
+func (g *Server) lastNumber(item string) int {
+	o, found := g.objects[item]
+	if found {
+		latest, _ := o.find(0)
+		return latest.Number
+	}
+	return g.tombstones[item].Number
+}
+
+// addVersion makes value the latest version of the object, and forgets the
+// oldest versions beyond what the object keeps
+func (o *object) addVersion(value string) {
+	number := 1
+	if len(o.Versions) > 0 {
+		number = o.Versions[len(o.Versions)-1].Number + 1
+	}
+	o.Value = value
+	o.Versions = append(o.Versions, version{number, value, time.Now()})
+	o.trim()
+}
+
+func (o *object) trim() {
+	keep := o.Keep
+	if keep <= 0 {
+		keep = defaultKeep
+	}
+	if len(o.Versions) > keep {
+		o.Versions = append([]version{}, o.Versions[len(o.Versions)-keep:]...)
+	}
+}
+
+// find gives the version with the given number, 0 being the latest
+func (o *object) find(number int) (v version, found bool) {
+	if len(o.Versions) == 0 {
+		return
+	}
+	if number == 0 {
+		return o.Versions[len(o.Versions)-1], true
+	}
+	for _, v = range o.Versions {
+		if v.Number == number {
+			return v, true
+		}
+	}
+	return v, false
+}
+
+// GetVersion fetches an older value of item, or the latest when number is 0.
+// current is the number of the version returned
+func (g *Server) GetVersion(item, key string, number int) (value string, current int, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	err = errors.New("No Such Item or Permission Denied")
+
+	o, found := g.objects[item]
+	if !found || o.expired() || !g.canRead(item, key) {
+		return
+	}
+
+	v, found := o.find(number)
+	if !found {
+		return
+	}
+	return v.Value, v.Number, nil
+}
+
+// SetVersion changes item like Set, but only if its latest version is still
+// number. current is the number of the version written
+func (g *Server) SetVersion(item, value, key string, number int) (current int, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	err = errors.New("Permission Denied")
+
+	o, found := g.objects[item]
+	if !found || !g.canWrite(item, key) {
+		return
+	}
+
+	latest, _ := o.find(0)
+	if latest.Number != number {
+		return latest.Number, ErrConflict
+	}
+
+	o.addVersion(value)
+	g.objects[item] = o
+	g.replicate(item)
+	latest, _ = o.find(0)
+	return latest.Number, nil
+}
+
+// Versions lists the versions of item that are still kept
+func (g *Server) Versions(item, key string) (versions []Version, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	o, found := g.objects[item]
+	if !found || !g.owns(item, key) {
+		return nil, errors.New("No Such Item or Permission Denied")
+	}
+
+	for _, v := range o.Versions {
+		versions = append(versions, Version{v.Number, v.Time})
+	}
+	return versions, nil
+}
+
+// Rollback makes an older value the latest again, as a new version
+func (g *Server) Rollback(item, key string, number int) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	err = errors.New("Permission Denied")
+
+	o, found := g.objects[item]
+	if !found || !g.owns(item, key) {
+		return
+	}
+
+	v, found := o.find(number)
+	if !found {
+		return errors.New("No such version")
+	}
+
+	o.addVersion(v.Value)
+	g.objects[item] = o
+	g.replicate(item)
+	return nil
+}
+
+// SetRetention sets how many versions of item are kept
+func (g *Server) SetRetention(item, key string, keep int) (err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	err = errors.New("Permission Denied")
+
+	o, found := g.objects[item]
+	if !found || !g.owns(item, key) || keep < 1 {
+		return
+	}
+
+	o.Keep = keep
+	o.trim()
+	g.objects[item] = o
+	g.replicate(item)
+	return nil
+}
+
+func (g *Server) versions(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	item := itemPath(r.URL.Path, "/versions/")
+	log.Print(item)
+	log.Print("Handling")
+
+	var err error
+	var v []byte
+
+	if r.Method != "GET" && !g.isLeader() {
+		g.notLeader(w)
+		return
+	}
+
+	value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1000000))
+
+	switch r.Method {
+
+	case "GET":
+		var versions []Version
+		versions, err = g.Versions(item, key)
+		if err == nil {
+			v, err = json.Marshal(versions)
+		}
+
+	case "POST":
+		var number int
+		if err == nil {
+			number, err = strconv.Atoi(r.FormValue("version"))
+		}
+		if err == nil {
+			err = g.Rollback(item, key, number)
+		}
+
+	case "PUT":
+		var keep int
+		if err == nil {
+			keep, err = strconv.Atoi(string(value))
+		}
+		if err == nil {
+			err = g.SetRetention(item, key, keep)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(v)
+}
@@ -0,0 +1,121 @@
+package libgatekeeper
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVersions(t *testing.T) {
+	g := NewServer()
+
+	err := g.New("token", "one", "key")
+	if err != nil {
+		t.Error(err)
+	}
+	err = g.Set("token", "two", "key")
+	if err != nil {
+		t.Error(err)
+	}
+
+	v, current, err := g.GetVersion("token", "key", 1)
+	if err != nil {
+		t.Error(err)
+	}
+	if v != "one" || current != 1 {
+		t.Error(errors.New("version 1 is not one"))
+	}
+
+	err = g.Rollback("token", "key", 1)
+	if err != nil {
+		t.Error(err)
+	}
+	v, current, err = g.GetVersion("token", "key", 0)
+	if v != "one" || current != 3 {
+		t.Error(errors.New("rollback did not make version 3 from version 1"))
+	}
+
+	err = g.SetRetention("token", "key", 2)
+	if err != nil {
+		t.Error(err)
+	}
+	versions, err := g.Versions("token", "key")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(versions) != 2 || versions[0].Number != 2 {
+		t.Error(errors.New("retention did not drop version 1"))
+	}
+	_, _, err = g.GetVersion("token", "key", 1)
+	if err == nil {
+		t.Error(errors.New("dropped version still fetched"))
+	}
+}
+
+func TestSetVersion(t *testing.T) {
+	g := NewServer()
+	go g.Listen("localhost:1354")
+	defer g.Close()
+	waitListening(t, "localhost:1354")
+
+	err := g.New("lease", "one", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two writers read the same version, only the first write lands
+	a := NewClient("localhost:1354", "key")
+	b := NewClient("localhost:1354", "key")
+	_, current, err := a.Latest("lease")
+	if err != nil || current != 1 {
+		t.Fatal(errors.New("lease is not at version 1"))
+	}
+	err = a.SetVersion("lease", "a", current)
+	if err != nil {
+		t.Error(err)
+	}
+	err = b.SetVersion("lease", "b", current)
+	if err != ErrConflict {
+		t.Error(errors.New("stale write was not refused"))
+	}
+
+	v, current, err := b.Latest("lease")
+	if err != nil || v != "a" || current != 2 {
+		t.Error(errors.New("lease is not a at version 2"))
+	}
+
+	_, err = g.SetVersion("lease", "c", "other", current)
+	if err == nil || err == ErrConflict {
+		t.Error(errors.New("conditional write skipped the permission check"))
+	}
+}
+
+func TestVersionsAfterDelete(t *testing.T) {
+	g := NewServer()
+
+	err := g.New("token", "one", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.Set("token", "two", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.Delete("token", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Whoever held version 2 must not take the new object for the old one
+	err = g.New("token", "three", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, current, err := g.GetVersion("token", "key", 0)
+	if err != nil || current != 3 {
+		t.Errorf("made again at version %d", current)
+	}
+	_, err = g.SetVersion("token", "four", "key", 2)
+	if err != ErrConflict {
+		t.Error(errors.New("write against the deleted object went through"))
+	}
+}
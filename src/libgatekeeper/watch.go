@@ -0,0 +1,82 @@
+package libgatekeeper
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// watchTimeout is the longest a watch waits for a change before answering
+var watchTimeout = 30 * time.Second
+
+// notify wakes up everybody watching for changes. It must be called with the
+// lock held, right after the change
+func (g *Server) notify() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// Watch waits until item has a version newer than since, and returns it. If
+// nothing changes before the timeout, changed is false. A negative since
+// returns the latest version straight away
+func (g *Server) Watch(item, key string, since int, timeout time.Duration) (value string, current int, changed bool, err error) {
+	deadline := time.After(timeout)
+
+	for {
+		g.lock.Lock()
+		o, found := g.objects[item]
+		if !found || o.expired() || !g.canRead(item, key) {
+			g.lock.Unlock()
+			err = errors.New("No Such Item or Permission Denied")
+			return
+		}
+
+		v, _ := o.find(0)
+		if v.Number > since {
+			g.lock.Unlock()
+			return v.Value, v.Number, true, nil
+		}
+		wait := g.changed
+		g.lock.Unlock()
+
+		select {
+		case <-wait:
+		case <-deadline:
+			return "", v.Number, false, nil
+		}
+	}
+}
+
+func (g *Server) watch(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	item := itemPath(r.URL.Path, "/watch/")
+	log.Print(item)
+	log.Print("Handling")
+
+	since, err := strconv.Atoi(r.FormValue("version"))
+
+	var v string
+	var current int
+	changed := false
+	if err == nil {
+		v, current, changed, err = g.Watch(item, key, since, watchTimeout)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("X-Gatekeeper-Version", strconv.Itoa(current))
+	if !changed {
+		w.WriteHeader(304)
+		return
+	}
+	w.WriteHeader(200)
+	io.WriteString(w, v)
+}
@@ -0,0 +1,112 @@
+package libgatekeeper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchTimeout(t *testing.T) {
+	g := NewServer()
+
+	err := g.New("token", "one", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, current, changed, err := g.Watch("token", "key", 1, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed || current != 1 {
+		t.Error("watch saw a change that never happened")
+	}
+
+	_, _, _, err = g.Watch("token", "stranger", 1, 10*time.Millisecond)
+	if err == nil {
+		t.Error("stranger could watch token")
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	g := NewServer()
+	go g.Listen("localhost:1343")
+	defer g.Close()
+	waitListening(t, "localhost:1343")
+
+	c := NewClient("localhost:1343", "key")
+	err := c.New("token", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, stop := c.Watch("token")
+	defer stop()
+	time.Sleep(200 * time.Millisecond)
+
+	err = c.Set("token", "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case v := <-values:
+		if v != "two" {
+			t.Error("watched value is: " + v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch never saw the new value")
+	}
+
+	err = c.Delete("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, open := <-values:
+		if open {
+			t.Error("watch carried on after the item was deleted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch never noticed the delete")
+	}
+}
+
+func TestClientWatchStop(t *testing.T) {
+	defer func(d time.Duration) { watchTimeout = d }(watchTimeout)
+	watchTimeout = 100 * time.Millisecond
+
+	g := NewServer()
+	go g.Listen("localhost:1355")
+	defer g.Close()
+	waitListening(t, "localhost:1355")
+
+	c := NewClient("localhost:1355", "key")
+	err := c.New("token", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, stop := c.Watch("token")
+	time.Sleep(200 * time.Millisecond)
+
+	// A change nobody reads doesn't hold the watch up
+	err = c.Set("token", "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	stop()
+	stop()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case _, open := <-values:
+			if !open {
+				return
+			}
+		case <-deadline:
+			t.Fatal("watch carried on after being stopped")
+		}
+	}
+}
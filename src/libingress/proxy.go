@@ -0,0 +1,271 @@
+package libingress
+
+import (
+	"common"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The ingress is a reverse proxy in front of the deployed containers. Routes
+// from the bonesFile pick a container by hostname and path, and requests are
+// spread round robin over every instance of it that is up. Update swaps in a
+// new configuration without touching the listener, so requests in flight
+// carry on to the backend they started with.
+
+// healthInterval is how often every backend is checked
+var healthInterval = 5 * time.Second
+
+// healthTimeout is how long a backend has to answer a check
+var healthTimeout = 2 * time.Second
+
+// backend is one instance of a container, with the proxy sending requests to
+// it
+type backend struct {
+	address string
+	health  string
+	proxy   *httputil.ReverseProxy
+
+	lock    sync.Mutex
+	healthy bool
+}
+
+func newBackend(address string) (b *backend) {
+	// New backends take requests until a check says otherwise
+	b = &backend{address: address, healthy: true}
+	b.proxy = &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL.Scheme = "http"
+			out.URL.Host = address
+		},
+		// A backend that fails a request is out until its next check passes
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			b.mark(false)
+			w.WriteHeader(502)
+			io.WriteString(w, "Backend failed")
+		},
+	}
+	return b
+}
+
+func (b *backend) up() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.healthy
+}
+
+func (b *backend) mark(healthy bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.healthy = healthy
+}
+
+// check connects to the backend, or fetches its health path if it has one
+func (b *backend) check() bool {
+	b.lock.Lock()
+	health := b.health
+	b.lock.Unlock()
+
+	if len(health) == 0 {
+		c, err := net.DialTimeout("tcp", b.address, healthTimeout)
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}
+
+	client := http.Client{Timeout: healthTimeout}
+	resp, err := client.Get("http://" + b.address + health)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 500
+}
+
+// route is a Route with the backends it currently has
+type route struct {
+	common.Route
+	backends []*backend
+
+	lock sync.Mutex
+	next int
+}
+
+// pick chooses the next backend that is up, round robin
+func (r *route) pick() *backend {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i := 0; i < len(r.backends); i++ {
+		b := r.backends[(r.next+i)%len(r.backends)]
+		if b.up() {
+			r.next = (r.next + i + 1) % len(r.backends)
+			return b
+		}
+	}
+	return nil
+}
+
+// matches is true if the route takes requests for host and path. Paths match
+// whole segments, so /api takes /api/users but not /apiary
+func (r *route) matches(host, path string) bool {
+	if len(r.Host) > 0 && !strings.EqualFold(r.Host, host) {
+		return false
+	}
+	prefix := strings.TrimSuffix(r.Path, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+type Proxy struct {
+	lock     sync.Mutex
+	routes   []*route
+	backends map[string]*backend
+	done     chan struct{}
+}
+
+func NewProxy() (p *Proxy) {
+	p = new(Proxy)
+	p.backends = make(map[string]*backend)
+	p.done = make(chan struct{})
+	return p
+}
+
+// Update reconfigures the proxy. services maps container names to their ip:port
+// endpoints, as in the orchestrator's service catalog. Backends that were
+// already known keep their health
+func (p *Proxy) Update(routes []common.Route, services map[string][]string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	backends := make(map[string]*backend)
+	updated := []*route{}
+	for _, r := range routes {
+		if len(r.Path) == 0 {
+			r.Path = "/"
+		}
+		nr := &route{Route: r}
+
+		for _, endpoint := range services[r.Container] {
+			_, port, err := net.SplitHostPort(endpoint)
+			if err != nil || (r.Port > 0 && port != strconv.Itoa(r.Port)) {
+				continue
+			}
+
+			b, found := backends[endpoint]
+			if !found {
+				b, found = p.backends[endpoint]
+			}
+			if !found {
+				b = newBackend(endpoint)
+			}
+			b.lock.Lock()
+			b.health = r.Health
+			b.lock.Unlock()
+			backends[endpoint] = b
+			nr.backends = append(nr.backends, b)
+		}
+		updated = append(updated, nr)
+	}
+
+	// Hostnames beat the catch all, then the longest path wins
+	sort.SliceStable(updated, func(i, j int) bool {
+		if (len(updated[i].Host) > 0) != (len(updated[j].Host) > 0) {
+			return len(updated[i].Host) > 0
+		}
+		return len(updated[i].Path) > len(updated[j].Path)
+	})
+
+	p.routes = updated
+	p.backends = backends
+}
+
+// match finds the route for a request
+func (p *Proxy) match(r *http.Request) *route {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, rt := range p.routes {
+		if rt.matches(host, r.URL.Path) {
+			return rt
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt := p.match(r)
+	if rt == nil {
+		w.WriteHeader(404)
+		io.WriteString(w, "No route")
+		return
+	}
+
+	b := rt.pick()
+	if b == nil {
+		w.WriteHeader(503)
+		io.WriteString(w, "No backend up for "+rt.Container)
+		return
+	}
+
+	b.proxy.ServeHTTP(w, r)
+}
+
+// CheckHealth checks every backend once
+func (p *Proxy) CheckHealth() {
+	p.lock.Lock()
+	backends := []*backend{}
+	for _, b := range p.backends {
+		backends = append(backends, b)
+	}
+	p.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			b.mark(b.check())
+		}(b)
+	}
+	wg.Wait()
+}
+
+// StartHealthChecks checks the backends every healthInterval until the proxy
+// is closed
+func (p *Proxy) StartHealthChecks() {
+	t := time.NewTicker(healthInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+			p.CheckHealth()
+		}
+	}
+}
+
+// Close stops the health checks
+func (p *Proxy) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+}
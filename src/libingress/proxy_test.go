@@ -0,0 +1,105 @@
+package libingress
+
+import (
+	"common"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func backendServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+}
+
+func get(t *testing.T, p *Proxy, host, path string) (int, string) {
+	r := httptest.NewRequest("GET", "http://"+host+path, nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	b, err := ioutil.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, string(b)
+}
+
+func address(s *httptest.Server) string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+func TestProxy(t *testing.T) {
+	web1 := backendServer("web1")
+	defer web1.Close()
+	web2 := backendServer("web2")
+	defer web2.Close()
+	api := backendServer("api")
+	defer api.Close()
+
+	p := NewProxy()
+	defer p.Close()
+	routes := []common.Route{
+		{Container: "web"},
+		{Path: "/api", Container: "api"},
+		{Host: "admin.example.com", Container: "admin"},
+	}
+	p.Update(routes, map[string][]string{
+		"web": {address(web1), address(web2)},
+		"api": {address(api)},
+	})
+
+	// Requests are spread over both instances
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		code, body := get(t, p, "example.com", "/")
+		if code != 200 {
+			t.Fatal(code, body)
+		}
+		seen[body] = true
+	}
+	if !seen["web1"] || !seen["web2"] {
+		t.Error("requests were not balanced: ", seen)
+	}
+
+	code, body := get(t, p, "example.com", "/api/users")
+	if code != 200 || body != "api" {
+		t.Error("api route gave ", code, body)
+	}
+
+	// Paths match whole segments
+	code, body = get(t, p, "example.com", "/apiary")
+	if code != 200 || body == "api" {
+		t.Error("/apiary went to ", body)
+	}
+
+	code, _ = get(t, p, "admin.example.com:8080", "/")
+	if code != 503 {
+		t.Error("a route without backends gave ", code)
+	}
+
+	// A backend that goes down stops getting requests after a check
+	web1.Close()
+	p.CheckHealth()
+	for i := 0; i < 4; i++ {
+		code, body := get(t, p, "example.com", "/")
+		if code != 200 || body != "web2" {
+			t.Fatal("with web1 down got ", code, body)
+		}
+	}
+
+	// Updates take effect straight away
+	p.Update(routes[:1], map[string][]string{"web": {address(api)}})
+	code, body = get(t, p, "example.com", "/api")
+	if code != 200 || body != "api" {
+		t.Error("after update got ", code, body)
+	}
+
+	p.Update(nil, nil)
+	code, _ = get(t, p, "example.com", "/")
+	if code != 404 {
+		t.Error("without routes got ", code)
+	}
+}
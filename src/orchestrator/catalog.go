@@ -0,0 +1,261 @@
+package main
+
+import (
+	"common"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// serviceItem is the gatekeeper item the service catalog is kept below, one
+// item per container name holding its endpoints a line each
+const serviceItem = "service"
+
+// dnsDomain is the domain the orchestrator serves DNS for, so containers can
+// reach each other as web.skeleton
+const dnsDomain = "skeleton"
+
+// catalogInterval is how often the leader brings the catalog up to date
+var catalogInterval = 10 * time.Second
+
+// catalog maps the name of every deployed container to the ip:port
+// endpoints its published ports are reachable on
+func (o *orchestrator) catalog(current map[string]*common.Docker) map[string][]string {
+	o.stateLock.Lock()
+	deployment := o.deployment
+	o.stateLock.Unlock()
+
+	services := make(map[string][]string)
+	if deployment == nil {
+		return services
+	}
+
+	for ip, mInfo := range current {
+		for _, C := range mInfo.Containers {
+			name := common.ImageBaseName(C.Image)
+			_, deployed := deployment.Containers[name]
+			if deployed {
+				services[name] = append(services[name], C.Endpoints(ip)...)
+			}
+		}
+	}
+	for _, endpoints := range services {
+		sort.Strings(endpoints)
+	}
+	return services
+}
+
+// StartCatalog keeps the service catalog in the gatekeeper and in DNS in line
+// with what is running, for as long as we lead. Standbys serve the catalog the
+// leader publishes in DNS, so containers can use any orchestrator to resolve
+func (o *orchestrator) StartCatalog() {
+	var published map[string]string
+
+	for ; ; time.Sleep(catalogInterval) {
+		o.trustDNS()
+
+		if o.leader() != o.D.GetIP() {
+			published = nil
+			o.followCatalog()
+			continue
+		}
+
+		// A new leader doesn't know what the last one published
+		if published == nil {
+			var err error
+			published, err = o.publishedCatalog()
+			if err != nil {
+				o.logger.Print(err)
+				continue
+			}
+		}
+
+		services := o.catalog(<-o.deploystate)
+		o.stateLock.Lock()
+		o.services = services
+		o.stateLock.Unlock()
+		o.dns.Update(services)
+
+		err := o.publishCatalog(services, published)
+		if err != nil {
+			o.logger.Print(err)
+		}
+	}
+}
+
+// followCatalog serves the catalog in the gatekeeper in DNS
+func (o *orchestrator) followCatalog() {
+	c := o.client()
+	if c == nil {
+		return
+	}
+
+	names, err := c.List(serviceItem)
+	if err != nil {
+		o.logger.Print(err)
+		return
+	}
+	services := make(map[string][]string)
+	for _, name := range names {
+		v, err := c.Get(serviceItem + "/" + name)
+		if err != nil {
+			o.logger.Print(err)
+			return
+		}
+		if len(v) > 0 {
+			services[name] = strings.Split(v, "\n")
+		}
+	}
+
+	o.stateLock.Lock()
+	o.services = services
+	o.stateLock.Unlock()
+	o.dns.Update(services)
+}
+
+// trustDNS lets the containers on this machine and the machines of the
+// deployment have names outside the DNS domain resolved. The orchestrator
+// runs on the docker bridge, so the network of its own interfaces is the
+// bridge subnet. The gateway is left out, as docker's userland proxy hands it
+// queries from anywhere
+func (o *orchestrator) trustDNS() {
+	networks := []string{}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		o.logger.Print(err)
+	}
+	for _, i := range interfaces {
+		if i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			o.logger.Print(err)
+			continue
+		}
+		for _, addr := range addrs {
+			networks = append(networks, addr.String())
+		}
+	}
+
+	o.stateLock.Lock()
+	if o.deployment != nil {
+		networks = append(networks, o.deployment.Machines.Ip...)
+	}
+	o.stateLock.Unlock()
+
+	err = o.dns.Trust(networks)
+	if err != nil {
+		o.logger.Print(err)
+	}
+	gateway := common.Gateway("/proc/net/route")
+	if len(gateway) > 0 {
+		err = o.dns.Exclude([]string{gateway})
+		if err != nil {
+			o.logger.Print(err)
+		}
+	}
+}
+
+// resolvers are the orchestrators the containers of d use for DNS, this one
+// first. skeleton starts one on each of the first common.OrchestratorReplicas
+// machines
+func (o *orchestrator) resolvers(d *common.SkeletonDeployment) []string {
+	ips := []string{o.D.GetIP()}
+	for _, ip := range d.Machines.Ip {
+		if len(ips) >= common.OrchestratorReplicas {
+			break
+		}
+		if !contains(ips, ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// publishedCatalog makes sure the catalog item is ours and readable by the
+// containers, and lists the services in it
+func (o *orchestrator) publishedCatalog() (published map[string]string, err error) {
+	err = o.claim(serviceItem)
+	if err != nil {
+		return
+	}
+	err = o.grantContainers(serviceItem)
+	if err != nil {
+		return
+	}
+
+	names, err := o.client().List(serviceItem)
+	if err != nil {
+		return
+	}
+	published = make(map[string]string)
+	for _, name := range names {
+		published[name], err = o.client().Get(serviceItem + "/" + name)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// publishCatalog writes the services that changed and deletes the ones that
+// are gone, keeping published up to date with what was written. Nothing is
+// written unless the catalog item is still ours
+func (o *orchestrator) publishCatalog(services map[string][]string, published map[string]string) (err error) {
+	err = o.claim(serviceItem)
+	if err != nil {
+		return
+	}
+	for name, endpoints := range services {
+		value := strings.Join(endpoints, "\n")
+		old, found := published[name]
+		if found && old == value {
+			continue
+		}
+		err = o.store(serviceItem+"/"+name, value)
+		if err != nil {
+			return
+		}
+		published[name] = value
+	}
+
+	for name, _ := range published {
+		_, running := services[name]
+		if running {
+			continue
+		}
+		err = o.client().Delete(serviceItem + "/" + name)
+		if err != nil {
+			return
+		}
+		delete(published, name)
+	}
+	return
+}
+
+// handleServices hands out the catalog as JSON, or the endpoints of a single
+// service with ?name=
+func (o *orchestrator) handleServices(w http.ResponseWriter, r *http.Request) {
+	o.stateLock.Lock()
+	defer o.stateLock.Unlock()
+
+	var v interface{} = o.services
+	name := r.FormValue("name")
+	if len(name) > 0 {
+		endpoints, found := o.services[name]
+		if !found {
+			w.WriteHeader(404)
+			io.WriteString(w, "No Such Service")
+			return
+		}
+		v = endpoints
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"libgatekeeper"
+	"testing"
+)
+
+func TestPublishCatalog(t *testing.T) {
+	g := startGatekeeper(t, "localhost:1366")
+	defer g.Close()
+	o := testOrchestrator("10.0.0.1", "localhost:1366")
+
+	published, err := o.publishedCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = o.addContainerKey("container")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	services := map[string][]string{"web": {"10.0.0.1:49153", "10.0.0.2:49160"}}
+	err = o.publishCatalog(services, published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := libgatekeeper.NewClient("localhost:1366", "container")
+	v, err := c.Get("service/web")
+	if err != nil || v != "10.0.0.1:49153\n10.0.0.2:49160" {
+		t.Errorf("container read %q, %v", v, err)
+	}
+
+	// Services that are gone are taken out
+	err = o.publishCatalog(map[string][]string{}, published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Get("service/web")
+	if err == nil {
+		t.Error("service/web still published")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"common"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"libgatekeeper"
+)
+
+// containerRole holds the key of every deployed container, and is granted
+// access to the databases so containers can get users of their own
+const containerRole = "containers"
+
+// postgresPort is where the postgresql containers listen
+const postgresPort = "5432"
+
+// addContainerKey puts a container key in the containers role
+func (o *orchestrator) addContainerKey(key string) (err error) {
+	err = o.client().AddMember(containerRole, key)
+	if err != nil {
+		err = o.client().NewRole(containerRole)
+		if err == nil {
+			err = o.client().AddMember(containerRole, key)
+		}
+	}
+	return
+}
+
+// superuserItem is where a database container finds its superuser password.
+// It is read with the container's own key, so the password is never in the
+// container's environment
+func superuserItem(ip string, name string) string {
+	return "key." + ip + "." + name + ".superuser"
+}
+
+// storeSuperuser puts a database container's superuser password where only
+// that container can read it
+func (o *orchestrator) storeSuperuser(ip string, name string, password string) (err error) {
+	key, err := o.client().Get("key." + ip + "." + name)
+	if err != nil {
+		return
+	}
+	err = o.store(superuserItem(ip, name), password)
+	if err != nil {
+		return
+	}
+	return o.client().AddAccess(superuserItem(ip, name), key)
+}
+
+// grantContainers lets every deployed container read item and everything
+// below it, making the containers role if there is none yet
+func (o *orchestrator) grantContainers(item string) (err error) {
+	err = o.client().Grant(item, containerRole, libgatekeeper.Read)
+	if err != nil {
+		err = o.client().NewRole(containerRole)
+		if err == nil {
+			err = o.client().Grant(item, containerRole, libgatekeeper.Read)
+		}
+	}
+	return
+}
+
+// claim makes sure item exists and belongs to the administrator key, so no
+// container can take it over before we publish into it
+func (o *orchestrator) claim(item string) (err error) {
+	p, err := o.client().Inspect(item)
+	if err != nil {
+		err = o.client().New(item, "")
+		if err == nil {
+			p, err = o.client().Inspect(item)
+		}
+	}
+	if err == nil && p.Owner != o.key {
+		err = errors.New("Owned by another key: " + item)
+	}
+	return
+}
+
+// databasePassword makes up the superuser password of a database container
+func databasePassword(kind string) (password string, err error) {
+	if kind != "postgresql" {
+		return "", errors.New("Unsupported database: " + kind)
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	return hex.EncodeToString(b), err
+}
+
+// databaseMachine is the machine whose instance of a database container the
+// gatekeeper hands out users on: the first machine of the deployment running
+// one, counting ip which is about to
+func databaseMachine(d *common.SkeletonDeployment, container string, ip string, instances map[string][]string) string {
+	for _, m := range d.Machines.Ip {
+		if m == ip || contains(instances[container], m) {
+			return m
+		}
+	}
+	return ip
+}
+
+// registerDatabase tells the gatekeeper how to create users on a database
+// container, and lets every container ask for one
+func (o *orchestrator) registerDatabase(ip string, name string, C *common.Container, port string, password string) (err error) {
+	err = C.Inspect()
+	if err != nil {
+		return
+	}
+	bindings := C.NetworkSettings.Ports[port+"/tcp"]
+	if len(bindings) == 0 {
+		return errors.New("Database port not published for " + name)
+	}
+
+	d := libgatekeeper.Database{
+		Address:  ip + ":" + bindings[0]["HostPort"],
+		User:     "postgres",
+		Password: password,
+	}
+	err = o.client().AddDatabase(name, d)
+	if err != nil {
+		return
+	}
+	return o.grantContainers("database/" + name)
+}
+
+// revokeContainer drops the database users a removed container was handed
+func (o *orchestrator) revokeContainer(ip string, name string) (err error) {
+	key, err := o.client().Get("key." + ip + "." + name)
+	if err != nil {
+		return
+	}
+	return o.client().RevokeCredentials(key)
+}
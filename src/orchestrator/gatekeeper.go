@@ -0,0 +1,96 @@
+package main
+
+import (
+	"common"
+)
+
+// gatekeeperReplicas is how many machines run a gatekeeper replica
+const gatekeeperReplicas = 3
+
+// isRunning checks for a container of the named image whatever registry or
+// tag it was started from
+func isRunning(D *common.Docker, name string) (bool, error) {
+	containers, err := D.ListContainers()
+	if err != nil {
+		return false, err
+	}
+	for _, C := range containers {
+		if common.ImageBaseName(C.Image) == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// startGatekeepers makes sure the first few machines each run a gatekeeper
+// replica, joined to the replica set led by the orchestrator's own gatekeeper
+func (o *orchestrator) startGatekeepers(enc *common.EncWriter, ips []string) {
+	leader := <-o.gatekeeperip
+	repoip := <-o.repoip
+	repo_tag := repoip + "/gatekeeper"
+	pushed := false
+
+	for i, ip := range ips {
+		if i >= gatekeeperReplicas {
+			break
+		}
+		if ip == o.D.GetIP() {
+			continue
+		}
+
+		D := common.NewDocker(ip)
+		running, err := isRunning(D, "gatekeeper")
+		if err != nil {
+			enc.SetError(err)
+			continue
+		}
+
+		if !running {
+			// Other machines fetch the gatekeeper image through the index
+			if !pushed {
+				Img := common.NewNamedImage("gatekeeper")
+				err = Img.AddTag(o.D, repo_tag)
+				if err == nil {
+					err = Img.Push(o.D, enc, repo_tag)
+				}
+				if err != nil {
+					enc.SetError(err)
+					return
+				}
+				pushed = true
+			}
+
+			enc.Log("Starting gatekeeper replica on " + ip)
+			Img, err := D.Load(repo_tag)
+			if err != nil {
+				enc.SetError(err)
+				continue
+			}
+			env := []string{"HOST=" + ip, "PEERS=" + leader, "ADMIN_KEY=" + o.key,
+				"PEER_KEY=" + o.peerKey}
+			_, err = Img.Run(D, env, "800")
+			if err != nil {
+				enc.SetError(err)
+				continue
+			}
+		}
+
+		o.addGatekeeper(ip + ":800")
+	}
+}
+
+// addGatekeeper records a replica that containers and our client can use
+func (o *orchestrator) addGatekeeper(address string) {
+	o.stateLock.Lock()
+	defer o.stateLock.Unlock()
+
+	for _, g := range o.gatekeepers {
+		if g == address {
+			return
+		}
+	}
+	o.gatekeepers = append(o.gatekeepers, address)
+	if o.c != nil {
+		o.c.AddReplica(address)
+	}
+}
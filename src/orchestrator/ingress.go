@@ -0,0 +1,85 @@
+package main
+
+import (
+	"common"
+	"encoding/json"
+)
+
+// ingressItem is the gatekeeper item holding the routes from the bonesFile,
+// which the ingress containers read
+const ingressItem = "ingress"
+
+// ingressPort is where the ingress takes requests on every machine
+const ingressPort = "8080"
+
+// publishRoutes hands the routes of a deployment to the ingress containers
+func (o *orchestrator) publishRoutes(routes []common.Route) (err error) {
+	if routes == nil {
+		routes = []common.Route{}
+	}
+	b, err := json.Marshal(routes)
+	if err != nil {
+		return
+	}
+	err = o.claim(ingressItem)
+	if err != nil {
+		return
+	}
+	err = o.store(ingressItem, string(b))
+	if err != nil {
+		return
+	}
+	return o.grantContainers(ingressItem)
+}
+
+// startIngress makes sure every machine runs an ingress container. They pick
+// up new routes and endpoints by themselves, so running ones are left alone
+func (o *orchestrator) startIngress(enc *common.EncWriter, ips []string) {
+	repoip := <-o.repoip
+	repo_tag := repoip + "/ingress"
+	pushed := false
+
+	for _, ip := range ips {
+		D := common.NewDocker(ip)
+		running, err := isRunning(D, "ingress")
+		if err != nil {
+			enc.SetError(err)
+			continue
+		}
+		if running {
+			continue
+		}
+
+		// Other machines fetch the ingress image through the index
+		if !pushed {
+			Img := common.NewNamedImage("ingress")
+			err = Img.AddTag(o.D, repo_tag)
+			if err == nil {
+				err = Img.Push(o.D, enc, repo_tag)
+			}
+			if err != nil {
+				enc.SetError(err)
+				return
+			}
+			pushed = true
+		}
+
+		enc.Log("Starting ingress on " + ip)
+		Img, err := D.Load(repo_tag)
+		if err != nil {
+			enc.SetError(err)
+			continue
+		}
+		env, err := o.BuildEnv(ip, "ingress")
+		if err != nil {
+			enc.SetError(err)
+			continue
+		}
+		D.Dns = []string{o.D.GetIP()}
+		_, err = Img.Run(D, env, ingressPort)
+		if err != nil {
+			enc.SetError(err)
+			continue
+		}
+	}
+}
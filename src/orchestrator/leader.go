@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"libgatekeeper"
+	"net/http"
+	"time"
+)
+
+// leaseItem is the gatekeeper object naming the active orchestrator
+const leaseItem = "orchestrator.lease"
+
+// stateItem keeps a copy of the orchestrator state in the gatekeeper, so a
+// standby taking over starts from where the old leader left off
+const stateItem = "orchestrator.state"
+
+var leaseDuration = 15 * time.Second
+
+type lease struct {
+	Holder string
+}
+
+// StartElection keeps trying to take or renew the lease. Only the holder of
+// the lease acts on API calls, the others send callers on to it
+func (o *orchestrator) StartElection() {
+	<-o.gatekeeperip
+	self := o.D.GetIP()
+
+	o.stateLock.Lock()
+	o.electing = true
+	o.stateLock.Unlock()
+
+	for ; ; time.Sleep(leaseDuration / 3) {
+		started := time.Now()
+		holder, err := o.campaign(self)
+		if err != nil {
+			o.logger.Print(err)
+			continue
+		}
+
+		o.stateLock.Lock()
+		was := o.leaderip
+		o.leaderip = holder
+		if holder == self {
+			o.renewed = started
+		}
+		o.stateLock.Unlock()
+
+		if holder == self && was != self {
+			o.logger.Print("Took over as leader")
+			o.takeOver()
+		} else if holder != was {
+			o.logger.Print("Following leader " + holder)
+		}
+	}
+}
+
+// campaign takes the lease if it is free or has gone stale and renews it if
+// it is ours. It returns whoever holds the lease afterwards.
+//
+// The lease is only written if it is still at the version read, so of two
+// orchestrators racing for it one wins and the other learns who did. A lease
+// has gone stale once this orchestrator has seen it go unrenewed for
+// leaseDuration by its own clock, so the clocks of the machines don't have
+// to agree. It is only called from StartElection
+func (o *orchestrator) campaign(self string) (holder string, err error) {
+	b, err := json.Marshal(lease{self})
+	if err != nil {
+		return
+	}
+
+	current, number, err := o.readLease()
+	if err != nil {
+		// Nobody has held the lease yet, and if somebody beat us to making
+		// it the next round finds out who
+		err = o.client().New(leaseItem, string(b))
+		if err != nil {
+			return
+		}
+		o.leaseVersion = 1
+		o.leaseSeen = time.Now()
+		return self, nil
+	}
+
+	if current.Holder != self && time.Since(o.leaseSeen) < leaseDuration {
+		return current.Holder, nil
+	}
+
+	err = o.client().SetVersion(leaseItem, string(b), number)
+	if err == libgatekeeper.ErrConflict {
+		current, _, err = o.readLease()
+		return current.Holder, err
+	}
+	if err != nil {
+		return
+	}
+	o.leaseVersion = number + 1
+	o.leaseSeen = time.Now()
+	return self, nil
+}
+
+// readLease fetches the lease, and notes when it was last seen to change
+func (o *orchestrator) readLease() (current lease, number int, err error) {
+	v, number, err := o.client().Latest(leaseItem)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(v), &current)
+	if err != nil {
+		return
+	}
+
+	if number != o.leaseVersion {
+		o.leaseVersion = number
+		o.leaseSeen = time.Now()
+	}
+	return
+}
+
+// store writes a gatekeeper object whether or not it exists yet. It is only
+// created when the write failed because it doesn't exist
+func (o *orchestrator) store(item string, value string) (err error) {
+	err = o.client().Set(item, value)
+	if err == nil {
+		return
+	}
+	found, ferr := o.client().Exists(item)
+	if ferr == nil && !found {
+		err = o.client().New(item, value)
+	}
+	return
+}
+
+// takeOver picks up the state the previous leader left in the gatekeeper
+func (o *orchestrator) takeOver() {
+	v, err := o.client().Get(stateItem)
+	if err != nil {
+		return
+	}
+	err = o.restoreState([]byte(v))
+	if err != nil {
+		o.logger.Print(err)
+	}
+}
+
+// leader is the active orchestrator, or "" if none is known. A leader that
+// hasn't renewed its lease for half of leaseDuration stops counting itself,
+// as a standby may take over once the lease has gone unrenewed for all of it
+func (o *orchestrator) leader() string {
+	o.stateLock.Lock()
+	defer o.stateLock.Unlock()
+	if o.leaderip == o.D.GetIP() && time.Since(o.renewed) > leaseDuration/2 {
+		return ""
+	}
+	return o.leaderip
+}
+
+// leading wraps a handler so standbys redirect the call to the leader. Until
+// the gatekeeper is up there is no lease to hold, and the orchestrator acts
+// on calls itself
+func (o *orchestrator) leading(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		leader := o.leader()
+		if len(leader) > 0 && leader != o.D.GetIP() {
+			http.Redirect(w, r, "https://"+leader+":900"+r.URL.RequestURI(), 307)
+			return
+		}
+		if len(leader) == 0 && o.isElecting() {
+			w.WriteHeader(503)
+			io.WriteString(w, "No leader elected")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (o *orchestrator) isElecting() bool {
+	o.stateLock.Lock()
+	defer o.stateLock.Unlock()
+	return o.electing
+}
+
+// handleLeader tells callers which orchestrator is active
+func (o *orchestrator) handleLeader(w http.ResponseWriter, r *http.Request) {
+	leader := o.leader()
+	if len(leader) == 0 {
+		w.WriteHeader(503)
+		io.WriteString(w, "No leader elected")
+		return
+	}
+	io.WriteString(w, leader)
+}
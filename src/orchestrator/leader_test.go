@@ -0,0 +1,173 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"libgatekeeper"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testOrchestrator is an orchestrator on ip that only talks to a gatekeeper
+func testOrchestrator(ip string, gatekeeper string) *orchestrator {
+	return &orchestrator{
+		D:      common.NewDocker(ip),
+		c:      libgatekeeper.NewClient(gatekeeper, "admin"),
+		key:    "admin",
+		logger: log.New(os.Stderr, "orchestrator "+ip+" ", log.LstdFlags),
+	}
+}
+
+func startGatekeeper(t *testing.T, address string) *libgatekeeper.Server {
+	g := libgatekeeper.NewServer()
+	g.SetAdmin("admin")
+	go g.Listen(address)
+	for i := 0; i < 100; i++ {
+		c, err := net.Dial("tcp", address)
+		if err == nil {
+			c.Close()
+			return g
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Nothing listening on " + address)
+	return nil
+}
+
+func TestCampaign(t *testing.T) {
+	g := startGatekeeper(t, "localhost:1360")
+	defer g.Close()
+
+	defer func(d time.Duration) { leaseDuration = d }(leaseDuration)
+	leaseDuration = 200 * time.Millisecond
+
+	a := testOrchestrator("10.0.0.1", "localhost:1360")
+	b := testOrchestrator("10.0.0.2", "localhost:1360")
+
+	holder, err := a.campaign("10.0.0.1")
+	if err != nil || holder != "10.0.0.1" {
+		t.Fatal(errors.New("first orchestrator did not take the free lease"))
+	}
+	holder, err = b.campaign("10.0.0.2")
+	if err != nil || holder != "10.0.0.1" {
+		t.Fatal(errors.New("second orchestrator took a held lease"))
+	}
+
+	// Renewing keeps the lease, however long it has been held
+	time.Sleep(leaseDuration / 2)
+	holder, err = a.campaign("10.0.0.1")
+	if err != nil || holder != "10.0.0.1" {
+		t.Fatal(errors.New("leader lost the lease renewing it"))
+	}
+	time.Sleep(leaseDuration / 2)
+	holder, err = b.campaign("10.0.0.2")
+	if err != nil || holder != "10.0.0.1" {
+		t.Fatal(errors.New("renewed lease was taken over"))
+	}
+
+	// Once nobody renews it a standby takes over, and the old leader follows
+	time.Sleep(2 * leaseDuration)
+	holder, err = b.campaign("10.0.0.2")
+	if err != nil || holder != "10.0.0.2" {
+		t.Fatal(errors.New("standby did not take over a stale lease"))
+	}
+	holder, err = a.campaign("10.0.0.1")
+	if err != nil || holder != "10.0.0.2" {
+		t.Fatal(errors.New("old leader took the lease back"))
+	}
+}
+
+func TestCampaignRace(t *testing.T) {
+	g := startGatekeeper(t, "localhost:1361")
+	defer g.Close()
+
+	defer func(d time.Duration) { leaseDuration = d }(leaseDuration)
+	leaseDuration = 100 * time.Millisecond
+
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	orchestrators := []*orchestrator{}
+	for _, ip := range ips {
+		orchestrators = append(orchestrators, testOrchestrator(ip, "localhost:1361"))
+	}
+
+	for round := 0; round < 5; round++ {
+		// Everyone has seen the lease go stale and goes for it at once
+		for i, o := range orchestrators {
+			o.readLease()
+			o.campaign(ips[i])
+		}
+		time.Sleep(2 * leaseDuration)
+
+		// Who a follower thinks holds the lease may already be out of date,
+		// but only one of them may think it holds the lease itself
+		won := make(chan string)
+		for i, o := range orchestrators {
+			go func(o *orchestrator, ip string) {
+				holder, err := o.campaign(ip)
+				if err != nil || holder != ip {
+					ip = ""
+				}
+				won <- ip
+			}(o, ips[i])
+		}
+
+		winners := []string{}
+		for range ips {
+			ip := <-won
+			if len(ip) > 0 {
+				winners = append(winners, ip)
+			}
+		}
+		if len(winners) > 1 {
+			t.Fatal(errors.New(strings.Join(winners, " and ") + " all hold the lease"))
+		}
+	}
+}
+
+func TestLeaderStopsUnrenewed(t *testing.T) {
+	o := testOrchestrator("10.0.0.1", "localhost:1362")
+	o.leaderip = "10.0.0.1"
+	o.electing = true
+
+	o.renewed = time.Now()
+	if o.leader() != "10.0.0.1" {
+		t.Error(errors.New("freshly renewed leader does not lead"))
+	}
+
+	// A standby could be taking over soon, so the leader stops acting early
+	o.renewed = time.Now().Add(-leaseDuration)
+	if o.leader() != "" {
+		t.Error(errors.New("leader still leads without renewing its lease"))
+	}
+}
+
+func TestStore(t *testing.T) {
+	g := startGatekeeper(t, "localhost:1367")
+	defer g.Close()
+	o := testOrchestrator("10.0.0.1", "localhost:1367")
+
+	for _, value := range []string{"first", "second"} {
+		err := o.store("item", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := o.client().Get("item")
+		if err != nil || v != value {
+			t.Errorf("stored %q, read %q, %v", value, v, err)
+		}
+	}
+
+	// Items a key can't read look missing to it
+	found, err := o.client().Exists("item")
+	if err != nil || !found {
+		t.Error("stored item does not exist")
+	}
+	found, err = libgatekeeper.NewClient("localhost:1367", "container").Exists("item")
+	if err != nil || found {
+		t.Error("another key sees the stored item")
+	}
+}
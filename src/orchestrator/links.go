@@ -0,0 +1,57 @@
+package main
+
+import (
+	"common"
+	"errors"
+)
+
+// containerPorts lists the ports a container publishes
+func containerPorts(spec common.ContainerSpec) []string {
+	if len(spec.Expose) == 0 && len(spec.Database) > 0 {
+		return []string{postgresPort}
+	}
+	return spec.Expose
+}
+
+// runningInstances maps every container of the deployment to the machines it
+// already runs on
+func runningInstances(d *common.SkeletonDeployment, current map[string]*common.Docker) map[string][]string {
+	instances := make(map[string][]string)
+	for ip, mInfo := range current {
+		for _, C := range mInfo.Containers {
+			name := common.ImageBaseName(C.Image)
+			_, deployed := d.Containers[name]
+			if deployed && !contains(instances[name], ip) {
+				instances[name] = append(instances[name], ip)
+			}
+		}
+	}
+	return instances
+}
+
+// linkEnv points a container at an instance of every container it links to,
+// preferring the one on its own machine
+func linkEnv(d *common.SkeletonDeployment, container string, ip string, instances map[string][]string) (env []string, err error) {
+	for _, link := range d.Containers[container].Links {
+		ips := instances[link]
+		if len(ips) == 0 {
+			return nil, errors.New(container + " links to " + link + ", which is not running")
+		}
+
+		chosen := ips[0]
+		if contains(ips, ip) {
+			chosen = ip
+		}
+		env = append(env, common.LinkEnv(container, link, chosen, containerPorts(d.Containers[link]))...)
+	}
+	return
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,7 +13,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,15 +28,37 @@ type orchestrator struct {
 	logger       *log.Logger
 	multiplexer  *common.Multiplexer
 	imageNames   map[string]string
+	imageIds     map[string]string
+	deployment   *common.SkeletonDeployment
+	revisions    []*revision
+	services     map[string][]string
+	dns          *common.DNSServer
+	gatekeepers  []string
+	leaderip     string
+	electing     bool
+	renewed      time.Time
+	leaseVersion int
+	leaseSeen    time.Time
+	stateLock    sync.Mutex
+	saveLock     sync.Mutex
+	statePath    string
 	key          string
+	peerKey      string
 	D            *common.Docker
-	c            *libgatekeeper.Client
+
+	// c is guarded by stateLock, as it is only set once the gatekeeper is up
+	c *libgatekeeper.Client
+}
+
+// client is the gatekeeper client, or nil until the gatekeeper is up
+func (o *orchestrator) client() *libgatekeeper.Client {
+	o.stateLock.Lock()
+	defer o.stateLock.Unlock()
+	return o.c
 }
 
 func (o *orchestrator) StartState() {
 	d := make(map[string]*common.Docker)
-	o.deploystate = make(chan map[string]*common.Docker)
-	o.addip = make(chan string)
 	for {
 		select {
 		case o.deploystate <- d:
@@ -68,19 +94,22 @@ func (o *orchestrator) WaitRefresh(t time.Time) {
 func (o *orchestrator) StartRepository() {
 	o.logger.Print("index setup")
 	registryName := "samalba/docker-registry"
-	o.startImage(registryName, o.repoip, "5000")
+	o.startImage(registryName, o.repoip, "5000", nil)
 }
 
 func (o *orchestrator) StartGatekeeper() {
 	o.logger.Print("gatekeeper setup")
 	registryName := "gatekeeper"
-	o.startImage(registryName, o.gatekeeperip, "800")
+	o.startImage(registryName, o.gatekeeperip, "800", []string{"HOST=" + o.D.GetIP(),
+		"ADMIN_KEY=" + o.key, "PEER_KEY=" + o.peerKey})
 }
 
 func (o *orchestrator) BuildEnv(ip string, container string) ([]string, error) {
-	gid := <-o.gatekeeperip
+	<-o.gatekeeperip
 	env := make([]string, 2)
-	env[0] = "GATEKEEPER=" + gid
+	o.stateLock.Lock()
+	env[0] = "GATEKEEPER=" + strings.Join(o.gatekeepers, ",")
+	o.stateLock.Unlock()
 
 	//Create container key
 	b := make([]byte, 64)
@@ -92,16 +121,36 @@ func (o *orchestrator) BuildEnv(ip string, container string) ([]string, error) {
 		n += t
 	}
 	container_key := hex.EncodeToString(b[0:32])
-	onetime_key := hex.EncodeToString(b[0:32])
-	o.c.Set("key."+ip+"."+container, container_key)
-	o.c.Set("key."+onetime_key, container_key)
-	o.c.SwitchOwner("key."+onetime_key, "")
+	onetime_key := hex.EncodeToString(b[32:64])
+	err := o.store("key."+ip+"."+container, container_key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The one time key expires if the container never redeems it
+	err = o.client().New("key."+onetime_key, container_key)
+	if err != nil {
+		return nil, err
+	}
+	err = o.client().SetTTL("key."+onetime_key, libgatekeeper.OneTimeKeyTTL)
+	if err != nil {
+		return nil, err
+	}
+	err = o.client().SwitchOwner("key."+onetime_key, "")
+	if err != nil {
+		return nil, err
+	}
 	env[1] = "GATEKEEPER_KEY=" + onetime_key
 
+	err = o.addContainerKey(container_key)
+	if err != nil {
+		return nil, err
+	}
+
 	return env, nil
 }
 
-func (o *orchestrator) startImage(registryName string, portchan chan string, port string) {
+func (o *orchestrator) startImage(registryName string, portchan chan string, port string, env []string) {
 	// So that id is passed out of the function
 	Img := &common.Image{}
 
@@ -123,7 +172,7 @@ func (o *orchestrator) startImage(registryName string, portchan chan string, por
 				o.logger.Print(err)
 				continue
 			}
-			C, err = Img.Run(o.D, nil, port)
+			C, err = Img.Run(o.D, env, port)
 			if err != nil {
 				o.logger.Print(err)
 				continue
@@ -175,6 +224,12 @@ func (o *orchestrator) handleImage(w http.ResponseWriter, r *http.Request) {
 			enc.SetError(err)
 			return
 		}
+		// Keep the build tag too so revisions can name this exact image
+		err = Img.TagVersion(o.D, repo_tag, Img.Tag)
+		if err != nil {
+			enc.SetError(err)
+			return
+		}
 		enc.Log("Pushing to index\n")
 		err = Img.Push(o.D, enc, repo_tag)
 		if err != nil {
@@ -182,17 +237,37 @@ func (o *orchestrator) handleImage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		o.imageNames[tag[0]] = repo_tag
+		// The build tag is how other machines fetch the image, and the id
+		// is what makes sure they run this build
+		id, err := o.D.ImageId(Img.GetName())
+		if err != nil {
+			enc.SetError(err)
+			return
+		}
+
+		o.stateLock.Lock()
+		o.imageNames[tag[0]] = repo_tag + ":" + Img.Tag
+		o.imageIds[tag[0]] = id
+		o.stateLock.Unlock()
+		err = o.saveState()
+		if err != nil {
+			enc.SetError(err)
+			return
+		}
 	}
 	enc.Log("built")
 }
 
-func (o *orchestrator) calcUpdate(w io.Writer, desired common.SkeletonDeployment, current map[string]*common.Docker) (update map[string][]string) {
+// calcUpdate works out which containers need starting on which machines, and
+// which running containers are on a different image than the one requested
+func (o *orchestrator) calcUpdate(w io.Writer, desired common.SkeletonDeployment, images map[string]string, current map[string]*common.Docker) (update map[string][]string, stale map[string][]*common.Container) {
 	c := fmt.Sprint(current)
 	io.WriteString(w, c)
 	io.WriteString(w, "\n")
 	// Maps IP's to lists of containers to deploy
 	update = make(map[string][]string)
+	// Maps IP's to containers running the wrong image
+	stale = make(map[string][]*common.Container)
 	// For each container we want to deploy
 	for container, _ := range desired.Containers {
 		// Assuming granularity machine
@@ -206,20 +281,18 @@ func (o *orchestrator) calcUpdate(w io.Writer, desired common.SkeletonDeployment
 			//Check if the container is running
 			for _, checkContainer := range mInfo.Containers {
 
-				imageName := checkContainer.Image
-
-				//Get the actual name
-				if strings.Contains(imageName, "/") {
-					imageName = strings.SplitN(imageName, "/", 2)[1]
-				}
-				if strings.Contains(imageName, ":") {
-					imageName = strings.SplitN(imageName, ":", 2)[0]
+				if common.ImageBaseName(checkContainer.Image) != container {
+					continue
 				}
 
-				if imageName == container {
-					found = true
-					break
+				//Running but on another image, replace it
+				if len(images[container]) > 0 && checkContainer.Image != images[container] {
+					stale[ip] = append(stale[ip], checkContainer)
+					continue
 				}
+
+				found = true
+				break
 			}
 
 			//Do we need to deploy a image?
@@ -230,77 +303,288 @@ func (o *orchestrator) calcUpdate(w io.Writer, desired common.SkeletonDeployment
 		}
 	}
 
-	return update
+	return update, stale
 
 }
 
+// deployUser names whoever asked for a deploy, falling back to their address
+func deployUser(r *http.Request) string {
+	user := r.Header.Get("X-Skeleton-User")
+	if len(user) == 0 {
+		user = r.RemoteAddr
+	}
+	return user
+}
+
 func (o *orchestrator) deploy(w http.ResponseWriter, r *http.Request) {
 	enc := common.NewEncWriter(w)
 	enc.Log("Starting deploy")
-	d := &common.SkeletonDeployment{}
 	c, err := ioutil.ReadAll(r.Body)
 
 	if err != nil {
 		enc.SetError(err)
 		return
 	}
-	err = json.Unmarshal(c, d)
+	d, err := common.Validate(c)
+	if err != nil {
+		enc.SetError(err)
+		return
+	}
+
+	// Pin the images as they are right now so the revision can be replayed
+	images := make(map[string]string)
+	ids := make(map[string]string)
+	o.stateLock.Lock()
+	for container, _ := range d.Containers {
+		images[container] = o.imageNames[container]
+		ids[container] = o.imageIds[container]
+	}
+	o.stateLock.Unlock()
+
+	o.apply(enc, d, images, ids, deployUser(r))
+}
+
+func (o *orchestrator) rollback(w http.ResponseWriter, r *http.Request) {
+	enc := common.NewEncWriter(w)
+	number, err := strconv.Atoi(r.FormValue("revision"))
 	if err != nil {
 		enc.SetError(err)
 		return
 	}
 
+	rev, err := o.getRevision(number)
+	if err != nil {
+		enc.SetError(err)
+		return
+	}
+
+	enc.Log(fmt.Sprintf("Rolling back to revision %d", number))
+	o.apply(enc, &rev.Deployment, rev.Images, rev.ImageIds, deployUser(r))
+}
+
+func (o *orchestrator) history(w http.ResponseWriter, r *http.Request) {
+	o.stateLock.Lock()
+	b, err := json.Marshal(o.revisions)
+	o.stateLock.Unlock()
+
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// apply brings the machines in line with d running exactly the given images,
+// checked against ids where they are known, and records the attempt as a new
+// revision
+func (o *orchestrator) apply(enc *common.EncWriter, d *common.SkeletonDeployment, images map[string]string, ids map[string]string, user string) {
+	o.stateLock.Lock()
+	o.deployment = d
+	o.stateLock.Unlock()
+
+	number, err := o.addRevision(d, images, ids, user)
+	if err != nil {
+		enc.SetError(err)
+		return
+	}
+	enc.Log(fmt.Sprintf("Revision %d", number))
+
+	failures := 0
+	defer func() {
+		outcome := "success"
+		if failures > 0 {
+			outcome = fmt.Sprintf("failed %d", failures)
+		}
+		err := o.finishRevision(number, outcome)
+		if err != nil {
+			enc.SetError(err)
+		}
+	}()
+
+	order, err := common.StartOrder(d)
+	if err != nil {
+		enc.SetError(err)
+		failures++
+		return
+	}
+
 	for _, ip := range d.Machines.Ip {
 		enc.Log("Adding ip\n" + ip + "\n")
 		o.addip <- ip
 	}
+	o.startGatekeepers(enc, d.Machines.Ip)
+
+	// The items we publish into are ours before any container could take them
+	for _, item := range []string{serviceItem, ingressItem} {
+		err = o.claim(item)
+		if err != nil {
+			enc.SetError(err)
+			failures++
+			return
+		}
+	}
 	enc.Log("Waiting for image refreshes")
 	o.WaitRefresh(time.Now())
 	enc.Log("waited")
 
 	current := <-o.deploystate
 
-	diff := o.calcUpdate(enc, *d, current)
+	diff, stale := o.calcUpdate(enc, *d, images, current)
 
 	sdiff := fmt.Sprint(diff)
 	enc.Log("Diff")
 	enc.Log(sdiff)
 
-	enc.Log("Deploying diff")
-	for ip, images := range diff {
-		for _, container := range images {
-			D := common.NewDocker(ip)
-			Img := &common.Image{}
-
-			enc.Log("Deploying " + container + " on " + ip)
-			enc.Log("Indexname " + o.imageNames[container] + "\n")
-			Img, err := D.Load(o.imageNames[container])
+	for ip, containers := range stale {
+		for _, C := range containers {
+			enc.Log("Replacing " + C.Image + " on " + ip)
+			err = C.Stop()
 			if err != nil {
 				enc.SetError(err)
+				failures++
 				continue
 			}
+			C.Delete()
 
-			//Sets environment variables, especially the gatekeeper key
-			env, err := o.BuildEnv(ip, container)
+			err = o.revokeContainer(ip, common.ImageBaseName(C.Image))
 			if err != nil {
-				enc.SetError(err)
-				continue
+				enc.Log("Database users not revoked: " + err.Error())
+			}
+		}
+	}
+
+	// Containers start after the ones they link to or depend on
+	instances := runningInstances(d, current)
+	ips := []string{}
+	for ip, _ := range diff {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	enc.Log("Deploying diff")
+	up := make(map[string]error)
+	for _, container := range order {
+		targets := []string{}
+		for _, ip := range ips {
+			if contains(diff[ip], container) {
+				targets = append(targets, ip)
 			}
+		}
+		if len(targets) == 0 {
+			continue
+		}
 
-			expose_port := ""
-			if len(d.Containers[container].Expose) > 0 {
-				expose_port = d.Containers[container].Expose[0]
+		// Dependencies have to be up before their dependents start
+		var blocked error
+		for _, dependency := range d.Containers[container].Dependencies() {
+			_, checked := up[dependency]
+			if !checked {
+				up[dependency] = o.waitReady(enc, d, dependency, instances[dependency])
 			}
+			if up[dependency] != nil {
+				blocked = up[dependency]
+			}
+		}
 
-			C, err := Img.Run(D, env, expose_port)
+		for _, ip := range targets {
+			if blocked != nil {
+				enc.SetError(blocked)
+				failures++
+				continue
+			}
+			err = o.deployContainer(enc, d, images, ids, instances, ip, container)
 			if err != nil {
 				enc.SetError(err)
+				failures++
 				continue
 			}
+			if !contains(instances[container], ip) {
+				instances[container] = append(instances[container], ip)
+			}
+		}
+	}
+
+	err = o.publishRoutes(d.Routes)
+	if err != nil {
+		enc.SetError(err)
+		failures++
+	}
+	if len(d.Routes) > 0 {
+		o.startIngress(enc, d.Machines.Ip)
+	}
+}
+
+// deployContainer starts a container on a machine. The image is fetched by
+// name, and refused if the name has come to point at another image than the
+// id pinned for it
+func (o *orchestrator) deployContainer(enc *common.EncWriter, d *common.SkeletonDeployment, images map[string]string, ids map[string]string, instances map[string][]string, ip string, container string) (err error) {
+	D := common.NewDocker(ip)
+	D.Dns = o.resolvers(d)
+	Img := &common.Image{}
+	spec := d.Containers[container]
 
-			enc.Log("Deployed\n" + C.Id + "\n")
+	enc.Log("Deploying " + container + " on " + ip)
+	enc.Log("Indexname " + images[container] + "\n")
+	Img, err = D.Load(images[container])
+	if err != nil {
+		return
+	}
+	if len(ids[container]) > 0 {
+		var id string
+		id, err = D.ImageId(images[container])
+		if err != nil {
+			return
+		}
+		if id != ids[container] {
+			return errors.New(images[container] + " is image " + id + " not " + ids[container])
 		}
 	}
+
+	//Sets environment variables, especially the gatekeeper key
+	env, err := o.BuildEnv(ip, container)
+	if err != nil {
+		return
+	}
+
+	links, err := linkEnv(d, container, ip, instances)
+	if err != nil {
+		return
+	}
+	env = append(env, links...)
+
+	// Database containers get a superuser only the gatekeeper knows, and
+	// read its password from the gatekeeper with their own key
+	ports := containerPorts(spec)
+	password := ""
+	if len(spec.Database) > 0 {
+		password, err = databasePassword(spec.Database)
+		if err != nil {
+			return
+		}
+		err = o.storeSuperuser(ip, container, password)
+		if err != nil {
+			return
+		}
+		env = append(env, "POSTGRES_PASSWORD_ITEM="+superuserItem(ip, container))
+	}
+
+	C, err := Img.Run(D, env, ports...)
+	if err != nil {
+		return
+	}
+
+	// Only one instance is registered, or the last one deployed would win
+	if len(password) > 0 && databaseMachine(d, container, ip, instances) == ip {
+		err = o.registerDatabase(ip, container, C, ports[0], password)
+		if err != nil {
+			return
+		}
+	}
+
+	enc.Log("Deployed\n" + C.Id + "\n")
+	return nil
 }
 
 func NewOrchestrator() (o *orchestrator) {
@@ -311,17 +595,100 @@ func NewOrchestrator() (o *orchestrator) {
 	o.multiplexer = common.NewMultiplexer()
 	o.logger = log.New(o.multiplexer, "", 0)
 	o.imageNames = make(map[string]string)
-	o.key = "orchestrator_key"
+	o.imageIds = make(map[string]string)
+	o.deploystate = make(chan map[string]*common.Docker)
+	o.addip = make(chan string)
+	o.dns = common.NewDNSServer(dnsDomain, common.Nameserver("/etc/resolv.conf"))
+
+	o.statePath = os.Getenv("STATE")
+	if len(o.statePath) == 0 {
+		o.statePath = defaultStatePath
+	}
+	err := o.loadState()
+	if err != nil {
+		o.logger.Print(err)
+	}
+	o.trustDNS()
+
+	// The orchestrator is the gatekeeper administrator, and the gatekeeper
+	// replicas only replicate with holders of the peer key. skeleton hands
+	// every orchestrator of a deployment the same keys, and once they are in
+	// the state file they stay
+	o.key, err = deploymentKey(o.key, "ADMIN_KEY")
+	if err != nil {
+		o.logger.Fatal(err)
+	}
+	o.peerKey, err = deploymentKey(o.peerKey, "PEER_KEY")
+	if err != nil {
+		o.logger.Fatal(err)
+	}
+
 	go o.StartState()
-	go o.StartRepository()
-	go o.StartGatekeeper()
+
+	// Pick the machines of the last deployment back up
+	if o.deployment != nil {
+		go func(ips []string) {
+			for _, ip := range ips {
+				o.addip <- ip
+			}
+		}(o.deployment.Machines.Ip)
+	}
+
+	// Standbys share the registry and gatekeeper the first orchestrator started
+	if len(os.Getenv("REGISTRY")) > 0 {
+		go useAddress(o.repoip, os.Getenv("REGISTRY"))
+	} else {
+		go o.StartRepository()
+	}
+	if len(os.Getenv("GATEKEEPER")) > 0 {
+		go useAddress(o.gatekeeperip, strings.Split(os.Getenv("GATEKEEPER"), ",")[0])
+	} else {
+		go o.StartGatekeeper()
+	}
+
 	go func() {
 		gatekeeperip := <-o.gatekeeperip
-		o.c = libgatekeeper.NewClient(gatekeeperip, o.key)
+		if len(os.Getenv("GATEKEEPER")) > 0 {
+			gatekeeperip = os.Getenv("GATEKEEPER")
+		}
+		o.stateLock.Lock()
+		// Replicas started before the client was made are kept
+		gatekeepers := strings.Split(gatekeeperip, ",")
+		for _, g := range o.gatekeepers {
+			if !contains(gatekeepers, g) {
+				gatekeepers = append(gatekeepers, g)
+			}
+		}
+		o.gatekeepers = gatekeepers
+		o.c = libgatekeeper.NewClient(strings.Join(o.gatekeepers, ","), o.key)
+		o.stateLock.Unlock()
+		go o.StartCatalog()
+		o.StartElection()
 	}()
 	return o
 }
 
+// deploymentKey is the key already in the state, else the one in the variable
+// skeleton passes, else a new one
+func deploymentKey(current string, variable string) (key string, err error) {
+	key = current
+	if len(key) == 0 {
+		key = os.Getenv(variable)
+	}
+	if len(key) == 0 {
+		key, err = common.RandomKey()
+	}
+	return
+}
+
+// useAddress hands out the address of a service somebody else started, in
+// place of startImage
+func useAddress(portchan chan string, address string) {
+	for {
+		portchan <- address
+	}
+}
+
 func status(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "status page")
 }
@@ -329,14 +696,37 @@ func status(w http.ResponseWriter, r *http.Request) {
 func main() {
 
 	o := NewOrchestrator()
-        
+
 	http.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
-		io.WriteString(w, "orchestrator v0")
+		io.WriteString(w, "orchestrator "+common.Version)
 	})
 
-	http.HandleFunc("/image", o.handleImage)
+	http.HandleFunc("/image", o.leading(o.handleImage))
+
+	http.HandleFunc("/deploy", o.leading(o.deploy))
+
+	http.HandleFunc("/history", o.leading(o.history))
+
+	http.HandleFunc("/rollback", o.leading(o.rollback))
+
+	// A handover puts the state into the orchestrator it was sent to, which
+	// may not lead yet
+	state := o.leading(o.handleState)
+	http.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			o.handleState(w, r)
+			return
+		}
+		state(w, r)
+	})
+
+	http.HandleFunc("/services", o.leading(o.handleServices))
+
+	http.HandleFunc("/leader", o.handleLeader)
+
+	go func() {
+		o.logger.Print(o.dns.ListenAndServe(":53"))
+	}()
 
-	http.HandleFunc("/deploy", o.deploy)
-        
 	o.logger.Fatal(common.CustomListenAndServeTLS(http.DefaultServeMux))
 }
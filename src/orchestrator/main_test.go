@@ -0,0 +1,150 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"io/ioutil"
+	"libgatekeeper"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCalcUpdateStale(t *testing.T) {
+	d := common.SkeletonDeployment{}
+	d.Machines.Ip = []string{"10.0.0.1", "10.0.0.2"}
+	d.Containers = map[string]common.ContainerSpec{"web": {}, "db": {}}
+
+	old := &common.Container{Image: "10.0.0.1:5000/web:1"}
+	current := map[string]*common.Docker{
+		"10.0.0.1": {Containers: []*common.Container{
+			old,
+			{Image: "10.0.0.1:5000/db:1"},
+			{Image: "10.0.0.1:5000/other:1"},
+		}},
+		"10.0.0.2": {Containers: []*common.Container{
+			{Image: "10.0.0.1:5000/web:2"},
+		}},
+	}
+	images := map[string]string{
+		"web": "10.0.0.1:5000/web:2",
+		"db":  "10.0.0.1:5000/db:1",
+	}
+
+	o := &orchestrator{}
+	update, stale := o.calcUpdate(ioutil.Discard, d, images, current)
+
+	// The old web is replaced, the db that is up to date and the container
+	// nobody asked for are left alone
+	if len(stale["10.0.0.1"]) != 1 || stale["10.0.0.1"][0] != old || len(stale["10.0.0.2"]) != 0 {
+		t.Error(errors.New("stale containers are wrong"))
+	}
+	if !reflect.DeepEqual(update["10.0.0.1"], []string{"web"}) {
+		t.Error("10.0.0.1 gets ", update["10.0.0.1"])
+	}
+	if !reflect.DeepEqual(update["10.0.0.2"], []string{"db"}) {
+		t.Error("10.0.0.2 gets ", update["10.0.0.2"])
+	}
+}
+
+func TestRollback(t *testing.T) {
+	g := startGatekeeper(t, "localhost:1363")
+	defer g.Close()
+
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := testOrchestrator("10.0.0.1", "localhost:1363")
+	o.statePath = dir + "/orchestrator.json"
+	o.repoip = make(chan string)
+	o.gatekeeperip = make(chan string)
+	o.addip = make(chan string)
+	o.deploystate = make(chan map[string]*common.Docker)
+	go useAddress(o.repoip, "10.0.0.1:5000")
+	go useAddress(o.gatekeeperip, "localhost:1363")
+
+	// The only machine already runs the first revision's web, so rolling
+	// back to it deploys nothing and only the bookkeeping happens
+	go func() {
+		s := map[string]*common.Docker{"10.0.0.1": {
+			Updated:    time.Now().Add(time.Hour),
+			Containers: []*common.Container{{Image: "10.0.0.1:5000/web:1"}},
+		}}
+		for {
+			o.deploystate <- s
+		}
+	}()
+
+	first := &common.SkeletonDeployment{}
+	first.Containers = map[string]common.ContainerSpec{"web": {}}
+	o.apply(common.NewEncWriter(ioutil.Discard), first,
+		map[string]string{"web": "10.0.0.1:5000/web:1"},
+		map[string]string{"web": "1111"}, "alice")
+
+	second := &common.SkeletonDeployment{}
+	second.Containers = map[string]common.ContainerSpec{"web": {}, "db": {}}
+	_, err = o.addRevision(second,
+		map[string]string{"web": "10.0.0.1:5000/web:2", "db": "10.0.0.1:5000/db:2"},
+		map[string]string{"web": "2222", "db": "3333"}, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.deployment = second
+
+	w := httptest.NewRecorder()
+	o.rollback(w, httptest.NewRequest("POST", "/rollback?revision=1", nil))
+
+	// The rollback is a new revision replaying the first one's images
+	if len(o.revisions) != 3 {
+		t.Fatalf("%d revisions after a rollback", len(o.revisions))
+	}
+	rev := o.revisions[2]
+	if !reflect.DeepEqual(rev.Deployment, *first) ||
+		!reflect.DeepEqual(rev.Images, o.revisions[0].Images) ||
+		!reflect.DeepEqual(rev.ImageIds, o.revisions[0].ImageIds) {
+		t.Error(errors.New("rollback did not replay revision 1"))
+	}
+	if rev.Outcome != "success" {
+		t.Error("rollback outcome is " + rev.Outcome)
+	}
+	if !reflect.DeepEqual(o.deployment, first) {
+		t.Error(errors.New("rollback did not bring back the deployment"))
+	}
+
+	// Revisions that never happened can't be rolled back to
+	w = httptest.NewRecorder()
+	o.rollback(w, httptest.NewRequest("POST", "/rollback?revision=4", nil))
+	if len(o.revisions) != 3 {
+		t.Error(errors.New("rolled back to a revision that doesn't exist"))
+	}
+}
+
+func TestClaim(t *testing.T) {
+	g := startGatekeeper(t, "localhost:1364")
+	defer g.Close()
+	o := testOrchestrator("10.0.0.1", "localhost:1364")
+
+	err := o.claim(ingressItem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = o.claim(ingressItem)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Items a container made first are refused
+	err = libgatekeeper.NewClient("localhost:1364", "container").New("routes", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = o.claim("routes")
+	if err == nil {
+		t.Error(errors.New("claimed an item owned by another key"))
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// readyTimeout is how long a dependency has to come up before the containers
+// depending on it are given up on
+var readyTimeout = 2 * time.Minute
+
+var readyInterval = time.Second
+
+// ready checks a container on a machine is up. Containers with a health path
+// must answer it, the others must take connections on all their tcp ports
+func ready(ip string, spec common.ContainerSpec) bool {
+	ports := []string{}
+	for _, port := range containerPorts(spec) {
+		if !strings.HasSuffix(port, "/udp") {
+			ports = append(ports, strings.TrimSuffix(port, "/tcp"))
+		}
+	}
+	if len(ports) == 0 {
+		return true
+	}
+
+	if len(spec.Health) > 0 {
+		client := http.Client{Timeout: readyInterval}
+		resp, err := client.Get("http://" + ip + ":" + ports[0] + spec.Health)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode < 500
+	}
+
+	for _, port := range ports {
+		c, err := net.DialTimeout("tcp", ip+":"+port, readyInterval)
+		if err != nil {
+			return false
+		}
+		c.Close()
+	}
+	return true
+}
+
+// waitReady waits for every instance of a container to come up
+func (o *orchestrator) waitReady(enc *common.EncWriter, d *common.SkeletonDeployment, name string, ips []string) error {
+	if len(ips) == 0 {
+		return errors.New(name + " is not running")
+	}
+
+	deadline := time.Now().Add(readyTimeout)
+	for _, ip := range ips {
+		enc.Log("Waiting for " + name + " on " + ip)
+		for !ready(ip, d.Containers[name]) {
+			if time.Now().After(deadline) {
+				return errors.New(name + " on " + ip + " is not up after " + readyTimeout.String())
+			}
+			time.Sleep(readyInterval)
+		}
+	}
+	return nil
+}
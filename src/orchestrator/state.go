@@ -0,0 +1,232 @@
+package main
+
+import (
+	"common"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// stateVersion is bumped whenever the layout of orchestratorState changes
+const stateVersion = 4
+
+// legacyAdminKey is the gatekeeper administrator key of state files from
+// before the key was made up per deployment. Their gatekeeper still uses it
+const legacyAdminKey = "orchestrator_key"
+
+// defaultStatePath is inside the /foo volume which Image.Run binds to /mnt on
+// the host, so the file outlives the orchestrator container
+const defaultStatePath = "/foo/orchestrator.json"
+
+// orchestratorState is everything the orchestrator needs to resume after a
+// restart without the images being pushed again
+type orchestratorState struct {
+	Version    int
+	ImageNames map[string]string
+	ImageIds   map[string]string
+	Deployment *common.SkeletonDeployment
+	Revisions  []*revision
+
+	// AdminKey is the gatekeeper administrator key and PeerKey is what the
+	// gatekeeper replicas replicate with. They are never handed out over
+	// /state
+	AdminKey string `json:",omitempty"`
+	PeerKey  string `json:",omitempty"`
+}
+
+// revision is a record of one deploy, with the images pinned so it can be
+// replayed by a rollback. Images are the names to fetch them by and ImageIds
+// the ids they had, which revisions from before version 4 lack
+type revision struct {
+	Number     int
+	Time       time.Time
+	User       string
+	Deployment common.SkeletonDeployment
+	Images     map[string]string
+	ImageIds   map[string]string
+	Outcome    string
+}
+
+// saveState writes the current state to the state file. The file is replaced
+// atomically so a crash never leaves half a state behind, and saveLock keeps
+// an older state from being written over a newer one
+func (o *orchestrator) saveState() (err error) {
+	o.saveLock.Lock()
+	defer o.saveLock.Unlock()
+
+	o.stateLock.Lock()
+	s := orchestratorState{stateVersion, o.imageNames, o.imageIds, o.deployment,
+		o.revisions, o.key, o.peerKey}
+	b, err := json.MarshalIndent(s, "", "    ")
+	// Every version of the gatekeeper copy is kept, so it goes without the
+	// keys. Standbys are started with them
+	s.AdminKey, s.PeerKey = "", ""
+	shared, _ := json.Marshal(s)
+	o.stateLock.Unlock()
+	if err != nil {
+		return
+	}
+
+	tmp := o.statePath + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp, o.statePath)
+	if err != nil {
+		return
+	}
+
+	// Keep a copy where a standby taking over can find it
+	if o.client() != nil {
+		err = o.store(stateItem, string(shared))
+	}
+	return
+}
+
+// loadState reads the state file back in. A missing file is not an error, it
+// just means this is the first time the orchestrator has run
+func (o *orchestrator) loadState() (err error) {
+	b, err := ioutil.ReadFile(o.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	return o.restoreState(b)
+}
+
+// restoreState replaces the current state with a serialized one
+func (o *orchestrator) restoreState(b []byte) (err error) {
+	s := orchestratorState{}
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return
+	}
+	if s.Version > stateVersion {
+		msg := fmt.Sprintf("State file version %d is newer than %d", s.Version, stateVersion)
+		return errors.New(msg)
+	}
+
+	o.stateLock.Lock()
+	defer o.stateLock.Unlock()
+	if s.ImageNames != nil {
+		o.imageNames = s.ImageNames
+	}
+	if s.ImageIds != nil {
+		o.imageIds = s.ImageIds
+	}
+	o.deployment = s.Deployment
+	o.revisions = s.Revisions
+	if len(s.AdminKey) > 0 {
+		o.key = s.AdminKey
+	} else if s.Version < 3 && len(o.key) == 0 {
+		o.key = legacyAdminKey
+	}
+	if len(s.PeerKey) > 0 {
+		o.peerKey = s.PeerKey
+	}
+	return nil
+}
+
+// handleState hands the state over to a replacement orchestrator. GET returns
+// it and PUT takes it over. The registry and gatekeeper containers are left
+// running across an upgrade, so the new orchestrator adopts them as they are.
+// The keys are left out, the replacement reads them from the state file and
+// from skeleton
+func (o *orchestrator) handleState(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	switch r.Method {
+	case "GET":
+		o.stateLock.Lock()
+		s := orchestratorState{stateVersion, o.imageNames, o.imageIds, o.deployment,
+			o.revisions, "", ""}
+		var b []byte
+		b, err = json.Marshal(s)
+		o.stateLock.Unlock()
+		if err == nil {
+			_, err = w.Write(b)
+		}
+
+	case "PUT":
+		var b []byte
+		b, err = ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = o.restoreState(b)
+		}
+		if err == nil {
+			err = o.saveState()
+		}
+		if err == nil {
+			w.WriteHeader(200)
+		}
+
+	default:
+		w.WriteHeader(405)
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+	}
+}
+
+// addRevision records the start of a deploy and returns its number
+func (o *orchestrator) addRevision(d *common.SkeletonDeployment, images map[string]string, ids map[string]string, user string) (number int, err error) {
+	o.stateLock.Lock()
+	number = len(o.revisions) + 1
+	rev := &revision{number, time.Now(), user, *d, images, ids, "in progress"}
+	o.revisions = append(o.revisions, rev)
+	o.stateLock.Unlock()
+
+	err = o.saveState()
+	return
+}
+
+// finishRevision stores how a deploy went. The revisions may have been
+// replaced by a handover or a takeover meanwhile, so it is looked up by number
+func (o *orchestrator) finishRevision(number int, outcome string) error {
+	o.stateLock.Lock()
+	rev := o.findRevision(number)
+	if rev != nil {
+		rev.Outcome = outcome
+	}
+	o.stateLock.Unlock()
+	if rev == nil {
+		return errors.New(fmt.Sprintf("Revision %d is gone", number))
+	}
+
+	return o.saveState()
+}
+
+func (o *orchestrator) getRevision(number int) (rev revision, err error) {
+	o.stateLock.Lock()
+	defer o.stateLock.Unlock()
+
+	r := o.findRevision(number)
+	if r == nil {
+		err = errors.New(fmt.Sprintf("No such revision %d", number))
+		return
+	}
+	return *r, nil
+}
+
+// findRevision is the revision numbered number, or nil. It must be called with
+// the lock held
+func (o *orchestrator) findRevision(number int) *revision {
+	for _, rev := range o.revisions {
+		if rev.Number == number {
+			return rev
+		}
+	}
+	return nil
+}
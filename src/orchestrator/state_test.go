@@ -0,0 +1,263 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stateOrchestrator is an orchestrator keeping its state file in dir, with no
+// gatekeeper to copy it to
+func stateOrchestrator(dir string) *orchestrator {
+	return &orchestrator{
+		D:          common.NewDocker("10.0.0.1"),
+		imageNames: make(map[string]string),
+		imageIds:   make(map[string]string),
+		statePath:  filepath.Join(dir, "orchestrator.json"),
+		logger:     log.New(os.Stderr, "orchestrator ", log.LstdFlags),
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &common.SkeletonDeployment{}
+	d.Machines.Ip = []string{"10.0.0.1", "10.0.0.2"}
+	d.Containers = map[string]common.ContainerSpec{
+		"web": {Source: "web", Quantity: 1, Expose: []string{"8080"}},
+	}
+
+	o := stateOrchestrator(dir)
+	o.imageNames["web"] = "10.0.0.1:5000/web:1400000000"
+	o.imageIds["web"] = "0123456789ab"
+	o.deployment = d
+	o.revisions = []*revision{{1, time.Now().UTC(), "alice", *d,
+		map[string]string{"web": "10.0.0.1:5000/web:1400000000"},
+		map[string]string{"web": "0123456789ab"}, "success"}}
+	o.key = "admin"
+	o.peerKey = "peer"
+	err = o.saveState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(o.statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("state file is readable by others: %v", info.Mode())
+	}
+
+	loaded := stateOrchestrator(dir)
+	err = loaded.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.imageNames, o.imageNames) ||
+		!reflect.DeepEqual(loaded.imageIds, o.imageIds) {
+		t.Error(errors.New("images did not survive a restart"))
+	}
+	if !reflect.DeepEqual(loaded.deployment, o.deployment) {
+		t.Error(errors.New("deployment did not survive a restart"))
+	}
+	if !reflect.DeepEqual(loaded.revisions, o.revisions) {
+		t.Error(errors.New("revisions did not survive a restart"))
+	}
+	if loaded.key != "admin" || loaded.peerKey != "peer" {
+		t.Error(errors.New("keys did not survive a restart"))
+	}
+}
+
+func TestStateMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The first run has nothing to load
+	o := stateOrchestrator(dir)
+	err = o.loadState()
+	if err != nil {
+		t.Error(err)
+	}
+	if o.deployment != nil || len(o.imageNames) != 0 {
+		t.Error(errors.New("state made up from nothing"))
+	}
+}
+
+func TestStateVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// State from before the admin key was made up per deployment keeps the
+	// key its gatekeeper was started with
+	o := stateOrchestrator(dir)
+	err = o.restoreState([]byte(`{"Version": 2, "ImageNames": {"web": "web:1"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.key != legacyAdminKey || o.imageNames["web"] != "web:1" {
+		t.Error(errors.New("version 2 state not taken over"))
+	}
+
+	// State from a newer orchestrator can't be understood
+	err = o.restoreState([]byte(`{"Version": 1000}`))
+	if err == nil {
+		t.Error(errors.New("newer state taken over"))
+	}
+}
+
+func TestHandleState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := stateOrchestrator(dir)
+	old.imageNames["web"] = "10.0.0.1:5000/web:1"
+	old.deployment = &common.SkeletonDeployment{}
+	old.deployment.Machines.Ip = []string{"10.0.0.1"}
+	old.key = "admin-key"
+	old.peerKey = "peer-key"
+
+	w := httptest.NewRecorder()
+	old.handleState(w, httptest.NewRequest("GET", "/state", nil))
+	if w.Code != 200 {
+		t.Fatal("GET /state answered ", w.Code)
+	}
+	state := w.Body.String()
+	if strings.Contains(state, "admin-key") || strings.Contains(state, "peer-key") {
+		t.Error(errors.New("keys handed out over /state"))
+	}
+	_, err = os.Stat(old.statePath)
+	if !os.IsNotExist(err) {
+		t.Error(errors.New("GET /state wrote the state file"))
+	}
+
+	// The replacement takes the state over and keeps the keys it was
+	// started with
+	newDir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(newDir)
+	replacement := stateOrchestrator(newDir)
+	replacement.key = "admin-key"
+	replacement.peerKey = "peer-key"
+
+	w = httptest.NewRecorder()
+	replacement.handleState(w, httptest.NewRequest("PUT", "/state", strings.NewReader(state)))
+	if w.Code != 200 {
+		t.Fatal("PUT /state answered ", w.Code, w.Body.String())
+	}
+	if replacement.imageNames["web"] != "10.0.0.1:5000/web:1" ||
+		!reflect.DeepEqual(replacement.deployment, old.deployment) {
+		t.Error(errors.New("state not taken over"))
+	}
+	if replacement.key != "admin-key" || replacement.peerKey != "peer-key" {
+		t.Error(errors.New("handover lost the keys"))
+	}
+
+	// And has it on disk for its next restart
+	loaded := stateOrchestrator(newDir)
+	err = loaded.loadState()
+	if err != nil || loaded.imageNames["web"] != "10.0.0.1:5000/web:1" {
+		t.Error(errors.New("handed over state not saved"))
+	}
+
+	w = httptest.NewRecorder()
+	replacement.handleState(w, httptest.NewRequest("PUT", "/state", strings.NewReader("{")))
+	if w.Code != 500 {
+		t.Error(errors.New("broken state taken over"))
+	}
+	w = httptest.NewRecorder()
+	replacement.handleState(w, httptest.NewRequest("DELETE", "/state", nil))
+	if w.Code != 405 {
+		t.Error("DELETE /state answered ", w.Code)
+	}
+}
+
+func TestSaveStateShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	g := startGatekeeper(t, "localhost:1365")
+	defer g.Close()
+
+	o := testOrchestrator("10.0.0.1", "localhost:1365")
+	o.imageNames = map[string]string{"web": "10.0.0.1:5000/web:1"}
+	o.statePath = filepath.Join(dir, "orchestrator.json")
+	o.peerKey = "peer-key"
+
+	// Saves racing each other all get their file written
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() { errs <- o.saveState() }()
+	}
+	for i := 0; i < 10; i++ {
+		err = <-errs
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// The copy in the gatekeeper keeps every version, so it has no keys
+	v, err := o.client().Get(stateItem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(v, "admin") || strings.Contains(v, "peer-key") ||
+		!strings.Contains(v, "web:1") {
+		t.Error("gatekeeper copy of the state is " + v)
+	}
+}
+
+func TestFinishRevisionGone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := stateOrchestrator(dir)
+	d := &common.SkeletonDeployment{}
+	_, err = o.addRevision(d, nil, nil, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	number, err := o.addRevision(d, nil, nil, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A handover mid-deploy brings in fewer revisions
+	o.revisions = o.revisions[:1]
+	err = o.finishRevision(number, "success")
+	if err == nil {
+		t.Error(errors.New("finished a revision that is gone"))
+	}
+	err = o.finishRevision(1, "success")
+	if err != nil || o.revisions[0].Outcome != "success" {
+		t.Error(errors.New("revision 1 not finished"))
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"libgatekeeper"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// entrypoint is the official postgres image's, which creates the database
+// with the superuser password in POSTGRES_PASSWORD on the first start
+const entrypoint = "/usr/local/bin/docker-entrypoint.sh"
+
+// superuserPassword reads the password the orchestrator left in the
+// gatekeeper item named by POSTGRES_PASSWORD_ITEM, with the container's key
+func superuserPassword() (password string, err error) {
+	c, err := libgatekeeper.NewOneTimeClient(os.Getenv("GATEKEEPER"), os.Getenv("GATEKEEPER_KEY"))
+	if err != nil {
+		return
+	}
+	return c.Get(os.Getenv("POSTGRES_PASSWORD_ITEM"))
+}
+
+// initialized tells whether the database was already created by an earlier
+// start, which needs no password
+func initialized() bool {
+	data := os.Getenv("PGDATA")
+	if len(data) == 0 {
+		data = "/var/lib/postgresql/data"
+	}
+	_, err := os.Stat(filepath.Join(data, "PG_VERSION"))
+	return err == nil
+}
+
+// postgresql starts PostgreSQL with the superuser password from the
+// gatekeeper. Only the entrypoint is handed the password, so it is never in
+// the container's environment as docker shows it
+func main() {
+	env := []string{}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "GATEKEEPER_KEY=") && !strings.HasPrefix(e, "POSTGRES_PASSWORD") {
+			env = append(env, e)
+		}
+	}
+
+	// The one time key is used up by the first start
+	if !initialized() {
+		password, err := superuserPassword()
+		if err != nil {
+			log.Fatal(err)
+		}
+		env = append(env, "POSTGRES_PASSWORD="+password)
+	}
+
+	err := syscall.Exec(entrypoint, append([]string{entrypoint}, os.Args[1:]...), env)
+	log.Fatal(err)
+}
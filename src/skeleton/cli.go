@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bytes"
+	"common"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// skeleton is driven by commands, some of which have commands of their own,
+// as in skeleton push images or skeleton secrets get db/password. Flags that
+// apply to every command can go before or after it. Help and shell
+// completion are generated from the command tree below.
+
+// command is something skeleton can be told to do
+type command struct {
+	name        string
+	aliases     []string
+	args        string
+	summary     string
+	description string
+
+	// minArgs and maxArgs bound how many arguments run takes, maxArgs is -1
+	// for any number
+	minArgs int
+	maxArgs int
+
+	// flags adds the command's own flags
+	flags func(fs *flag.FlagSet)
+
+	// run does the command, or is nil if the command only groups others
+	run      func(args []string) error
+	commands []*command
+}
+
+// Flags that apply to every command
+var (
+	bonesFile        string
+	orchestratorFlag string
+	env              string
+	verbose          bool
+	jsonOutput       bool
+)
+
+func globalFlags(fs *flag.FlagSet) {
+	fs.StringVar(&bonesFile, "f", "", "read the bonesFile at this path")
+	fs.StringVar(&bonesFile, "file", "", "read the bonesFile at this path, the same as -f")
+	fs.StringVar(&orchestratorFlag, "orchestrator", "",
+		"use the orchestrator at this address rather than looking for one")
+	fs.StringVar(&env, "env", "", "use the overlay for an environment, bonesFile.<env>")
+	fs.BoolVar(&verbose, "verbose", false, "log every step, with times")
+	fs.BoolVar(&jsonOutput, "json", false, "print results as JSON")
+}
+
+// tailFlag is how many lines of each container's log logs prints
+var tailFlag int
+
+// keyFlag is the gatekeeper key secrets uses
+var keyFlag string
+
+// root is every command skeleton has. It is put together in init, as help
+// and completion look through it
+var root *command
+
+func init() {
+	root = commands
+}
+
+var commands = &command{
+	name:        "skeleton",
+	summary:     "Deploys the containers a bonesFile describes to its machines",
+	description: "skeleton reads the bonesFile in the current directory, or the nearest one\nabove it, and hands it to the orchestrator, starting one if none is running.",
+	commands: []*command{
+		{
+			name:        "deploy",
+			summary:     "Push the images and configuration and deploy them",
+			description: "Builds every container's image, pushes them and the bonesFile to the\norchestrator and deploys them. The orchestrator is started on the first\nmachine if it isn't running, and upgraded if it is an older version.",
+			run: func(args []string) error {
+				return push(true, true)
+			},
+		},
+		{
+			name:    "push",
+			summary: "Push only the images or only the configuration",
+			commands: []*command{
+				{
+					name:        "images",
+					summary:     "Build and push every container's image without deploying",
+					description: "Builds every container's image and pushes it to the orchestrator's\nregistry. Nothing is started until the configuration is pushed.",
+					run: func(args []string) error {
+						return push(true, false)
+					},
+				},
+				{
+					name:        "config",
+					aliases:     []string{"configuration"},
+					summary:     "Deploy the bonesFile with the images already pushed",
+					description: "Hands the bonesFile to the orchestrator, which deploys it with the\nimages it already has.",
+					run: func(args []string) error {
+						return push(false, true)
+					},
+				},
+			},
+		},
+		{
+			name:        "status",
+			summary:     "Show the orchestrator and where every container is running",
+			description: "Prints the orchestrator leading the deployment, its version, and the\naddresses every container can be reached on.",
+			run: func(args []string) error {
+				return status()
+			},
+		},
+		{
+			name:        "logs",
+			args:        "<container>",
+			summary:     "Print what a container has logged on every machine",
+			description: "Prints the end of the log of every instance of a container, on every\nmachine in the bonesFile.",
+			minArgs:     1,
+			maxArgs:     1,
+			flags: func(fs *flag.FlagSet) {
+				fs.IntVar(&tailFlag, "tail", 100, "how many lines to print from each instance")
+			},
+			run: func(args []string) error {
+				return logs(args[0], tailFlag)
+			},
+		},
+		{
+			name:        "secrets",
+			summary:     "Read and write secrets in the gatekeeper",
+			description: "Talks to the gatekeeper replicas on the first machines of the bonesFile\nwith the key given by --key, or in SKELETON_KEY.",
+			commands: []*command{
+				{
+					name:    "get",
+					args:    "<item>",
+					summary: "Print a secret",
+					minArgs: 1,
+					maxArgs: 1,
+					flags:   secretFlags,
+					run:     getSecret,
+				},
+				{
+					name:    "set",
+					args:    "<item> <value>",
+					summary: "Set a secret, creating it if it doesn't exist",
+					minArgs: 2,
+					maxArgs: 2,
+					flags:   secretFlags,
+					run:     setSecret,
+				},
+				{
+					name:    "rm",
+					args:    "<item>",
+					summary: "Delete a secret",
+					minArgs: 1,
+					maxArgs: 1,
+					flags:   secretFlags,
+					run:     removeSecret,
+				},
+				{
+					name:    "ls",
+					args:    "[prefix]",
+					summary: "List the secrets below a prefix that the key can read",
+					maxArgs: 1,
+					flags:   secretFlags,
+					run:     listSecrets,
+				},
+			},
+		},
+		{
+			name:        "validate",
+			summary:     "Check the bonesFile without deploying it",
+			description: "Prints every mistake in the bonesFile with the file, line and column it\nis at, and exits with 1 if there are any.",
+			run: func(args []string) error {
+				return validate()
+			},
+		},
+		{
+			name:        "render",
+			summary:     "Print the bonesFile as it would be deployed",
+			description: "Prints the bonesFile as a single JSON bonesFile, with its includes, the\noverlay for --env and its variables filled in.",
+			run: func(args []string) error {
+				return render()
+			},
+		},
+		{
+			name:    "history",
+			summary: "List the deployments the orchestrator has made",
+			run: func(args []string) error {
+				return history()
+			},
+		},
+		{
+			name:        "rollback",
+			args:        "<revision>",
+			summary:     "Deploy an earlier revision again",
+			description: "Asks the orchestrator to deploy a revision from skeleton history again,\nwith the images it had.",
+			minArgs:     1,
+			maxArgs:     1,
+			run: func(args []string) error {
+				return rollback(args[0])
+			},
+		},
+		{
+			name:    "version",
+			aliases: []string{"v"},
+			summary: "Print skeleton's version",
+			run: func(args []string) error {
+				return output(map[string]string{"Version": common.Version}, func() {
+					fmt.Println("skeleton " + common.Version)
+				})
+			},
+		},
+		{
+			name:        "completion",
+			args:        "<bash|zsh>",
+			summary:     "Print a shell completion script",
+			description: "Prints a script completing skeleton's commands and flags. Load it from\nyour shell's startup file with\n\n    source <(skeleton completion bash)",
+			minArgs:     1,
+			maxArgs:     1,
+			run: func(args []string) error {
+				return completion(os.Stdout, args[0])
+			},
+		},
+		{
+			name:    "help",
+			args:    "[command]",
+			summary: "Show help for a command",
+			maxArgs: -1,
+			run: func(args []string) error {
+				c, rest := find(args)
+				if len(rest) > 0 {
+					return errors.New("No command " + strings.Join(args, " "))
+				}
+				help(os.Stdout, c)
+				return nil
+			},
+		},
+	},
+}
+
+// find walks down the command tree as far as args go
+func find(args []string) (c *command, rest []string) {
+	c = root
+	for len(args) > 0 {
+		next := c.command(args[0])
+		if next == nil {
+			break
+		}
+		c, args = next, args[1:]
+	}
+	return c, args
+}
+
+func (c *command) command(name string) *command {
+	for _, sub := range c.commands {
+		if sub.name == name {
+			return sub
+		}
+		for _, alias := range sub.aliases {
+			if alias == name {
+				return sub
+			}
+		}
+	}
+	return nil
+}
+
+// path is how the command is typed, such as skeleton push images
+func (c *command) path() string {
+	return strings.Join(pathTo(root, c), " ")
+}
+
+func pathTo(from *command, c *command) []string {
+	if from == c {
+		return []string{from.name}
+	}
+	for _, sub := range from.commands {
+		p := pathTo(sub, c)
+		if p != nil {
+			return append([]string{from.name}, p...)
+		}
+	}
+	return nil
+}
+
+// flagSet has the global flags and the command's own
+func (c *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.path(), flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Usage = func() {}
+	globalFlags(fs)
+	if c.flags != nil {
+		c.flags(fs)
+	}
+	return fs
+}
+
+// parseFlags parses flags wherever they are among the arguments, up to a --
+func parseFlags(fs *flag.FlagSet, args []string) (positional []string, err error) {
+	positional = []string{}
+	for {
+		err = fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return
+		}
+		if len(args) > len(rest) && args[len(args)-len(rest)-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// help prints how to use a command
+func help(w io.Writer, c *command) {
+	usage := "Usage: " + c.path() + " [flags]"
+	if len(c.commands) > 0 {
+		usage += " <command>"
+	}
+	if len(c.args) > 0 {
+		usage += " " + c.args
+	}
+	fmt.Fprintln(w, usage)
+
+	fmt.Fprintln(w)
+	if len(c.description) > 0 {
+		fmt.Fprintln(w, c.description)
+	} else {
+		fmt.Fprintln(w, c.summary)
+	}
+
+	if len(c.commands) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Commands:")
+		width := 0
+		for _, sub := range c.commands {
+			if len(sub.name) > width {
+				width = len(sub.name)
+			}
+		}
+		for _, sub := range c.commands {
+			fmt.Fprintf(w, "  %-*s  %s\n", width, sub.name, sub.summary)
+		}
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Flags:")
+	fs := c.flagSet()
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+
+	if len(c.commands) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Run 'skeleton help %s<command>' for more about a command.\n",
+			strings.TrimPrefix(c.path()+" ", "skeleton "))
+	}
+}
+
+// flagNames lists the flags a command takes, and those that take a value
+func (c *command) flagNames() (all []string, valued []string) {
+	c.flagSet().VisitAll(func(f *flag.Flag) {
+		all = append(all, "--"+f.Name)
+		bool, ok := f.Value.(interface{ IsBoolFlag() bool })
+		if !ok || !bool.IsBoolFlag() {
+			valued = append(valued, "-"+f.Name, "--"+f.Name)
+		}
+	})
+	return
+}
+
+// completionScript is filled in with a line loading bash completion for zsh,
+// the flags that take a value, and a case for each command listing the flags
+// and words that can follow it
+const completionScript = `%s_skeleton() {
+	local i path= flags= words= cur="${COMP_WORDS[COMP_CWORD]}"
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		case "${COMP_WORDS[i]}" in
+		%s) ((i++)) ;;
+		-*) ;;
+		*) path="${path:+$path }${COMP_WORDS[i]}" ;;
+		esac
+	done
+	case "$path" in
+%s	esac
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+	else
+		COMPREPLY=($(compgen -W "$words" -- "$cur"))
+	fi
+}
+complete -o default -F _skeleton skeleton
+`
+
+// completion prints a completion script for a shell
+func completion(w io.Writer, shell string) error {
+	prelude := ""
+	switch shell {
+	case "bash":
+	case "zsh":
+		// zsh runs bash completion scripts once bashcompinit is loaded
+		prelude = "autoload -U +X bashcompinit && bashcompinit\n"
+	default:
+		return errors.New("No completion for " + shell + ", only bash and zsh")
+	}
+
+	cases := &bytes.Buffer{}
+	valued := map[string]bool{}
+	var add func(c *command, path string)
+	add = func(c *command, path string) {
+		flags, v := c.flagNames()
+		for _, f := range v {
+			valued[f] = true
+		}
+		words := []string{}
+		for _, sub := range c.commands {
+			words = append(words, sub.name)
+		}
+		switch c {
+		case root.command("help"):
+			for _, sub := range root.commands {
+				words = append(words, sub.name)
+			}
+		case root.command("completion"):
+			words = []string{"bash", "zsh"}
+		}
+		fmt.Fprintf(cases, "\t%q) flags=%q; words=%q ;;\n", path, strings.Join(flags, " "),
+			strings.Join(words, " "))
+
+		for _, sub := range c.commands {
+			add(sub, strings.TrimSpace(path+" "+sub.name))
+		}
+	}
+	add(root, "")
+
+	names := []string{}
+	for f := range valued {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	_, err := fmt.Fprintf(w, completionScript, prelude, strings.Join(names, "|"), cases.String())
+	return err
+}
+
+// output prints a result as JSON with --json, or calls text to print it for
+// people
+func output(v interface{}, text func()) error {
+	if !jsonOutput {
+		text()
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	return enc.Encode(v)
+}
+
+// debug logs the steps only worth seeing with --verbose
+func debug(v ...interface{}) {
+	if verbose {
+		log.Print(v...)
+	}
+}
+
+// usageError is a command typed wrong, which is answered with its help
+type usageError struct {
+	c       *command
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+// run does what the arguments say, returning the exit status
+func run(args []string) int {
+	// Older scripts pass commands such as "push images" as one argument
+	if len(args) == 1 && strings.Contains(args[0], " ") {
+		args = strings.Fields(args[0])
+	}
+
+	err := dispatch(args)
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case *usageError:
+		fmt.Fprintln(os.Stderr, "skeleton: "+e.message)
+		fmt.Fprintf(os.Stderr, "Run '%s' for usage.\n",
+			strings.Replace(e.c.path(), "skeleton", "skeleton help", 1))
+		return 2
+	case common.ValidationErrors:
+		if jsonOutput {
+			output(e, nil)
+			return 1
+		}
+		for _, v := range e {
+			fmt.Fprintln(os.Stderr, v)
+		}
+		return 1
+	default:
+		fmt.Fprintln(os.Stderr, "skeleton: "+err.Error())
+		return 1
+	}
+}
+
+// dispatch finds the command the arguments name and runs it
+func dispatch(args []string) error {
+	// Global flags can come before the command
+	fs := root.flagSet()
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		help(os.Stdout, root)
+		return nil
+	}
+	if err != nil {
+		return &usageError{root, err.Error()}
+	}
+
+	c, args := find(fs.Args())
+	fs = c.flagSet()
+	args, err = parseFlags(fs, args)
+	if err == flag.ErrHelp {
+		help(os.Stdout, c)
+		return nil
+	}
+	if err != nil {
+		return &usageError{c, err.Error()}
+	}
+
+	if c.run == nil {
+		if len(args) > 0 {
+			return &usageError{c, "No command " + strings.TrimPrefix(c.path()+" "+args[0], "skeleton ")}
+		}
+		help(os.Stderr, c)
+		return &usageError{c, "Missing command"}
+	}
+	if len(args) < c.minArgs || (c.maxArgs >= 0 && len(args) > c.maxArgs) {
+		return &usageError{c, "Usage: " + strings.TrimSpace(c.path()+" "+c.args)}
+	}
+
+	log.SetFlags(0)
+	if verbose {
+		log.SetFlags(log.LstdFlags)
+	}
+	return c.run(args)
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseFlags(t *testing.T) {
+	c, _ := find([]string{"logs"})
+	fs := c.flagSet()
+	args, err := parseFlags(fs, []string{"web", "--tail", "20", "--", "--json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tailFlag != 20 {
+		t.Error(errors.New("--tail after an argument was not parsed"))
+	}
+	if len(args) != 2 || args[0] != "web" || args[1] != "--json" {
+		t.Error(errors.New("Wrong arguments " + strings.Join(args, ",")))
+	}
+	if jsonOutput {
+		t.Error(errors.New("A flag after -- was parsed"))
+	}
+}
+
+func TestFind(t *testing.T) {
+	c, rest := find([]string{"push", "configuration", "extra"})
+	if c.path() != "skeleton push config" {
+		t.Error(errors.New("An alias found " + c.path()))
+	}
+	if len(rest) != 1 || rest[0] != "extra" {
+		t.Error(errors.New("Wrong arguments left over"))
+	}
+
+	c, rest = find([]string{"nothing"})
+	if c != root || len(rest) != 1 {
+		t.Error(errors.New("An unknown command was found"))
+	}
+}
+
+func TestHelp(t *testing.T) {
+	b := &bytes.Buffer{}
+	c, _ := find([]string{"secrets"})
+	help(b, c)
+	for _, want := range []string{"Usage: skeleton secrets [flags] <command>", "  set ", "-orchestrator"} {
+		if !strings.Contains(b.String(), want) {
+			t.Error(errors.New("Help is missing " + want))
+		}
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	b := &bytes.Buffer{}
+	err := completion(b, "bash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `"secrets") flags="--env --f --file --json --orchestrator --verbose"; words="get set rm ls"`) {
+		t.Error(errors.New("bash completion is missing the secrets commands"))
+	}
+
+	b.Reset()
+	err = completion(b, "zsh")
+	if err != nil || !strings.Contains(b.String(), "bashcompinit") {
+		t.Error(errors.New("zsh completion doesn't load bashcompinit"))
+	}
+	if completion(b, "fish") == nil {
+		t.Error(errors.New("fish completion should be refused"))
+	}
+}
@@ -5,13 +5,16 @@ import (
 	"common"
 	"encoding/json"
 	"errors"
-	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/user"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -22,25 +25,79 @@ func (t *NoOrchestratorFound) Error() string {
 	return "No Orchestrator Found"
 }
 
-// loadBonesFile does initial bones file loading and does some quick and dirty
-// data sanitization
-func loadBonesFile() *common.SkeletonDeployment {
-	log.Print("Loading bonesFile")
-	config, err := os.Open("bonesFile")
+// sourceDir is the directory of a local source. Relative directories are
+// relative to the directory the bonesFile is in
+func sourceDir(dir string, source string) string {
+	path := strings.SplitN(source, ":", 2)[1]
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// checkSource makes sure a local source is a directory skeleton can send
+func checkSource(dir string, source string) error {
+	dir = sourceDir(dir, source)
+	info, err := os.Stat(dir)
 	if err != nil {
-		log.Fatal(err)
+		return errors.New("no directory " + dir)
+	}
+	if !info.IsDir() {
+		return errors.New(dir + " is not a directory")
 	}
+	return nil
+}
 
-	configslice, err := ioutil.ReadAll(config)
+// bonesFiles finds the bonesFile, given by -f or in the current directory or
+// the nearest one above it, and the overlay for --env
+func bonesFiles() (name string, overlays []string, err error) {
+	name = bonesFile
+	if len(name) == 0 {
+		name, err = common.SearchBonesFile(".")
+		if err == nil {
+			debug("Using " + name)
+		}
+	}
+	if err != nil || len(env) == 0 {
+		return
+	}
+	overlay, err := common.EnvFile(name, env)
 	if err != nil {
-		log.Fatal(err)
+		return
 	}
+	return name, []string{overlay}, nil
+}
 
-	deploy := new(common.SkeletonDeployment)
+// validator checks a bonesFile, filling in variables from the environment and
+// the .env file next to it
+func validator(name string) (v common.Validator, err error) {
+	v.CheckSource = func(source string) error {
+		return checkSource(filepath.Dir(name), source)
+	}
+	v.Lookup, err = common.Variables(filepath.Dir(name))
+	return
+}
 
-	err = json.Unmarshal(configslice, deploy)
+// readBonesFile reads and validates the bonesFile, in whichever format it is,
+// filling in the defaults
+func readBonesFile() (*common.SkeletonDeployment, error) {
+	name, overlays, err := bonesFiles()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	return loadBonesFile(name, overlays)
+}
+
+// loadBonesFile reads and validates a bonesFile and its overlays
+func loadBonesFile(name string, overlays []string) (*common.SkeletonDeployment, error) {
+	debug("Loading bonesFile")
+	v, err := validator(name)
+	if err != nil {
+		return nil, err
+	}
+	deploy, err := v.ValidateFile(name, overlays...)
+	if err != nil {
+		return nil, err
 	}
 
 	for k, v := range deploy.Containers {
@@ -61,13 +118,37 @@ func loadBonesFile() *common.SkeletonDeployment {
 		}
 		deploy.Containers[k] = v
 	}
+	return deploy, nil
+}
 
-	if len(deploy.Machines.Provider) == 0 {
-		log.Fatal("Machine Provider must be specified")
+// validate checks the bonesFile, the errors in it are printed by run
+func validate() error {
+	_, err := readBonesFile()
+	if err != nil {
+		return err
 	}
+	return output(map[string]bool{"Valid": true}, func() {
+		fmt.Println("bonesFile is valid")
+	})
+}
 
-	log.Print("bonesFile loaded")
-	return deploy
+// render prints the bonesFile as it would be deployed, with its includes and
+// the environment's overlay merged in
+func render() error {
+	name, overlays, err := bonesFiles()
+	if err != nil {
+		return err
+	}
+	v, err := validator(name)
+	if err != nil {
+		return err
+	}
+	b, err := v.RenderFile(name, overlays...)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
 }
 
 // findOrchestrator finds a running orchestrator by scanning port 900 on all
@@ -76,50 +157,362 @@ func findOrchestrator(config *common.SkeletonDeployment) (string, error) {
 	log.Print("Finding orchestrator")
 	client := common.MakeHttpClient()
 	for _, v := range config.Machines.Ip {
-		_, err := net.DialTimeout("tcp", v+":900", 1000*time.Millisecond)
+		c, err := net.DialTimeout("tcp", v+":900", 1000*time.Millisecond)
 		if err != nil {
-            log.Print(err)
+			debug(err)
 			continue
 		}
-        err = nil
-		_, err = client.Get("https://" + v + ":900/version")
+		c.Close()
+		resp, err := client.Get("https://" + v + ":900/version")
 		if err == nil {
+			resp.Body.Close()
 			log.Print("Orchestrator Found")
-			return v, nil
+			return findLeader(v), nil
 		}
-        log.Print(err)
+		debug(err)
 	}
 	log.Print("No Orchestrator Found")
 	return "", new(NoOrchestratorFound)
 }
 
+// findLeader asks an orchestrator which orchestrator is active, in case we
+// found a standby
+func findLeader(ip string) string {
+	resp, err := common.MakeHttpClient().Get("https://" + ip + ":900/leader")
+	if err != nil {
+		log.Print(err)
+		return ip
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != 200 {
+		log.Print("No leader elected yet")
+		return ip
+	}
+	return string(b)
+}
+
+// orchestratorVersion asks a running orchestrator which version it is
+func orchestratorVersion(ip string) (version string, err error) {
+	resp, err := common.MakeHttpClient().Get("https://" + ip + ":900/version")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	return strings.TrimPrefix(string(b), "orchestrator "), nil
+}
+
+// upgradeTimeout is how long a new orchestrator gets to come up and take the
+// state over before the old one is put back
+var upgradeTimeout = 2 * time.Minute
+
+// carriedEnv are the variables an orchestrator was started with that its
+// replacement keeps, besides the shared keys
+var carriedEnv = []string{"REGISTRY", "GATEKEEPER"}
+
+// upgradeOrchestrators replaces the orchestrators of a deployment with this
+// version, the standbys first and the leader last. Every new orchestrator is
+// handed the leader's state before the old leader is stopped, so whichever of
+// them takes the lease carries on where it left off. It returns the leader to
+// use from then on.
+//
+// Only the orchestrators are upgraded. The gatekeeper and registry are left
+// running, and their images untouched so the new orchestrators find them
+// rather than starting empty ones, so no secrets are lost. Upgrading the
+// gatekeeper itself is not handled
+func upgradeOrchestrators(config *common.SkeletonDeployment, leader string) (string, error) {
+	log.Print("Upgrading Orchestrators")
+	state, err := orchestratorState(leader)
+	if err != nil {
+		return leader, err
+	}
+	keys, err := orchestratorKeys(leader)
+	if err != nil {
+		return leader, err
+	}
+
+	ips := []string{}
+	for i, ip := range config.Machines.Ip {
+		if i < common.OrchestratorReplicas && ip != leader {
+			ips = append(ips, ip)
+		}
+	}
+	ips = append(ips, leader)
+
+	for _, ip := range ips {
+		// Machines without a standby get one from startStandbys
+		version, err := orchestratorVersion(ip)
+		if (err != nil && ip != leader) || version == common.Version {
+			continue
+		}
+		err = upgradeOrchestrator(ip, keys, state)
+		if err != nil {
+			return leader, err
+		}
+	}
+	return waitLeader(leader)
+}
+
+// orchestratorState fetches the state of the orchestrator on ip, or nil if it
+// has none to hand over
+func orchestratorState(ip string) (state []byte, err error) {
+	resp, err := common.MakeHttpClient().Get("https://" + ip + ":900/state")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Print("Orchestrator has no state to hand over: " + resp.Status)
+		return nil, nil
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// waitLeader waits for the orchestrator on ip to know of a leader of this
+// version, for up to upgradeTimeout
+func waitLeader(ip string) (leader string, err error) {
+	deadline := time.Now().Add(upgradeTimeout)
+	for ; time.Now().Before(deadline); time.Sleep(time.Second) {
+		leader = findLeader(ip)
+		version, err := orchestratorVersion(leader)
+		if err == nil && version == common.Version {
+			return leader, nil
+		}
+	}
+	return ip, errors.New("No orchestrator of this version took the lease")
+}
+
+// upgradeOrchestrator replaces the orchestrator on ip with this version,
+// started with keys and handed state. If the new one doesn't come up within
+// upgradeTimeout or refuses the state, it is stopped and the old one started
+// again
+func upgradeOrchestrator(ip string, keys []string, state []byte) (err error) {
+	log.Print("Upgrading Orchestrator on " + ip)
+	env := append(append([]string{}, keys...), buildEnv(ip)...)
+
+	D := common.NewDocker(ip)
+	running, old, err := (&common.Image{}).IsRunning(D, "orchestrator")
+	if err != nil {
+		return
+	}
+	if running {
+		// Inspecting fills in the id of the old image, which still finds it
+		// once the orchestrator name points at the new one
+		err = old.Inspect()
+		if err != nil {
+			return
+		}
+		for _, e := range old.Config.Env {
+			for _, name := range carriedEnv {
+				if strings.HasPrefix(e, name+"=") {
+					env = append(env, e)
+				}
+			}
+		}
+
+		// Both can't have the ports at once. Until the new one is up the
+		// others, already upgraded and handed the state, can take the lease
+		err = old.Stop()
+		if err != nil {
+			return
+		}
+		old.Delete()
+	}
+
+	err = handOver(D, env, state)
+	if err == nil {
+		log.Print("Orchestrator upgraded on " + ip)
+		return
+	}
+
+	log.Print("Orchestrator upgrade failed: ", err)
+	if !running {
+		return
+	}
+	log.Print("Going back to the old orchestrator")
+	(&common.Image{}).Stop(D, "orchestrator")
+	_, rerr := common.NewImage(old.Image).Run(D, old.Config.Env, "900", "53/udp")
+	if rerr != nil {
+		log.Print(rerr)
+	}
+	return
+}
+
+// handOver starts this version of the orchestrator and gives it the state of
+// the old one. It fails if the orchestrator isn't up within upgradeTimeout
+func handOver(D *common.Docker, env []string, state []byte) (err error) {
+	err = buildImages(D, "orchestrator")
+	if err != nil {
+		return
+	}
+	err = runOrchestrator(D, env)
+	if err != nil {
+		return
+	}
+
+	ip := D.GetIP()
+	deadline := time.Now().Add(upgradeTimeout)
+	version, err := orchestratorVersion(ip)
+	for ; err != nil; version, err = orchestratorVersion(ip) {
+		if time.Now().After(deadline) {
+			return errors.New("The new orchestrator did not come up: " + err.Error())
+		}
+		time.Sleep(time.Second)
+	}
+	if version != common.Version {
+		return errors.New("The new orchestrator is " + version + " not " + common.Version)
+	}
+
+	if state == nil {
+		return
+	}
+	req, err := http.NewRequest("PUT", "https://"+ip+":900/state", bytes.NewReader(state))
+	if err != nil {
+		return
+	}
+	resp, err := common.MakeHttpClient().Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("State handover failed: " + string(b))
+	}
+	return
+}
+
+// sharedKeys are the variables every orchestrator of a deployment is started
+// with the same value of. The gatekeeper replicas are handed them too
+var sharedKeys = []string{"ADMIN_KEY", "PEER_KEY"}
+
+// orchestratorKeys reads the shared keys the orchestrator on ip was started
+// with, so its standbys and its replacement get the same ones. Keys it lacks,
+// or all of them if no orchestrator runs there, are made up
+func orchestratorKeys(ip string) (env []string, err error) {
+	found := make(map[string]string)
+	D := common.NewDocker(ip)
+	running, C, err := (&common.Image{}).IsRunning(D, "orchestrator")
+	if err != nil {
+		return
+	}
+	if running {
+		err = C.Inspect()
+		if err != nil {
+			return
+		}
+		for _, e := range C.Config.Env {
+			kv := strings.SplitN(e, "=", 2)
+			if len(kv) == 2 {
+				found[kv[0]] = kv[1]
+			}
+		}
+	}
+
+	for _, name := range sharedKeys {
+		v := found[name]
+		if len(v) == 0 {
+			v, err = common.RandomKey()
+			if err != nil {
+				return
+			}
+		}
+		env = append(env, name+"="+v)
+	}
+	return
+}
+
 func buildEnv(ip string) []string {
 	a := make([]string, 1)
 	a[0] = "HOST=" + ip
 	return a
 }
 
-// bootstrapOrchestrator starts up the orchestrator on a machine
-func bootstrapOrchestrator(ip string) string {
-	log.Print("Bootstrapping Orchestrator")
-	D := common.NewDocker(ip)
-	Img := &common.Image{}
+// startStandbys makes sure the first few machines each run an orchestrator.
+// Standbys share the leader's registry and the gatekeeper replicas, and take
+// over the lease if the leader goes away
+func startStandbys(config *common.SkeletonDeployment, leader string) {
+	gatekeepers := []string{leader + ":800"}
+	for i, ip := range config.Machines.Ip {
+		if i < common.OrchestratorReplicas && ip != leader {
+			gatekeepers = append(gatekeepers, ip+":800")
+		}
+	}
+
+	var keys []string
+	for i, ip := range config.Machines.Ip {
+		if i >= common.OrchestratorReplicas {
+			break
+		}
+		if ip == leader {
+			continue
+		}
+		_, err := orchestratorVersion(ip)
+		if err == nil {
+			continue
+		}
 
-	//Setup gatekeeper image
-	tar := common.TarDir("../../containers/gatekeeper")
-	Img, err := D.Build(tar, "gatekeeper")
+		if keys == nil {
+			keys, err = orchestratorKeys(leader)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		log.Print("Starting standby orchestrator on " + ip)
+		bootstrapOrchestrator(ip, append(keys, "REGISTRY="+leader+":5000",
+			"GATEKEEPER="+strings.Join(gatekeepers, ","))...)
+	}
+}
+
+// containersDir finds the directory with the gatekeeper, ingress and
+// orchestrator images, named by SKELETON_CONTAINERS or shipped next to
+// skeleton as containers or ../containers
+func containersDir() (string, error) {
+	dir := os.Getenv("SKELETON_CONTAINERS")
+	if len(dir) > 0 {
+		return dir, nil
+	}
+
+	exe, err := os.Executable()
 	if err != nil {
-		log.Fatal(err)
+		return "", err
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return "", err
 	}
+	for _, dir := range []string{
+		filepath.Join(filepath.Dir(exe), "containers"),
+		filepath.Join(filepath.Dir(exe), "..", "containers"),
+	} {
+		_, err = os.Stat(filepath.Join(dir, "gatekeeper", "Dockerfile"))
+		if err == nil {
+			return dir, nil
+		}
+	}
+	return "", errors.New("No containers directory next to " + exe +
+		", set SKELETON_CONTAINERS to where skeleton's containers are")
+}
 
-	//Setup orchestrator container
-	tar = common.TarDir("../../containers/orchestrator")
+// bootstrapOrchestrator starts up the orchestrator on a machine, extra is
+// added to its environment
+func bootstrapOrchestrator(ip string, extra ...string) string {
+	log.Print("Bootstrapping Orchestrator")
+	D := common.NewDocker(ip)
 
-	Img, err = D.Build(tar, "orchestrator")
+	// The orchestrator runs the gatekeeper, and the ingress when there are
+	// routes
+	err := buildImages(D, "gatekeeper", "ingress", "orchestrator")
 	if err != nil {
 		log.Fatal(err)
 	}
-	_, err = Img.Run(D, buildEnv(D.GetIP()), "900")
+	err = runOrchestrator(D, append(buildEnv(D.GetIP()), extra...))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -128,8 +521,31 @@ func bootstrapOrchestrator(ip string) string {
 	return ip
 }
 
-// deploys the images to the server
-func deployImages(ip string, config *common.SkeletonDeployment) (err error) {
+// buildImages builds the named images from skeleton's containers directory
+func buildImages(D *common.Docker, names ...string) (err error) {
+	dir, err := containersDir()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		tar := common.TarDir(filepath.Join(dir, name))
+		_, err = D.Build(tar, name)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// runOrchestrator starts the orchestrator image, which also answers DNS for
+// the containers
+func runOrchestrator(D *common.Docker, env []string) (err error) {
+	_, err = common.NewNamedImage("orchestrator").Run(D, env, "900", "53/udp")
+	return
+}
+
+// deploys the images to the server, with local sources relative to dir
+func deployImages(ip string, dir string, config *common.SkeletonDeployment) (err error) {
 	log.Print("Pushing images to Orchestrator")
 	h := common.MakeHttpClient()
 	var image io.Reader
@@ -137,7 +553,7 @@ func deployImages(ip string, config *common.SkeletonDeployment) (err error) {
 	for k, v := range config.Containers {
 		source := strings.SplitN(v.Source, ":", 2)
 		if source[0] == "local" {
-			image = common.TarDir(source[1])
+			image = common.TarDir(sourceDir(dir, v.Source))
 		} else {
 			log.Fatal(source)
 		}
@@ -167,8 +583,15 @@ func deployConfig(ip string, config *common.SkeletonDeployment) (err error) {
 
 	b := bytes.NewBuffer(barr)
 
-	resp, err := h.Post("https://"+ip+":900/deploy", "application/json", b)
-	log.Print("Post returned")
+	req, err := http.NewRequest("POST", "https://"+ip+":900/deploy", b)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Skeleton-User", deployUser())
+
+	resp, err := h.Do(req)
+	debug("Post returned")
 
 	if err != nil {
 		return
@@ -181,60 +604,153 @@ func deployConfig(ip string, config *common.SkeletonDeployment) (err error) {
 	return
 }
 
-// deploy pushes our new deploy configuration to the orchestrator
-func deploy(ip string, config *common.SkeletonDeployment, update string) (err error) {
-	err = errors.New("Incorrect command entered")
-	if update == "deploy" {
-		err = deployImages(ip, config)
-		if err != nil {
-			return
+// deployUser names the person deploying for the orchestrator's history
+func deployUser() string {
+	u, err := user.Current()
+	if err != nil {
+		return os.Getenv("USER")
+	}
+	return u.Username
+}
+
+// orchestrator finds the orchestrator to talk to, the one given by
+// --orchestrator or the one running on the bonesFile's machines
+func orchestrator() (string, error) {
+	if len(orchestratorFlag) > 0 {
+		return findLeader(orchestratorFlag), nil
+	}
+	config, err := readBonesFile()
+	if err != nil {
+		return "", err
+	}
+	return findOrchestrator(config)
+}
+
+// history prints every revision the orchestrator has recorded
+func history() (err error) {
+	ip, err := orchestrator()
+	if err != nil {
+		return
+	}
+	h := common.MakeHttpClient()
+
+	resp, err := h.Get("https://" + ip + ":900/history")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var revisions []struct {
+		Number  int
+		Time    time.Time
+		User    string
+		Images  map[string]string
+		Outcome string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&revisions)
+	if err != nil {
+		return
+	}
+
+	return output(revisions, func() {
+		for _, rev := range revisions {
+			fmt.Printf("%d\t%s\t%s\t%s\n", rev.Number,
+				rev.Time.Format(time.RFC3339), rev.User, rev.Outcome)
+			for container, image := range rev.Images {
+				fmt.Printf("\t%s\t%s\n", container, image)
+			}
 		}
-		err = deployConfig(ip, config)
-	} else if update == "push images" {
-		err = deployImages(ip, config)
-	} else if update == "push configuration" {
-		err = deployConfig(ip, config)
+	})
+}
+
+// rollback asks the orchestrator to redeploy an earlier revision
+func rollback(number string) (err error) {
+	ip, err := orchestrator()
+	if err != nil {
+		return
 	}
-	log.Print("Deploy Pushed")
-	return
+	h := common.MakeHttpClient()
+	log.Print("Rolling back to revision " + number)
+
+	req, err := http.NewRequest("POST",
+		"https://"+ip+":900/rollback?revision="+url.QueryEscape(number), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("X-Skeleton-User", deployUser())
+
+	resp, err := h.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	return common.JsonReader(resp.Body)
 }
 
-func main() {
+// push sends the images, the configuration or both to the orchestrator,
+// starting it or upgrading it first if need be
+func push(images bool, configuration bool) (err error) {
+	name, overlays, err := bonesFiles()
+	if err != nil {
+		return
+	}
+	config, err := loadBonesFile(name, overlays)
+	if err != nil {
+		return
+	}
 
-	flag.Parse()
-	if flag.NArg() > 1 || (len(flag.Args()) == 0) {
-		log.Print("Error - bring up help flags")
-	} else if flag.Arg(0) == "v" || flag.Arg(0) == "version" {
-		log.Print("prints version number")
+	var orch string
+	if len(orchestratorFlag) > 0 {
+		orch = findLeader(orchestratorFlag)
 	} else {
-		config := loadBonesFile()
+		orch, err = findOrchestrator(config)
+	}
+	switch err.(type) {
 
-		orch, err := findOrchestrator(config)
-		switch err.(type) {
+	// Initial Setup
+	case *NoOrchestratorFound:
+		if len(config.Machines.Ip) == 0 {
+			return errors.New("The bonesFile has no machines to start the orchestrator on")
+		}
+		keys, err := orchestratorKeys(config.Machines.Ip[0])
+		if err != nil {
+			return err
+		}
+		orch = bootstrapOrchestrator(config.Machines.Ip[0], keys...)
 
-		// Initial Setup
-		case *NoOrchestratorFound:
-			orch = bootstrapOrchestrator(config.Machines.Ip[0])
-			err = deploy(orch, config, flag.Arg(0))
+	// Update Deploy
+	case nil:
+		version, err := orchestratorVersion(orch)
+		if err != nil {
+			return err
+		}
+		if version != common.Version {
+			log.Print("Orchestrator is " + version + " not " + common.Version)
+			orch, err = upgradeOrchestrators(config, orch)
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
+		}
 
-		// Update Deploy
-		case nil:
-			D := common.NewDocker(orch)
-			Img := &common.Image{}
-			Img.Stop(D, "orchestrator")
-			Img.Stop(D, "gatekeeper")
-			orch = bootstrapOrchestrator(config.Machines.Ip[0])
-			err = deploy(orch, config, flag.Arg(0))
-			if err != nil {
-				log.Fatal(err)
-			}
+	// Error contacting orchestrator
+	default:
+		return err
+	}
+	startStandbys(config, orch)
 
-		// Error contacting orchestrator
-		default:
-			log.Fatal(err)
+	if images {
+		err = deployImages(orch, filepath.Dir(name), config)
+		if err != nil {
+			return
+		}
+	}
+	if configuration {
+		err = deployConfig(orch, config)
+		if err != nil {
+			return
 		}
 	}
+	log.Print("Deploy Pushed")
+	return
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"flag"
+	"fmt"
+	"libgatekeeper"
+	"os"
+	"strings"
+)
+
+func secretFlags(fs *flag.FlagSet) {
+	fs.StringVar(&keyFlag, "key", "", "the gatekeeper key to use, SKELETON_KEY if not given")
+}
+
+// gatekeeper connects to the gatekeeper replicas, which run on the first
+// machines of the bonesFile or with the orchestrator given by --orchestrator
+func gatekeeper() (*libgatekeeper.Client, error) {
+	key := keyFlag
+	if len(key) == 0 {
+		key = os.Getenv("SKELETON_KEY")
+	}
+	if len(key) == 0 {
+		return nil, errors.New("Secrets need a gatekeeper key, give it with --key or in SKELETON_KEY")
+	}
+
+	replicas := []string{}
+	if len(orchestratorFlag) > 0 {
+		replicas = append(replicas, orchestratorFlag+":800")
+	} else {
+		config, err := readBonesFile()
+		if err != nil {
+			return nil, err
+		}
+		for i, ip := range config.Machines.Ip {
+			if i < common.OrchestratorReplicas {
+				replicas = append(replicas, ip+":800")
+			}
+		}
+	}
+	if len(replicas) == 0 {
+		return nil, errors.New("The bonesFile has no machines running the gatekeeper")
+	}
+	return libgatekeeper.NewClient(strings.Join(replicas, ","), key), nil
+}
+
+func getSecret(args []string) error {
+	g, err := gatekeeper()
+	if err != nil {
+		return err
+	}
+	value, err := g.Get(args[0])
+	if err != nil {
+		return err
+	}
+	return output(map[string]string{"Item": args[0], "Value": value}, func() {
+		fmt.Println(value)
+	})
+}
+
+func setSecret(args []string) error {
+	g, err := gatekeeper()
+	if err != nil {
+		return err
+	}
+	err = g.Set(args[0], args[1])
+	if err != nil {
+		err = g.New(args[0], args[1])
+	}
+	return err
+}
+
+func removeSecret(args []string) error {
+	g, err := gatekeeper()
+	if err != nil {
+		return err
+	}
+	return g.Delete(args[0])
+}
+
+func listSecrets(args []string) error {
+	g, err := gatekeeper()
+	if err != nil {
+		return err
+	}
+	prefix := ""
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+	items, err := g.List(prefix)
+	if err != nil {
+		return err
+	}
+	if items == nil {
+		items = []string{}
+	}
+	return output(items, func() {
+		for _, item := range items {
+			fmt.Println(item)
+		}
+	})
+}
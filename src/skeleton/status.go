@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"common"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// status prints the orchestrator and the service catalog it keeps
+func status() error {
+	ip, err := orchestrator()
+	if err != nil {
+		return err
+	}
+	version, err := orchestratorVersion(ip)
+	if err != nil {
+		return err
+	}
+
+	resp, err := common.MakeHttpClient().Get("https://" + ip + ":900/services")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return errors.New("Orchestrator answered " + resp.Status)
+	}
+	services := make(map[string][]string)
+	err = json.NewDecoder(resp.Body).Decode(&services)
+	if err != nil {
+		return err
+	}
+
+	s := struct {
+		Orchestrator string
+		Version      string
+		Services     map[string][]string
+	}{ip, version, services}
+	return output(s, func() {
+		fmt.Println("orchestrator\t" + ip + "\t" + version)
+		names := []string{}
+		for name := range services {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(name + "\t" + strings.Join(services[name], " "))
+		}
+	})
+}
+
+// instanceLog is the end of the log of one instance of a container
+type instanceLog struct {
+	Machine   string
+	Container string
+	Lines     []string
+}
+
+// logs prints the end of the log of every instance of a container, asking
+// docker on each machine for them
+func logs(name string, tail int) error {
+	config, err := readBonesFile()
+	if err != nil {
+		return err
+	}
+	_, found := config.Containers[name]
+	if !found {
+		return errors.New(name + " is not a container in the bonesFile")
+	}
+
+	instances := []instanceLog{}
+	for _, ip := range config.Machines.Ip {
+		containers, err := common.NewDocker(ip).ListContainers()
+		if err != nil {
+			log.Print(ip + ": " + err.Error())
+			continue
+		}
+
+		for _, C := range containers {
+			if common.ImageBaseName(C.Image) != name {
+				continue
+			}
+			b := &bytes.Buffer{}
+			err = C.Logs(b, tail)
+			if err != nil {
+				return err
+			}
+
+			id := C.Id
+			if len(id) > 12 {
+				id = id[:12]
+			}
+			if !jsonOutput {
+				fmt.Printf("==> %s %s <==\n", ip, id)
+				os.Stdout.Write(b.Bytes())
+				continue
+			}
+			lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+			if b.Len() == 0 {
+				lines = []string{}
+			}
+			instances = append(instances, instanceLog{ip, id, lines})
+		}
+	}
+	if jsonOutput {
+		return output(instances, nil)
+	}
+	return nil
+}